@@ -0,0 +1,162 @@
+package authclient
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned for a kid that is not in the key set.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySource resolves the public key and algorithm for the kid of a token.
+// An empty kid asks for the current signing key.
+type KeySource interface {
+	PublicKey(kid string) (crypto.PublicKey, string, error)
+}
+
+type publishedKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// RemoteKeySet is a KeySource that caches the JWKS published by the auth
+// server and refreshes it in the background.
+type RemoteKeySet struct {
+	url       string
+	client    *http.Client
+	interval  time.Duration
+	mu        sync.RWMutex
+	keys      map[string]publishedKey
+	current   string
+	fetchedAt time.Time
+	stop      chan struct{}
+}
+
+// minRefetchInterval throttles on-demand fetches triggered by unknown kids.
+const minRefetchInterval = time.Minute
+
+// NewRemoteKeySet creates a key set for the JWKS at url, typically
+// https://<auth-server>/.well-known/jwks.json. A zero interval defaults to
+// ten minutes; a nil client to http.DefaultClient.
+func NewRemoteKeySet(url string, interval time.Duration, client *http.Client) *RemoteKeySet {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteKeySet{
+		url:      url,
+		client:   client,
+		interval: interval,
+		keys:     make(map[string]publishedKey),
+	}
+}
+
+// PublicKey implements KeySource. Unknown kids trigger a refetch, so keys
+// rotated in between background refreshes are picked up.
+func (ks *RemoteKeySet) PublicKey(kid string) (crypto.PublicKey, string, error) {
+	if key, ok := ks.lookup(kid); ok {
+		return key.key, key.alg, nil
+	}
+
+	ks.mu.RLock()
+	recent := time.Since(ks.fetchedAt) < minRefetchInterval
+	ks.mu.RUnlock()
+	if !recent {
+		if err := ks.Refresh(); err != nil {
+			return nil, "", err
+		}
+		if key, ok := ks.lookup(kid); ok {
+			return key.key, key.alg, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+func (ks *RemoteKeySet) lookup(kid string) (publishedKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if kid == "" {
+		kid = ks.current
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// Refresh downloads the JWKS and replaces the cached keys.
+func (ks *RemoteKeySet) Refresh() error {
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return fmt.Errorf("error fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching JWKS: status %d", resp.StatusCode)
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("error decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]publishedKey, len(jwks.Keys))
+	current := ""
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// Skip keys this client cannot use rather than failing the set
+			continue
+		}
+		keys[jwk.Kid] = publishedKey{key: key, alg: jwk.Alg}
+		if current == "" {
+			// The server lists its current signing key first
+			current = jwk.Kid
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.current = current
+	ks.fetchedAt = time.Now()
+	return nil
+}
+
+// Start fetches the key set and keeps it fresh until Stop is called.
+func (ks *RemoteKeySet) Start() error {
+	err := ks.Refresh()
+	if ks.stop != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	ks.stop = stop
+	go func() {
+		ticker := time.NewTicker(ks.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ks.Refresh(); err != nil {
+					fmt.Println("Error refreshing JWKS:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return err
+}
+
+// Stop ends the background refresh.
+func (ks *RemoteKeySet) Stop() {
+	if ks.stop != nil {
+		close(ks.stop)
+		ks.stop = nil
+	}
+}
@@ -0,0 +1,92 @@
+package authclient
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by Middleware.
+const (
+	ClaimsKey = "authclient.claims"
+	UserIDKey = "user_id"
+	EmailKey  = "email"
+	RolesKey  = "roles"
+)
+
+// Middleware verifies the bearer token of every request and stores the
+// parsed claims in the context. Requests without a valid token get a 401.
+func Middleware(verifier *Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		claims, err := verifier.Verify(token)
+		if errors.Is(err, ErrRevocationCheck) {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not verify token"})
+			return
+		}
+		if errors.Is(err, ErrTokenRevoked) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			return
+		}
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		c.Set(ClaimsKey, claims)
+		c.Set(UserIDKey, claims.UserID)
+		c.Set(EmailKey, claims.Email)
+		c.Set(RolesKey, claims.Roles)
+		c.Next()
+	}
+}
+
+// RequireRole only lets through requests whose token holds one of the role
+// codes. It must run after Middleware.
+func RequireRole(codes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := GetClaims(c)
+		if claims == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+		if !claims.HasRole(codes...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient role"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireScope only lets through requests whose token holds every one of the
+// scopes. It must run after Middleware.
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := GetClaims(c)
+		if claims == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+		if !claims.HasScope(scopes...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetClaims returns the claims stored by Middleware, or nil.
+func GetClaims(c *gin.Context) *Claims {
+	value, _ := c.Get(ClaimsKey)
+	claims, _ := value.(*Claims)
+	return claims
+}
@@ -0,0 +1,200 @@
+// Package authclient verifies access tokens issued by the global auth server
+// in downstream gin services.
+//
+//	keys := authclient.NewRemoteKeySet("https://auth.example.com/.well-known/jwks.json", 0, nil)
+//	_ = keys.Start()
+//	verifier := authclient.NewVerifier(keys, authclient.Config{
+//		Issuer:   "global-auth-server",
+//		Audience: "reports",
+//	})
+//	r.Use(authclient.Middleware(verifier))
+//	r.GET("/reports", authclient.RequireRole("REPORTS_VIEW"), handler)
+package authclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrTokenRevoked is returned by Verify when the revocation hook rejects a token.
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrRevocationCheck is returned by Verify when the revocation hook fails.
+	ErrRevocationCheck = errors.New("could not check token revocation")
+	// ErrNotAccessToken is returned by Verify for tokens without the access
+	// token typ header, such as id_tokens.
+	ErrNotAccessToken = errors.New("token is not an access token")
+)
+
+// AccessTokenType is the typ header of access tokens (RFC 9068).
+const AccessTokenType = "at+jwt"
+
+// Role is a role granted to the user, as stored in the roles claim.
+type Role struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Actor identifies the staff member behind an impersonation token (the act
+// claim of RFC 8693).
+type Actor struct {
+	Sub   string `json:"sub"`
+	Email string `json:"email"`
+}
+
+// Claims are the claims of an access token issued by the auth server.
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Roles  []Role `json:"roles"`
+	// ClientID is set on tokens a client obtained for itself with the
+	// client_credentials grant; UserID is empty on those.
+	ClientID string `json:"client_id"`
+	// Scope is the space separated list of granted scopes.
+	Scope string `json:"scope"`
+	// Actor is set when a staff member is impersonating the user.
+	Actor *Actor `json:"act,omitempty"`
+	// Raw holds every claim of the token, including custom ones.
+	Raw jwt.MapClaims `json:"-"`
+}
+
+// HasRole reports whether the claims hold any of the role codes.
+func (c *Claims) HasRole(codes ...string) bool {
+	for _, role := range c.Roles {
+		if slices.Contains(codes, role.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the claims hold every one of the scopes.
+func (c *Claims) HasScope(scopes ...string) bool {
+	granted := strings.Fields(c.Scope)
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Config holds the checks applied on top of the signature.
+type Config struct {
+	// Issuer is the expected iss claim; empty skips the check.
+	Issuer string
+	// MissingIssuerUntil accepts tokens without iss until this time, for
+	// tokens issued by servers older than the iss claim. Zero rejects them.
+	MissingIssuerUntil time.Time
+	// Audience is the expected aud value; empty skips the check.
+	Audience string
+	// ClockSkew is the leeway applied to exp, nbf and iat.
+	ClockSkew time.Duration
+	// Algorithms restricts the accepted JWS algorithms. Defaults to RS256,
+	// ES256 and EdDSA.
+	Algorithms []string
+	// IsRevoked optionally rejects tokens that were revoked before expiry.
+	IsRevoked func(claims *Claims) (bool, error)
+}
+
+// Verifier checks tokens against a KeySource.
+type Verifier struct {
+	keys   KeySource
+	config Config
+}
+
+// NewVerifier creates a verifier for tokens signed with keys from the source.
+func NewVerifier(keys KeySource, config Config) *Verifier {
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodES256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}
+	}
+	return &Verifier{keys: keys, config: config}
+}
+
+// Verify checks the signature, algorithm, type, time claims, issuer and
+// audience of the access token and returns its claims.
+func (v *Verifier) Verify(tokenString string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.config.Algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.config.ClockSkew),
+	}
+	if v.config.Audience != "" {
+		options = append(options, jwt.WithAudience(v.config.Audience))
+	}
+
+	raw := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, raw, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, alg, err := v.keys.PublicKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Each key only verifies the algorithm it signs with
+		if token.Method.Alg() != alg {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens from servers older than iss predate the typ header as well
+	issuer, _ := raw.GetIssuer()
+	legacy := issuer == "" && time.Now().Before(v.config.MissingIssuerUntil)
+	if v.config.Issuer != "" && issuer != v.config.Issuer && !legacy {
+		return nil, fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, jwt.ErrTokenInvalidIssuer)
+	}
+	if !legacy && !isAccessTokenType(token.Header["typ"]) {
+		return nil, ErrNotAccessToken
+	}
+
+	claims, err := decodeClaims(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.config.IsRevoked != nil {
+		revoked, err := v.config.IsRevoked(claims)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRevocationCheck, err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	return claims, nil
+}
+
+// isAccessTokenType accepts the typ header with or without the
+// "application/" prefix, compared case-insensitively (RFC 9068, section 2.1).
+func isAccessTokenType(typ any) bool {
+	value, _ := typ.(string)
+	return strings.TrimPrefix(strings.ToLower(value), "application/") == AccessTokenType
+}
+
+func decodeClaims(raw jwt.MapClaims) (*Claims, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding claims: %w", err)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("error decoding claims: %w", err)
+	}
+	claims.Raw = raw
+	return claims, nil
+}
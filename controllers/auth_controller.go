@@ -2,18 +2,22 @@ package controllers
 
 import (
 	"encoding/base64"
+	"errors"
 	"global-auth-server/libs"
 	"global-auth-server/services"
 	"net/http"
+	"strconv"
 	"time"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // LoginRequest represents the request body for the login endpoint.
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// Audience optionally restricts the token to one client application,
+	// which must be registered with the password grant.
+	Audience string `json:"audience,omitempty"`
 }
 
 // UserResponse represents the response body for user information.
@@ -36,10 +40,19 @@ type UserResponse struct {
 
 // LoginResponse represents the response body for a successful login.
 type LoginResponse struct {
-	Message   string       `json:"message"`
-	User      UserResponse `json:"user"`
-	Token     string       `json:"token"`
-	ExpiredAt int64        `json:"expired_at"`
+	Message          string       `json:"message"`
+	User             UserResponse `json:"user"`
+	Token            string       `json:"token"`
+	ExpiredAt        int64        `json:"expired_at"`
+	// IDToken is only issued for logins through a registered client
+	IDToken          string       `json:"id_token,omitempty"`
+	RefreshToken     string       `json:"refresh_token"`
+	RefreshExpiredAt int64        `json:"refresh_expired_at"`
+}
+
+// RefreshRequest represents the request body for the refresh endpoint.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 // ErrorResponse represents a generic error response.
@@ -47,16 +60,26 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// LockedResponse represents the response for a locked account.
+type LockedResponse struct {
+	Error       string `json:"error"`
+	LockedUntil int64  `json:"locked_until"`
+}
+
 // Login godoc
 // @Summary Authenticate user and return JWT token
-// @Description Authenticate user with email and password.
+// @Description Authenticate user with email and password. Returns a short-lived access token and a refresh token. Each successful login, counted when the tokens are issued (after the second factor), uses up one of the logins allowed with the password (PASSWORD_MAX_LOGINS); inactive users and exhausted passwords get a 403. Since no token is issued then, exhausted passwords and locked accounts are recovered through /auth/password/forgot, which also lifts the lock. Users with MFA enabled, or holding a role that requires it, get a 202 with an MFA challenge to complete on /auth/mfa/verify instead. A directory user whose entry is linked to another user, or who cannot be provisioned because the username is taken, gets a 409.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param body body LoginRequest true "User credentials"
 // @Success 200 {object} LoginResponse
+// @Success 202 {object} MFAChallengeResponse
 // @Failure 400 {object} ErrorResponse
 // @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} FederatedLoginResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
 // @Router /auth/login [post]
 func Login(c *gin.Context) {
 	loggingService := services.NewLoggingService()
@@ -66,71 +89,325 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	user, err := services.GetUserByEmail(req.Email)
+	options, err := audienceOptions(req.Audience)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user or password"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid audience"})
 		return
 	}
 
-	// Validate password using bcrypt
 	decodedPasswordBytes, err := base64.StdEncoding.DecodeString(req.Password)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password format"})
 		return
 	}
-	
-	decodedPassword := string(decodedPasswordBytes)
-	if user.Password == nil || bcrypt.CompareHashAndPassword([]byte(*user.Password), []byte(decodedPassword)) != nil {
+
+	user, err := authenticate(c, req.Email, string(decodedPasswordBytes))
+	var locked *services.AccountLockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(locked.Until).Seconds())+1, 10))
+		c.JSON(http.StatusLocked, LockedResponse{Error: "Account locked, try again later or reset your password at /auth/password/forgot", LockedUntil: locked.Until.Unix()})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidCredentials) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user or password"})
 		return
 	}
+	var federated *services.FederatedLoginError
+	if errors.As(err, &federated) {
+		c.JSON(http.StatusForbidden, FederatedLoginResponse{Error: "Sign in with the identity provider of your organization at /oauth/authorize", ProviderID: federated.ProviderID})
+		return
+	}
+	if errors.Is(err, services.ErrUserInactive) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is inactive"})
+		return
+	}
+	if errors.Is(err, services.ErrPasswordExpired) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password usage limit reached, reset your password at /auth/password/forgot"})
+		return
+	}
+	var taken *services.UsernameTakenError
+	if errors.Is(err, services.ErrIdentityLinkedToOtherUser) || errors.As(err, &taken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your directory account cannot be linked to a user, contact the administrator"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+		return
+	}
+
+	// Users with MFA complete the login on /auth/mfa/verify
+	challenge, err := startMFAChallenge(user, req.Audience)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+		return
+	}
+	if challenge != nil {
+		c.JSON(http.StatusAccepted, challenge)
+		return
+	}
+
+	if err := services.CountPasswordLogin(user); errors.Is(err, services.ErrPasswordExpired) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password usage limit reached, reset your password at /auth/password/forgot"})
+		return
+	} else if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+		return
+	}
+	loginResponse, err := issueTokens(user, options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	loginResponse.Message = "Login successful"
+
+	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Login successful", "user": loginResponse.User.Email}, "LOGIN_SUCCESS")
+
+	c.JSON(http.StatusOK, loginResponse)
+}
+
+// Refresh godoc
+// @Summary Rotate a refresh token
+// @Description Exchange a refresh token for a new access token and a new refresh token. The user and roles are read again, and replaying an already used refresh token revokes every token of that login.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body RefreshRequest true "Refresh token"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /auth/refresh [post]
+func Refresh(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	tokenConfig := libs.GetTokenConfig()
+	ttl := tokenConfig.RefreshTokenTTL
+	// The lifetime of the new refresh token depends on the client it is bound to
+	if previous, err := services.GetRefreshToken(req.RefreshToken); err == nil && previous.Audience != "" {
+		if client, err := services.GetClient(previous.Audience); err == nil {
+			ttl = client.RefreshTokenLifetime()
+		}
+	}
+	refreshToken, next, err := services.RotateRefreshToken(req.RefreshToken, "", ttl)
+	if errors.Is(err, services.ErrRefreshTokenReused) {
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Refresh token reuse detected"}, "REFRESH_TOKEN_REUSED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if errors.Is(err, services.ErrRefreshTokenInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh token"})
+		return
+	}
+
+	user, err := services.GetUserByID(next.UserID)
+	if err != nil || !user.IsActive {
+		_ = services.RevokeUserRefreshTokens(next.UserID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	options, err := audienceOptions(next.Audience)
+	if err != nil {
+		// The client the token was bound to is gone
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	response, err := issueAccessToken(user, options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	response.Message = "Token refreshed"
+	response.RefreshToken = refreshToken
+	response.RefreshExpiredAt = next.ExpiresAt.Unix()
 
+	c.JSON(http.StatusOK, response)
+}
+
+// authenticate checks the credentials of a login form and audits failed
+// attempts and accounts that get locked.
+func authenticate(c *gin.Context, email string, password string) (*services.User, error) {
+	loggingService := services.NewLoggingService()
+	user, err := services.AuthenticateUser(email, password)
+
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		response := gin.H{"message": "Account locked", "user": email, "locked_until": locked.Until.Unix()}
+		if locked.JustLocked {
+			loggingService.Log(locked.UserID, c.Request.URL.Path, nil, gin.H{"message": "Invalid user or password", "user": email}, "LOGIN_FAILED")
+			loggingService.Log(locked.UserID, c.Request.URL.Path, nil, response, "ACCOUNT_LOCKED")
+		} else {
+			loggingService.Log(locked.UserID, c.Request.URL.Path, nil, response, "LOGIN_FAILED")
+		}
+	case errors.Is(err, services.ErrInvalidCredentials):
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Invalid user or password", "user": email}, "LOGIN_FAILED")
+	case errors.Is(err, services.ErrUserInactive), errors.Is(err, services.ErrPasswordExpired),
+		errors.Is(err, services.ErrIdentityLinkedToOtherUser), errors.As(err, new(*services.UsernameTakenError)):
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": err.Error(), "user": email}, "LOGIN_FAILED")
+	}
+	return user, err
+}
+
+// tokenOptions customizes the tokens issued for a user.
+type tokenOptions struct {
+	// Audience restricts the tokens to one client; empty means the
+	// configured default audiences.
+	Audience string
+	// Client is the registered client the tokens are issued for. Its
+	// lifetimes apply and only the roles it may see are included.
+	Client *services.Client
+	// Nonce is echoed in the id_token for OpenID Connect clients.
+	Nonce string
+	// Scope is the scope granted to the client, kept on the refresh token
+	// so that refreshing cannot widen it.
+	Scope string
+	// Actor is the staff member impersonating the user. The access token
+	// gets an act claim and the fixed impersonation lifetime, and no
+	// id_token is issued.
+	Actor *services.User
+}
+
+// clientOptions issues tokens for a registered client.
+func clientOptions(client *services.Client) tokenOptions {
+	return tokenOptions{Audience: client.ID, Client: client}
+}
+
+// audienceOptions resolves the audience requested at login, which is either
+// one of the configured audiences or a registered client allowed to use the
+// password grant.
+func audienceOptions(audience string) (tokenOptions, error) {
+	if audience == "" {
+		return tokenOptions{}, nil
+	}
+	client, err := services.GetClient(audience)
+	if err == nil {
+		if !client.AllowsGrantType(services.PasswordGrantType) {
+			return tokenOptions{}, services.ErrInvalidClient
+		}
+		return clientOptions(client), nil
+	}
+	if !libs.GetTokenConfig().AllowsAudience(audience) {
+		return tokenOptions{}, err
+	}
+	return tokenOptions{Audience: audience}, nil
+}
+
+// issueTokens builds the login response for a user with a fresh access token
+// and a refresh token starting a new family.
+func issueTokens(user *services.User, options tokenOptions) (LoginResponse, error) {
+	response, err := issueAccessToken(user, options)
+	if err != nil {
+		return response, err
+	}
+
+	ttl := libs.GetTokenConfig().RefreshTokenTTL
+	if options.Client != nil {
+		if !options.Client.AllowsGrantType("refresh_token") {
+			return response, nil
+		}
+		ttl = options.Client.RefreshTokenLifetime()
+	}
+	refreshToken, stored, err := services.CreateRefreshToken(user.ID, options.Audience, options.Scope, ttl)
+	if err != nil {
+		return response, err
+	}
+	response.RefreshToken = refreshToken
+	response.RefreshExpiredAt = stored.ExpiresAt.Unix()
+	return response, nil
+}
+
+// issueAccessToken reads the user roles and signs a short-lived access token.
+func issueAccessToken(user *services.User, options tokenOptions) (LoginResponse, error) {
 	// Get user roles
 	roles, err := services.GetRolesByUserID(user.ID)
 	if err != nil {
 		roles = []services.Role{}
 	}
-
-	userResponse := UserResponse{
-		ID:              user.ID,
-		Username:        user.Username,
-		Code:            user.Code,
-		Names:           user.Names,
-		Email:           user.Email,
-		RolID:           user.RolID,
-		IsStaff:         user.IsStaff,
-		IsActive:        user.IsActive,
-		BossID:          user.BossID,
-		Logins:          user.Logins,
-		CanDownloadXlsx: user.CanDownloadXlsx,
-		BankID:          user.BankID,
-		FilialID:        user.FilialID,
-		Roles:           roles,
+	ttl := libs.GetTokenConfig().AccessTokenTTL
+	if options.Client != nil {
+		roles = options.Client.FilterRoles(roles)
+		ttl = options.Client.AccessTokenLifetime()
 	}
 
+	userResponse := newUserResponse(user, roles)
+
 	// JWT payload (puedes ajustar los campos que quieras incluir)
 	payload := map[string]any{
+		"sub":     user.ID,
 		"user_id": user.ID,
 		"email":   user.Email,
 		"roles":   roles,
 	}
+	if options.Audience != "" {
+		payload["aud"] = options.Audience
+	}
+	if options.Actor != nil {
+		payload["act"] = map[string]any{"sub": options.Actor.ID, "email": options.Actor.Email}
+		ttl = services.ImpersonationTokenTTL
+	}
 
-	token, expiredAt, err := libs.GenerateJWT(payload, 30*24*time.Hour)
+	token, expiredAt, err := libs.GenerateJWT(payload, ttl)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
-		return
+		return LoginResponse{}, err
+	}
+	// An id_token is only issued to a registered client, and never for
+	// impersonation
+	if options.Actor != nil || options.Client == nil {
+		return LoginResponse{User: userResponse, Token: token, ExpiredAt: expiredAt}, nil
 	}
 
-	loginResponse := LoginResponse{
-		Message:   "Login successful",
+	// OpenID Connect id_token for the client, with the profile claims of
+	// userinfo; roles are only carried by the access token
+	idPayload := newUserInfo(user, nil).claims()
+	delete(idPayload, "roles")
+	idPayload["aud"] = options.Client.ID
+	idPayload["auth_time"] = time.Now().Unix()
+	if options.Nonce != "" {
+		idPayload["nonce"] = options.Nonce
+	}
+	idToken, _, err := libs.GenerateIDToken(idPayload, ttl)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
 		User:      userResponse,
 		Token:     token,
 		ExpiredAt: expiredAt,
-	}
-
-	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Login successful", "user": userResponse.Email}, "LOGIN_SUCCESS")
+		IDToken:   idToken,
+	}, nil
+}
 
-	c.JSON(http.StatusOK, loginResponse)
+func newUserResponse(user *services.User, roles []services.Role) UserResponse {
+	return UserResponse{
+		ID:              user.ID,
+		Username:        user.Username,
+		Code:            user.Code,
+		Names:           user.Names,
+		Email:           user.Email,
+		RolID:           user.RolID,
+		IsStaff:         user.IsStaff,
+		IsActive:        user.IsActive,
+		BossID:          user.BossID,
+		Logins:          user.Logins,
+		CanDownloadXlsx: user.CanDownloadXlsx,
+		BankID:          user.BankID,
+		FilialID:        user.FilialID,
+		Roles:           roles,
+	}
 }
 
 func CanLogin(c *gin.Context) {
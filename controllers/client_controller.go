@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientResponse represents a registered client. ClientSecret is only
+// returned when the secret is generated.
+type ClientResponse struct {
+	services.Client
+	ClientSecret string `json:"client_secret,omitempty"`
+	Confidential bool   `json:"confidential"`
+}
+
+func newClientResponse(client *services.Client, secret string) ClientResponse {
+	return ClientResponse{Client: *client, ClientSecret: secret, Confidential: client.IsConfidential()}
+}
+
+// ListClients godoc
+// @Summary List OAuth2 clients
+// @Description Returns every registered client. Requires the admin role.
+// @Tags clients
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} ClientResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/clients [get]
+func ListClients(c *gin.Context) {
+	clients, err := services.ListClients()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list clients"})
+		return
+	}
+
+	response := make([]ClientResponse, 0, len(clients))
+	for i := range clients {
+		response = append(response, newClientResponse(&clients[i], ""))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetClient godoc
+// @Summary Get an OAuth2 client
+// @Description Returns a registered client. Requires the admin role.
+// @Tags clients
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client id"
+// @Success 200 {object} ClientResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/clients/{client_id} [get]
+func GetClient(c *gin.Context) {
+	client, err := services.GetClient(c.Param("client_id"))
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newClientResponse(client, ""))
+}
+
+// CreateClient godoc
+// @Summary Register an OAuth2 client
+// @Description Registers a client with its redirect URIs, grant types, token lifetimes (seconds) and the role codes its tokens may carry. Confidential clients get a generated secret that is only shown in this response. Requires the admin role.
+// @Tags clients
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body services.ClientInput true "Client settings"
+// @Success 201 {object} ClientResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /admin/clients [post]
+func CreateClient(c *gin.Context) {
+	var req services.ClientInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	client, secret, err := services.CreateClient(req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, req, gin.H{"message": "Client created", "client_id": client.ID}, "CLIENT_CREATED")
+
+	c.JSON(http.StatusCreated, newClientResponse(client, secret))
+}
+
+// UpdateClient godoc
+// @Summary Update an OAuth2 client
+// @Description Replaces the settings of a client. The client id, secret and confidentiality do not change. Requires the admin role.
+// @Tags clients
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client id"
+// @Param body body services.ClientInput true "Client settings"
+// @Success 200 {object} ClientResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/clients/{client_id} [put]
+func UpdateClient(c *gin.Context) {
+	var req services.ClientInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	client, err := services.UpdateClient(c.Param("client_id"), req)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, req, gin.H{"message": "Client updated", "client_id": client.ID}, "CLIENT_UPDATED")
+
+	c.JSON(http.StatusOK, newClientResponse(client, ""))
+}
+
+// RotateClientSecret godoc
+// @Summary Rotate the secret of an OAuth2 client
+// @Description Generates a new secret for a confidential client; the old one stops working. Requires the admin role.
+// @Tags clients
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client id"
+// @Success 200 {object} ClientResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/clients/{client_id}/secret [post]
+func RotateClientSecret(c *gin.Context) {
+	clientID := c.Param("client_id")
+	secret, err := services.RotateClientSecret(clientID)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+	client, err := services.GetClient(clientID)
+	if err != nil {
+		clientError(c, err)
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Client secret rotated", "client_id": clientID}, "CLIENT_SECRET_ROTATED")
+
+	c.JSON(http.StatusOK, newClientResponse(client, secret))
+}
+
+// DeleteClient godoc
+// @Summary Delete an OAuth2 client
+// @Description Removes a client and revokes the refresh tokens issued for it. Requires the admin role.
+// @Tags clients
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/clients/{client_id} [delete]
+func DeleteClient(c *gin.Context) {
+	clientID := c.Param("client_id")
+	if err := services.DeleteClient(clientID); err != nil {
+		clientError(c, err)
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Client deleted", "client_id": clientID}, "CLIENT_DELETED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Client deleted"})
+}
+
+// clientError maps the errors of the client service to responses.
+func clientError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidClient):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+	case errors.Is(err, services.ErrClientExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Client already exists"})
+	case errors.Is(err, services.ErrInvalidClientData):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save client"})
+	}
+}
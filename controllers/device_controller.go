@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/services"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceAuthorizationResponse represents the device authorization response
+// (RFC 8628 section 3.2).
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceAuthorization godoc
+// @Summary OAuth2 device authorization endpoint
+// @Description Starts the device authorization flow (RFC 8628) for clients that cannot open a browser. The device shows the user code and polls /oauth/token with the device code. Requested scopes must be OpenID Connect scopes or scopes of the client.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param client_id formData string false "Client id, unless sent with HTTP Basic"
+// @Param scope formData string false "Requested scopes"
+// @Success 200 {object} DeviceAuthorizationResponse
+// @Failure 400 {object} OAuthErrorResponse
+// @Failure 401 {object} OAuthErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /oauth/device_authorization [post]
+func DeviceAuthorization(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	client, err := tokenEndpointClient(c)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		c.JSON(http.StatusUnauthorized, OAuthErrorResponse{Error: "invalid_client"})
+		return
+	}
+	if !client.AllowsGrantType(services.DeviceCodeGrantType) {
+		c.JSON(http.StatusBadRequest, OAuthErrorResponse{Error: "unauthorized_client", ErrorDescription: "the device flow is not allowed for this client"})
+		return
+	}
+	if !client.AllowsUserScopes(c.PostForm("scope")) {
+		c.JSON(http.StatusBadRequest, OAuthErrorResponse{Error: "invalid_scope", ErrorDescription: "a requested scope is not allowed for this client"})
+		return
+	}
+
+	authorization, err := services.CreateDeviceAuthorization(client.ID, c.PostForm("scope"))
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, OAuthErrorResponse{Error: "server_error"})
+		return
+	}
+
+	userCode := services.FormatUserCode(authorization.UserCode)
+	verificationURI := publicBaseURL(c) + "/oauth/device"
+	c.JSON(http.StatusOK, DeviceAuthorizationResponse{
+		DeviceCode:              authorization.DeviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               authorization.ExpiresIn,
+		Interval:                authorization.Interval,
+	})
+}
+
+// DeviceVerification godoc
+// @Summary Device verification page
+// @Description Renders the page where the user enters the code shown by the device and logs in to approve it.
+// @Tags oauth
+// @Produce html
+// @Param user_code query string false "User code shown by the device"
+// @Success 200 {string} string "Verification page"
+// @Router /oauth/device [get]
+func DeviceVerification(c *gin.Context) {
+	c.HTML(http.StatusOK, "device.html", gin.H{"userCode": c.Query("user_code")})
+}
+
+// DeviceVerify godoc
+// @Summary Approve or deny a device
+// @Description Checks the user code and the credentials entered on the verification page and approves or denies the device. Denying also requires the credentials, so a user code alone cannot cancel someone else's request. Users whose second factor is a passkey confirm with it on a second page.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param user_code formData string true "User code shown by the device"
+// @Param email formData string false "User email, except on the passkey step"
+// @Param password formData string false "User password, except on the passkey step"
+// @Param code formData string false "Verification code, for users with MFA"
+// @Param mfa_token formData string false "MFA token of the passkey step"
+// @Param session_id formData string false "WebAuthn session id of the passkey step"
+// @Param credential formData string false "PublicKeyCredential returned by navigator.credentials.get, serialized as JSON"
+// @Param action formData string false "approve (default) or deny"
+// @Success 200 {string} string "Result page"
+// @Failure 400 {string} string "Verification page with an error"
+// @Failure 401 {string} string "Verification page with an error"
+// @Router /oauth/device [post]
+func DeviceVerify(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	userCode := c.PostForm("user_code")
+
+	code, err := services.GetPendingDeviceCode(userCode)
+	if errors.Is(err, services.ErrInvalidGrant) {
+		renderDevice(c, http.StatusBadRequest, userCode, "El código no es válido o ha expirado")
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		renderDevice(c, http.StatusInternalServerError, userCode, "No se pudo verificar el código")
+		return
+	}
+
+	var user *services.User
+	if c.PostForm("mfa_token") != "" {
+		// Second step of a user with passkeys
+		user, err = finishFormMFA(c, code.ClientID)
+	} else {
+		user, err = authenticate(c, c.PostForm("email"), c.PostForm("password"))
+		if err == nil {
+			err = checkFormMFA(c, user)
+		}
+	}
+	if errors.Is(err, services.ErrPasskeyRequired) {
+		if mfaToken, err := startFormMFA(c, user, code.ClientID); err == nil {
+			c.HTML(http.StatusOK, "device.html", gin.H{"userCode": userCode, "mfaToken": mfaToken, "passkey": true, "action": c.PostForm("action")})
+			return
+		}
+	}
+	if err != nil {
+		status, message := loginFormError(c, err)
+		renderDevice(c, status, userCode, message)
+		return
+	}
+
+	if c.PostForm("action") == "deny" {
+		if err := services.DenyDeviceCode(code.UserCode); err != nil && !errors.Is(err, services.ErrInvalidGrant) {
+			c.Error(err)
+		}
+		loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Device denied", "user": user.Email, "client_id": code.ClientID}, "DEVICE_DENIED")
+		c.HTML(http.StatusOK, "device.html", gin.H{"done": "Se ha rechazado el acceso del dispositivo."})
+		return
+	}
+
+	if err := services.CountPasswordLogin(user); err != nil {
+		status, message := loginFormError(c, err)
+		renderDevice(c, status, userCode, message)
+		return
+	}
+	err = services.ApproveDeviceCode(code.UserCode, user.ID)
+	if errors.Is(err, services.ErrInvalidGrant) {
+		renderDevice(c, http.StatusBadRequest, userCode, "El código no es válido o ha expirado")
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		renderDevice(c, http.StatusInternalServerError, userCode, "No se pudo autorizar el dispositivo")
+		return
+	}
+
+	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Device approved", "user": user.Email, "client_id": code.ClientID}, "LOGIN_SUCCESS")
+
+	c.HTML(http.StatusOK, "device.html", gin.H{"done": "Dispositivo autorizado. Puede volver a la aplicación."})
+}
+
+func renderDevice(c *gin.Context, status int, userCode string, message string) {
+	c.HTML(status, "device.html", gin.H{
+		"userCode": userCode,
+		"error":    message,
+	})
+}
+
+func deviceCodeGrant(c *gin.Context, client *services.Client) (*TokenResponse, error) {
+	code, err := services.PollDeviceCode(c.PostForm("device_code"), client.ID)
+	switch {
+	case errors.Is(err, services.ErrAuthorizationPending):
+		return nil, &oauthError{Code: "authorization_pending", Description: "the user has not approved the device yet"}
+	case errors.Is(err, services.ErrSlowDown):
+		return nil, &oauthError{Code: "slow_down", Description: "polling too fast"}
+	case errors.Is(err, services.ErrAccessDenied):
+		return nil, &oauthError{Code: "access_denied", Description: "the user denied the device"}
+	case errors.Is(err, services.ErrExpiredToken):
+		return nil, &oauthError{Code: "expired_token", Description: "the device code has expired"}
+	case errors.Is(err, services.ErrInvalidGrant):
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid device code"}
+	case err != nil:
+		return nil, err
+	}
+
+	user, err := services.GetUserByID(*code.UserID)
+	if err != nil || !user.IsActive {
+		return nil, &oauthError{Code: "invalid_grant", Description: "user is not active"}
+	}
+
+	options := clientOptions(client)
+	options.Scope = code.Scope
+	response, err := issueTokens(user, options)
+	if err != nil {
+		return nil, err
+	}
+	return newTokenResponse(response, code.Scope), nil
+}
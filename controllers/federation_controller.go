@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FederatedLoginResponse is returned by the password login for users that
+// sign in at the identity provider of their domain.
+type FederatedLoginResponse struct {
+	Error      string `json:"error"`
+	ProviderID string `json:"provider_id"`
+}
+
+// IdentityProviderResponse represents an upstream identity provider. The
+// client secret is never returned.
+type IdentityProviderResponse struct {
+	services.IdentityProvider
+	HasClientSecret bool `json:"has_client_secret"`
+}
+
+func newIdentityProviderResponse(provider *services.IdentityProvider) IdentityProviderResponse {
+	return IdentityProviderResponse{IdentityProvider: *provider, HasClientSecret: provider.ClientSecret != ""}
+}
+
+// startFederatedLogin sends the browser to the identity provider. The
+// authorization request is resumed by FederationCallback.
+func startFederatedLogin(c *gin.Context, provider *services.IdentityProvider, req *AuthorizeRequest, email string) {
+	request, err := json.Marshal(req)
+	if err == nil {
+		var target string
+		target, err = services.StartFederatedLogin(provider, publicBaseURL(c)+"/oauth/federation/callback", email, request)
+		if err == nil {
+			c.Redirect(http.StatusFound, target)
+			return
+		}
+	}
+
+	c.Error(err)
+	renderLogin(c, http.StatusBadGateway, req, "No se pudo contactar con el proveedor de identidad de su organización")
+}
+
+// FederationCallback godoc
+// @Summary Identity provider callback
+// @Description Receives the user back from an upstream identity provider, verifies its id_token, and redirects to the client with an authorization code for the linked local user. Locked accounts are refused. Users with MFA enabled, with passkeys or with a role that requires MFA complete the second factor here, unless the provider asserts a multi-factor login with amr "mfa"; the login page then asks for the code or the passkey.
+// @Tags oauth
+// @Produce html
+// @Param state query string true "State sent to the provider"
+// @Param code query string false "Authorization code of the provider"
+// @Param error query string false "Error returned by the provider"
+// @Success 200 {string} string "Login page asking for the second factor"
+// @Success 302 {string} string "Redirect to the client with the code"
+// @Failure 400 {string} string "Login page with an error"
+// @Failure 401 {string} string "Login page with an error"
+// @Failure 403 {string} string "Login page with an error"
+// @Failure 409 {string} string "Login page with an error for an identity that cannot be linked"
+// @Failure 423 {string} string "Login page with an error for a locked account"
+// @Router /oauth/federation/callback [get]
+func FederationCallback(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	state, err := services.TakeFederationState(c.Query("state"))
+	if err != nil {
+		if !errors.Is(err, services.ErrInvalidFederationState) {
+			c.Error(err)
+		}
+		c.HTML(http.StatusBadRequest, "login.html", gin.H{
+			"fatal": "La solicitud de inicio de sesión expiró o no es válida; vuelva a la aplicación e inténtelo de nuevo",
+		})
+		return
+	}
+
+	var req AuthorizeRequest
+	if err := json.Unmarshal(state.Request, &req); err != nil {
+		c.Error(err)
+		c.HTML(http.StatusBadRequest, "login.html", gin.H{
+			"fatal": "La solicitud de inicio de sesión no es válida",
+		})
+		return
+	}
+	if _, ok := validateAuthorizeRequest(c, &req); !ok {
+		return
+	}
+
+	if upstreamError := c.Query("error"); upstreamError != "" {
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Identity provider returned an error", "provider_id": state.ProviderID, "error": upstreamError, "error_description": c.Query("error_description")}, "LOGIN_FAILED")
+		renderLogin(c, http.StatusUnauthorized, &req, "El proveedor de identidad no completó el inicio de sesión")
+		return
+	}
+
+	user, mfa, err := services.CompleteFederatedLogin(state, c.Query("code"))
+	if err != nil {
+		status, message := federationError(c, err)
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": err.Error(), "provider_id": state.ProviderID}, "LOGIN_FAILED")
+		renderLogin(c, status, &req, message)
+		return
+	}
+
+	// The MFA policy applies as on the password login, unless the provider
+	// vouches for a second factor
+	if !mfa {
+		mfaState, err := services.GetMFAState(user.ID)
+		if err == nil && (mfaState.Enabled || mfaState.Passkeys) {
+			var mfaToken string
+			if mfaToken, err = startFormMFA(c, user, req.ClientID); err == nil {
+				c.HTML(http.StatusOK, "login.html", gin.H{"request": &req, "mfaToken": mfaToken, "totp": mfaState.Enabled, "passkey": mfaState.Passkeys, "csrf": newFormCSRFToken(c)})
+				return
+			}
+		}
+		if err == nil && mfaState.Required {
+			err = services.ErrMFAEnrollmentRequired
+		}
+		if err != nil {
+			status, message := federationError(c, err)
+			loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": err.Error(), "provider_id": state.ProviderID}, "LOGIN_FAILED")
+			renderLogin(c, status, &req, message)
+			return
+		}
+	}
+
+	redirectWithCode(c, &req, user, gin.H{"message": "Login successful", "user": user.Email, "client_id": req.ClientID, "method": "federation", "provider_id": state.ProviderID})
+}
+
+// federationError maps a failed federated login to the status and message
+// shown on the login page.
+func federationError(c *gin.Context, err error) (int, string) {
+	var locked *services.AccountLockedError
+	switch {
+	case errors.Is(err, libs.ErrInvalidIDToken):
+		return http.StatusUnauthorized, "La respuesta del proveedor de identidad no es válida"
+	case errors.Is(err, services.ErrFederatedEmailRejected):
+		return http.StatusForbidden, "El proveedor de identidad no confirmó un correo de su organización"
+	case errors.Is(err, services.ErrNoLocalAccount):
+		return http.StatusForbidden, "No existe una cuenta para este usuario; contacte con el administrador"
+	case errors.Is(err, services.ErrIdentityLinkedToOtherUser), errors.As(err, new(*services.UsernameTakenError)):
+		return http.StatusConflict, "Su cuenta de la organización no se pudo asociar a un usuario; contacte con el administrador"
+	case errors.Is(err, services.ErrUserInactive):
+		return http.StatusForbidden, "El usuario está inactivo"
+	case errors.As(err, &locked):
+		return http.StatusLocked, "Cuenta bloqueada hasta las " + locked.Until.Local().Format("15:04")
+	case errors.Is(err, services.ErrMFAEnrollmentRequired):
+		// Without a password there is no login to enroll an authenticator
+		// from, so the provider has to assert the second factor
+		return http.StatusForbidden, "Su cuenta requiere verificación en dos pasos; actívela en el proveedor de identidad de su organización o contacte con el administrador"
+	default:
+		c.Error(err)
+		return http.StatusBadGateway, "No se pudo completar el inicio de sesión con el proveedor de identidad"
+	}
+}
+
+// ListIdentityProviders godoc
+// @Summary List identity providers
+// @Description Returns the upstream OpenID Connect providers and the email domains that sign in at each. Requires the admin role.
+// @Tags identity-providers
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} IdentityProviderResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/identity-providers [get]
+func ListIdentityProviders(c *gin.Context) {
+	providers, err := services.ListIdentityProviders()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list identity providers"})
+		return
+	}
+
+	response := make([]IdentityProviderResponse, 0, len(providers))
+	for i := range providers {
+		response = append(response, newIdentityProviderResponse(&providers[i]))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// SaveIdentityProvider godoc
+// @Summary Create or replace an identity provider
+// @Description Configures an upstream OpenID Connect provider. Users whose email domain is in domains sign in at the provider, unless they were assigned an authentication backend. The redirect URI to register at the provider is {PUBLIC_URL}/oauth/federation/callback. An omitted client_secret keeps the current one. Requires the admin role.
+// @Tags identity-providers
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param provider_id path string true "Provider id"
+// @Param body body services.IdentityProviderInput true "Provider settings"
+// @Success 200 {object} IdentityProviderResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/identity-providers/{provider_id} [put]
+func SaveIdentityProvider(c *gin.Context) {
+	var input services.IdentityProviderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	provider, err := services.SaveIdentityProvider(c.Param("provider_id"), input)
+	if errors.Is(err, services.ErrInvalidIdentityProviderData) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save identity provider"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Identity provider saved", "provider_id": provider.ID, "issuer": provider.Issuer, "domains": provider.Domains}, "IDENTITY_PROVIDER_SAVED")
+
+	c.JSON(http.StatusOK, newIdentityProviderResponse(provider))
+}
+
+// DeleteIdentityProvider godoc
+// @Summary Delete an identity provider
+// @Description Removes an upstream provider with the identities linked through it and its provisioning rules. Its domains sign in with passwords again. Requires the admin role.
+// @Tags identity-providers
+// @Produce json
+// @Security BearerAuth
+// @Param provider_id path string true "Provider id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/identity-providers/{provider_id} [delete]
+func DeleteIdentityProvider(c *gin.Context) {
+	providerID := c.Param("provider_id")
+	err := services.DeleteIdentityProvider(providerID)
+	if errors.Is(err, services.ErrIdentityProviderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete identity provider"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Identity provider deleted", "provider_id": providerID}, "IDENTITY_PROVIDER_DELETED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Identity provider deleted"})
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenExchangeGrant lets a staff member exchange their own access token for
+// a short-lived access token of another user (RFC 8693 impersonation). The
+// new token carries an act claim with the staff member, and every exchange is
+// audited with both identities and the reason given.
+func tokenExchangeGrant(c *gin.Context, client *services.Client) (*TokenResponse, error) {
+	if c.PostForm("subject_token_type") != services.AccessTokenType {
+		return nil, &oauthError{Code: "invalid_request", Description: "subject_token_type must be " + services.AccessTokenType}
+	}
+	if requested := c.PostForm("requested_token_type"); requested != "" && requested != services.AccessTokenType {
+		return nil, &oauthError{Code: "invalid_request", Description: "only access tokens can be requested"}
+	}
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	if reason == "" {
+		return nil, &oauthError{Code: "invalid_request", Description: "reason is required"}
+	}
+
+	claims, err := libs.ParseJWT(c.PostForm("subject_token"))
+	if err != nil {
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid subject token"}
+	}
+	if _, ok := claims["act"]; ok {
+		return nil, &oauthError{Code: "invalid_grant", Description: "impersonation tokens cannot be exchanged"}
+	}
+	revoked, err := services.IsClaimsRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid subject token"}
+	}
+
+	actorID, _ := claims["user_id"].(string)
+	actor, err := services.GetUserByID(actorID)
+	if err != nil {
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid subject token"}
+	}
+	actorRoles, err := services.GetRolesByUserID(actor.ID)
+	if err != nil {
+		return nil, err
+	}
+	target, _ := services.GetUserByID(c.PostForm("requested_subject"))
+
+	audit := gin.H{
+		"actor_id":          actor.ID,
+		"actor_email":       actor.Email,
+		"requested_subject": c.PostForm("requested_subject"),
+		"reason":            reason,
+		"client_id":         client.ID,
+	}
+	loggingService := services.NewLoggingService()
+
+	err = services.CheckImpersonation(actor, actorRoles, target)
+	if err != nil {
+		loggingService.Log(actor.ID, c.Request.URL.Path, audit, gin.H{"message": "Impersonation denied"}, "IMPERSONATION_DENIED")
+		if errors.Is(err, services.ErrImpersonationTarget) {
+			return nil, &oauthError{Code: "invalid_target", Description: "the requested user cannot be impersonated"}
+		}
+		return nil, &oauthError{Code: "access_denied", Description: "not allowed to impersonate users"}
+	}
+
+	options := clientOptions(client)
+	options.Actor = actor
+	response, err := issueAccessToken(target, options)
+	if err != nil {
+		return nil, err
+	}
+
+	audit["subject_id"] = target.ID
+	audit["subject_email"] = target.Email
+	loggingService.Log(actor.ID, c.Request.URL.Path, audit, gin.H{"message": "Impersonation started", "expired_at": response.ExpiredAt}, "IMPERSONATION_STARTED")
+
+	return &TokenResponse{
+		AccessToken:     response.Token,
+		TokenType:       "Bearer",
+		ExpiresIn:       response.ExpiredAt - time.Now().Unix(),
+		IssuedTokenType: services.AccessTokenType,
+	}, nil
+}
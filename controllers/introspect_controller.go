@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IntrospectionResponse represents the RFC 7662 introspection response.
+// Only Active is set for tokens that are not live. UserID, Email and Roles
+// extend the standard members; Roles only lists the roles the calling
+// client is entitled to.
+type IntrospectionResponse struct {
+	Active    bool              `json:"active"`
+	Scope     string            `json:"scope,omitempty"`
+	ClientID  string            `json:"client_id,omitempty"`
+	Username  string            `json:"username,omitempty"`
+	TokenType string            `json:"token_type,omitempty"`
+	Exp       int64             `json:"exp,omitempty"`
+	Iat       int64             `json:"iat,omitempty"`
+	Nbf       int64             `json:"nbf,omitempty"`
+	Sub       string            `json:"sub,omitempty"`
+	Aud       []string          `json:"aud,omitempty"`
+	Iss       string            `json:"iss,omitempty"`
+	Jti       string            `json:"jti,omitempty"`
+	Act       *authclient.Actor `json:"act,omitempty"`
+	UserID    string            `json:"user_id,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	Roles     []services.Role   `json:"roles,omitempty"`
+}
+
+// Introspect godoc
+// @Summary Introspect a token
+// @Description Tells a registered client whether a token issued by this server is active (RFC 7662). The client authenticates with HTTP Basic or client_id/client_secret form fields and only sees the roles it is entitled to.
+// @Tags auth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token to introspect"
+// @Param token_type_hint formData string false "Hint about the token type"
+// @Success 200 {object} IntrospectionResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/introspect [post]
+func Introspect(c *gin.Context) {
+	client, ok := authenticateClient(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="introspect"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	claims, err := libs.ParseJWT(token)
+	if err != nil {
+		c.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+		return
+	}
+
+	revoked, err := services.IsClaimsRevoked(claims)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	if revoked {
+		c.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+		return
+	}
+
+	response := IntrospectionResponse{
+		Active:    true,
+		TokenType: "Bearer",
+	}
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		response.Exp = exp.Unix()
+	}
+	if iat, _ := claims.GetIssuedAt(); iat != nil {
+		response.Iat = iat.Unix()
+	}
+	if nbf, _ := claims.GetNotBefore(); nbf != nil {
+		response.Nbf = nbf.Unix()
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 0 {
+		response.Aud = aud
+	}
+	response.Iss, _ = claims.GetIssuer()
+	response.Jti, _ = claims["jti"].(string)
+	response.ClientID, _ = claims["client_id"].(string)
+	response.Scope, _ = claims["scope"].(string)
+	if act, ok := claims["act"].(map[string]any); ok {
+		response.Act = &authclient.Actor{}
+		response.Act.Sub, _ = act["sub"].(string)
+		response.Act.Email, _ = act["email"].(string)
+	}
+
+	userID, _ := claims["user_id"].(string)
+	if userID == "" && response.ClientID != "" {
+		// client_credentials token: live while the client is registered
+		if _, err := services.GetClient(response.ClientID); err != nil {
+			c.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+			return
+		}
+		response.Sub = response.ClientID
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	user, err := services.GetUserByID(userID)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+		return
+	}
+	response.Sub = user.ID
+	response.Username = user.Username
+	response.UserID = user.ID
+	response.Email = user.Email
+	if roles, err := services.GetRolesByUserID(user.ID); err == nil {
+		response.Roles = client.FilterRoles(roles)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// authenticateClient reads client credentials from HTTP Basic auth or from
+// the client_id/client_secret form fields.
+func authenticateClient(c *gin.Context) (*services.Client, bool) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+	if clientID == "" {
+		return nil, false
+	}
+	client, err := services.AuthenticateClient(clientID, secret)
+	if err != nil {
+		return nil, false
+	}
+	return client, true
+}
@@ -0,0 +1,599 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MFAChallengeResponse is returned by the login of a user with MFA instead
+// of the tokens. Methods lists how the challenge can be completed: "totp" on
+// /auth/mfa/verify and "webauthn" on /auth/webauthn/login. When
+// EnrollmentRequired is set the user has no second factor yet but a role
+// requires it; the secret is obtained on /auth/mfa/challenge/enroll with an
+// enrollment token issued by an admin, and the first code enables it.
+type MFAChallengeResponse struct {
+	Message            string   `json:"message"`
+	MFARequired        bool     `json:"mfa_required"`
+	MFAToken           string   `json:"mfa_token"`
+	ExpiresIn          int64    `json:"expires_in"`
+	Methods            []string `json:"methods"`
+	EnrollmentRequired bool     `json:"enrollment_required,omitempty"`
+}
+
+// MFAVerifyRequest represents the request body for the MFA verify endpoint.
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// MFAChallengeEnrollRequest represents the request body for the enrollment
+// during a login.
+type MFAChallengeEnrollRequest struct {
+	MFAToken        string `json:"mfa_token" binding:"required"`
+	EnrollmentToken string `json:"enrollment_token" binding:"required"`
+}
+
+// MFAVerifyResponse is the login response, with the recovery codes when the
+// verification completed an enrollment.
+type MFAVerifyResponse struct {
+	LoginResponse
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// MFACodeRequest represents a request confirmed with a code from the
+// authenticator app or a recovery code.
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// StepUpRequest represents the proof asked before adding a factor: a code
+// from the authenticator app or a passkey assertion (the session id of
+// /auth/webauthn/login/options, called without an mfa_token, and the
+// credential) when the user has MFA or passkeys, otherwise the current
+// password, base64 encoded as in the login.
+type StepUpRequest struct {
+	Password   string          `json:"password,omitempty"`
+	Code       string          `json:"code,omitempty"`
+	SessionID  string          `json:"session_id,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty" swaggertype:"object"`
+}
+
+// stepUpMaxAge is how old an access token may be to add a factor.
+const stepUpMaxAge = 5 * time.Minute
+
+// MFAEnrollmentResponse holds the secret of a new enrollment. OTPAuthURI is
+// meant to be shown as a QR code.
+type MFAEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// RecoveryCodesResponse holds new recovery codes, shown to the user once.
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// startMFAChallenge returns the challenge that replaces the tokens of a login
+// when the user has MFA enabled, has passkeys or a role requires it, or nil
+// otherwise.
+func startMFAChallenge(user *services.User, audience string) (*MFAChallengeResponse, error) {
+	state, err := services.GetMFAState(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !state.Enabled && !state.Passkeys && !state.Required {
+		return nil, nil
+	}
+
+	token, ttl, err := services.CreateMFAChallenge(user.ID, audience)
+	if err != nil {
+		return nil, err
+	}
+	response := &MFAChallengeResponse{
+		Message:     "MFA required",
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(ttl.Seconds()),
+		Methods:     []string{},
+	}
+	if state.Enabled {
+		response.Methods = append(response.Methods, "totp")
+	}
+	if state.Passkeys {
+		response.Methods = append(response.Methods, "webauthn")
+	}
+	if !state.Enabled && !state.Passkeys {
+		response.Message = "MFA enrollment required"
+		response.Methods = append(response.Methods, "totp")
+		response.EnrollmentRequired = true
+	}
+	return response, nil
+}
+
+// checkFormMFA enforces MFA on the hosted login forms, which take the code
+// along with the password, and audits wrong codes.
+func checkFormMFA(c *gin.Context, user *services.User) error {
+	err := services.CheckMFA(user.ID, c.PostForm("code"))
+	if errors.Is(err, services.ErrInvalidMFACode) {
+		services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Invalid verification code", "user": user.Email}, "MFA_FAILED")
+	}
+	return err
+}
+
+// startFormMFA creates the MFA challenge the second step of a hosted form
+// completes, bound to the client the form signs in to.
+func startFormMFA(c *gin.Context, user *services.User, audience string) (string, error) {
+	token, _, err := services.CreateMFAChallenge(user.ID, audience)
+	if err != nil {
+		c.Error(err)
+	}
+	return token, err
+}
+
+// finishFormMFA completes the second step of a hosted form with the code
+// entered on the page, or else with the passkey assertion posted by it. The
+// challenge must belong to the same client, and the account must still be
+// active and not locked.
+func finishFormMFA(c *gin.Context, audience string) (*services.User, error) {
+	loggingService := services.NewLoggingService()
+	token := c.PostForm("mfa_token")
+	challenge, err := services.GetMFAChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.Audience != audience {
+		return nil, services.ErrInvalidMFAChallenge
+	}
+
+	if code := c.PostForm("code"); code != "" {
+		// The page only asks for a code when MFA is enabled, so a code never
+		// confirms an enrollment here
+		state, err := services.GetMFAState(challenge.UserID)
+		if err != nil {
+			return nil, err
+		}
+		err = services.ErrInvalidMFACode
+		if state.Enabled {
+			_, _, err = services.CompleteMFAChallenge(token, code)
+		}
+		if errors.Is(err, services.ErrInvalidMFACode) {
+			loggingService.Log(challenge.UserID, c.Request.URL.Path, nil, gin.H{"message": "Invalid verification code"}, "MFA_FAILED")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return services.GetLoginUser(challenge.UserID)
+	}
+
+	_, err = services.CompleteMFAChallengeWithWebAuthn(token, c.PostForm("session_id"), []byte(c.PostForm("credential")))
+	if errors.Is(err, services.ErrWebAuthnVerification) {
+		loggingService.Log(challenge.UserID, c.Request.URL.Path, nil, gin.H{"message": "Passkey verification failed"}, "WEBAUTHN_FAILED")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return services.GetLoginUser(challenge.UserID)
+}
+
+// MFAVerify godoc
+// @Summary Complete a login with MFA
+// @Description Completes a login that returned an MFA challenge with a code from the authenticator app or a recovery code. If the challenge required enrollment, the code enables MFA and the recovery codes are returned once.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Param body body MFAVerifyRequest true "MFA token and code"
+// @Success 200 {object} MFAVerifyResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/verify [post]
+func MFAVerify(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	var req MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	challenge, recoveryCodes, err := services.CompleteMFAChallenge(req.MFAToken, req.Code)
+	switch {
+	case errors.Is(err, services.ErrInvalidMFAChallenge):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrMFARequired):
+		loggingService.Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Invalid verification code"}, "MFA_FAILED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify code"})
+		return
+	}
+
+	user, loginResponse, ok := completeLogin(c, challenge.UserID, challenge.Audience, true)
+	if !ok {
+		return
+	}
+
+	if recoveryCodes != nil {
+		loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "MFA enabled", "user": user.Email}, "MFA_ENABLED")
+	}
+	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Login successful", "user": user.Email, "mfa": true}, "LOGIN_SUCCESS")
+
+	c.JSON(http.StatusOK, MFAVerifyResponse{LoginResponse: *loginResponse, RecoveryCodes: recoveryCodes})
+}
+
+// MFAChallengeEnroll godoc
+// @Summary Enroll MFA during a login
+// @Description For a login challenge with enrollment_required, exchanges the enrollment token an admin issued to the user for a TOTP secret. The otpauth URI is shown as a QR code; the first code sent to /auth/mfa/verify enables MFA and completes the login.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Param body body MFAChallengeEnrollRequest true "MFA token and enrollment token"
+// @Success 200 {object} MFAEnrollmentResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/challenge/enroll [post]
+func MFAChallengeEnroll(c *gin.Context) {
+	var req MFAChallengeEnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	enrollment, err := services.StartChallengeEnrollment(req.MFAToken, req.EnrollmentToken)
+	switch {
+	case errors.Is(err, services.ErrInvalidMFAChallenge):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	case errors.Is(err, services.ErrInvalidEnrollmentToken):
+		services.NewLoggingService().Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Invalid enrollment token"}, "MFA_FAILED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired enrollment token"})
+		return
+	case errors.Is(err, services.ErrMFAAlreadyEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA already enabled"})
+		return
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, MFAEnrollmentResponse{Secret: enrollment.Secret, OTPAuthURI: enrollment.URI})
+}
+
+// completeLogin issues the tokens of a login finished without the password
+// step, answering the request when the user is no longer active or the
+// account is locked. password tells whether the login started with the
+// password, which then counts against its usage limit.
+func completeLogin(c *gin.Context, userID string, audience string, password bool) (*services.User, *LoginResponse, bool) {
+	user, err := services.GetLoginUser(userID)
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(locked.Until).Seconds())+1, 10))
+		c.JSON(http.StatusLocked, LockedResponse{Error: "Account locked", LockedUntil: locked.Until.Unix()})
+		return nil, nil, false
+	case errors.Is(err, services.ErrUserInactive):
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is inactive"})
+		return nil, nil, false
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+		return nil, nil, false
+	}
+	options, err := audienceOptions(audience)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid audience"})
+		return nil, nil, false
+	}
+	if password {
+		err := services.CountPasswordLogin(user)
+		if errors.Is(err, services.ErrPasswordExpired) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password usage limit reached, reset your password at /auth/password/forgot"})
+			return nil, nil, false
+		}
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+			return nil, nil, false
+		}
+	}
+
+	loginResponse, err := issueTokens(user, options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return nil, nil, false
+	}
+	loginResponse.Message = "Login successful"
+	return user, &loginResponse, true
+}
+
+// MFAEnroll godoc
+// @Summary Start MFA enrollment
+// @Description Creates a TOTP secret for the user. The otpauth URI is shown as a QR code to add the account to an authenticator app; MFA is enabled once /auth/mfa/enable confirms a code. The access token must be at most 5 minutes old, and the user proves the account again with a passkey when it has one, otherwise with the current password. Wrong passwords count as failed logins.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body StepUpRequest true "Current password or passkey assertion"
+// @Success 200 {object} MFAEnrollmentResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/enroll [post]
+func MFAEnroll(c *gin.Context) {
+	var req StepUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok || !stepUp(c, user, req) {
+		return
+	}
+
+	enrollment, err := services.StartMFAEnrollment(user)
+	if errors.Is(err, services.ErrMFAAlreadyEnabled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA already enabled"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, MFAEnrollmentResponse{Secret: enrollment.Secret, OTPAuthURI: enrollment.URI})
+}
+
+// MFAEnable godoc
+// @Summary Enable MFA
+// @Description Confirms the enrollment with a code from the authenticator app and returns the recovery codes, which are shown only once.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/enable [post]
+func MFAEnable(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok {
+		return
+	}
+
+	codes, err := services.EnableMFA(user.ID, req.Code)
+	switch {
+	case errors.Is(err, services.ErrMFANotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No enrollment in progress"})
+		return
+	case errors.Is(err, services.ErrMFAAlreadyEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA already enabled"})
+		return
+	case errors.Is(err, services.ErrInvalidMFACode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
+		return
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable MFA"})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "MFA enabled", "user": user.Email}, "MFA_ENABLED")
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "MFA enabled", RecoveryCodes: codes})
+}
+
+// MFADisable godoc
+// @Summary Disable MFA
+// @Description Disables MFA after checking a code from the authenticator app or a recovery code. Users holding a role that requires MFA cannot disable it. Wrong codes count as failed logins and lock the account like wrong passwords.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body MFACodeRequest true "Code from the authenticator app or recovery code"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/disable [post]
+func MFADisable(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok {
+		return
+	}
+
+	state, err := services.GetMFAState(user.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not disable MFA"})
+		return
+	}
+	if state.Required {
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrMFARequiredByRole.Error()})
+		return
+	}
+	if !mfaCodeValid(c, user, req.Code) {
+		return
+	}
+
+	if err := services.DisableMFA(user.ID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not disable MFA"})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "MFA disabled", "user": user.Email}, "MFA_DISABLED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "MFA disabled"})
+}
+
+// MFARecoveryCodes godoc
+// @Summary Regenerate recovery codes
+// @Description Replaces the recovery codes after checking a code from the authenticator app or a recovery code. The new codes are shown only once. Wrong codes count as failed logins and lock the account like wrong passwords.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body MFACodeRequest true "Code from the authenticator app or recovery code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/mfa/recovery-codes [post]
+func MFARecoveryCodes(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok || !mfaCodeValid(c, user, req.Code) {
+		return
+	}
+
+	codes, err := services.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate recovery codes"})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Recovery codes regenerated", "user": user.Email}, "MFA_RECOVERY_CODES")
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "Recovery codes regenerated", RecoveryCodes: codes})
+}
+
+// recentToken answers the request unless the access token was issued in the
+// last stepUpMaxAge, so an old or stolen token cannot add a factor.
+func recentToken(c *gin.Context) bool {
+	claims := authclient.GetClaims(c)
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > stepUpMaxAge {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in again to add a second factor"})
+		return false
+	}
+	return true
+}
+
+// stepUp checks the age of the access token and the proof of the request
+// before a factor is added, answering the request when they do not hold.
+func stepUp(c *gin.Context, user *services.User, req StepUpRequest) bool {
+	if !recentToken(c) {
+		return false
+	}
+	password, err := base64.StdEncoding.DecodeString(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password format"})
+		return false
+	}
+
+	loggingService := services.NewLoggingService()
+	err = services.VerifyStepUp(user, services.StepUp{
+		Password:   string(password),
+		Code:       req.Code,
+		SessionID:  req.SessionID,
+		Credential: req.Credential,
+	})
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		if locked.JustLocked {
+			loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Account locked", "user": user.Email, "locked_until": locked.Until.Unix()}, "ACCOUNT_LOCKED")
+		}
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(locked.Until).Seconds())+1, 10))
+		c.JSON(http.StatusLocked, LockedResponse{Error: "Account locked", LockedUntil: locked.Until.Unix()})
+	case errors.Is(err, services.ErrStepUpRequired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password, verification code or passkey required"})
+	case errors.Is(err, services.ErrInvalidCredentials),
+		errors.Is(err, services.ErrInvalidMFACode),
+		errors.Is(err, services.ErrMFARequired),
+		errors.Is(err, services.ErrWebAuthnSession),
+		errors.Is(err, services.ErrWebAuthnVerification):
+		loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Invalid proof before adding a factor", "user": user.Email}, "STEP_UP_FAILED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password, verification code or passkey"})
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check credentials"})
+	default:
+		return true
+	}
+	return false
+}
+
+// mfaUser loads the user of the access token. Impersonation tokens cannot
+// change the MFA settings or the passkeys of the user.
+func mfaUser(c *gin.Context) (*services.User, bool) {
+	claims := authclient.GetClaims(c)
+	if claims.Actor != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed while impersonating"})
+		return nil, false
+	}
+	user, err := services.GetUserByID(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return user, true
+}
+
+// mfaCodeValid checks the code of a user with MFA enabled, answering the
+// request when it is not valid. Wrong codes count as failed logins and lock
+// the account.
+func mfaCodeValid(c *gin.Context, user *services.User, code string) bool {
+	loggingService := services.NewLoggingService()
+	err := services.CheckMFACode(user.ID, code)
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		response := gin.H{"message": "Account locked", "user": user.Email, "locked_until": locked.Until.Unix()}
+		if locked.JustLocked {
+			loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Invalid verification code", "user": user.Email}, "MFA_FAILED")
+			loggingService.Log(user.ID, c.Request.URL.Path, nil, response, "ACCOUNT_LOCKED")
+		}
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(locked.Until).Seconds())+1, 10))
+		c.JSON(http.StatusLocked, LockedResponse{Error: "Account locked", LockedUntil: locked.Until.Unix()})
+	case errors.Is(err, services.ErrMFANotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA not enabled"})
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrMFARequired):
+		loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Invalid verification code", "user": user.Email}, "MFA_FAILED")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify code"})
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,508 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthorizeRequest represents the parameters of the authorization endpoint.
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+}
+
+// TokenResponse represents a successful OAuth2 token response (RFC 6749).
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IssuedTokenType is set on token exchange responses (RFC 8693).
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// OAuthErrorResponse represents an OAuth2 error response (RFC 6749).
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// oauthError is an error that is reported to the client with an OAuth2
+// error code.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// Authorize godoc
+// @Summary OAuth2 authorization endpoint
+// @Description Renders the hosted login page for the authorization code flow. PKCE with S256 is mandatory.
+// @Tags oauth
+// @Produce html
+// @Param response_type query string true "Must be code"
+// @Param client_id query string true "Registered client id"
+// @Param redirect_uri query string true "Registered redirect URI"
+// @Param scope query string false "Requested scopes, limited to the scopes of the client and the OpenID Connect scopes"
+// @Param state query string false "Opaque value echoed back to the client"
+// @Param nonce query string false "Value echoed in the id_token"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Success 200 {string} string "Login page"
+// @Failure 302 {string} string "Redirect to the client with an error"
+// @Router /oauth/authorize [get]
+func Authorize(c *gin.Context) {
+	var req AuthorizeRequest
+	_ = c.ShouldBind(&req)
+
+	if _, ok := validateAuthorizeRequest(c, &req); !ok {
+		return
+	}
+
+	renderLogin(c, http.StatusOK, &req, "")
+}
+
+// AuthorizeLogin godoc
+// @Summary Submit the hosted login form
+// @Description Checks the credentials entered on the hosted login page and redirects back to the client with a one-time authorization code. Users whose second factor is a passkey get a second page that signs the MFA challenge with it and posts the assertion back; the same page completes the second factor of a federated login with a code or a passkey. Emails of a domain with an identity provider are redirected to the provider instead.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param email formData string false "User email, except on the passkey step"
+// @Param password formData string false "User password, unless the email signs in at an identity provider"
+// @Param code formData string false "Verification code, for users with MFA"
+// @Param mfa_token formData string false "MFA token of the second step"
+// @Param session_id formData string false "WebAuthn session id of the passkey step"
+// @Param credential formData string false "PublicKeyCredential returned by navigator.credentials.get, serialized as JSON"
+// @Param csrf_token formData string true "Anti-CSRF token of the rendered form, matching the form_csrf cookie"
+// @Success 302 {string} string "Redirect to the client with the code, or to the identity provider"
+// @Failure 401 {string} string "Login page with an error"
+// @Failure 403 {string} string "Login page with an error, e.g. for a missing or stale csrf_token"
+// @Failure 409 {string} string "Login page with an error for a directory account that cannot be linked"
+// @Router /oauth/authorize [post]
+func AuthorizeLogin(c *gin.Context) {
+	var req AuthorizeRequest
+	_ = c.ShouldBind(&req)
+
+	if _, ok := validateAuthorizeRequest(c, &req); !ok {
+		return
+	}
+	if !checkFormCSRF(c) {
+		renderLogin(c, http.StatusForbidden, &req, "El formulario expiró; vuelva a introducir sus datos")
+		return
+	}
+
+	// Second step of a user with passkeys or of a federated login
+	if c.PostForm("mfa_token") != "" {
+		user, err := finishFormMFA(c, req.ClientID)
+		if err == nil {
+			// Federated users have no local password, so they are not counted
+			err = services.CountPasswordLogin(user)
+		}
+		if err != nil {
+			status, message := loginFormError(c, err)
+			renderLogin(c, status, &req, message)
+			return
+		}
+		method := "webauthn"
+		if c.PostForm("code") != "" {
+			method = "totp"
+		}
+		redirectWithCode(c, &req, user, gin.H{"message": "Login successful", "user": user.Email, "client_id": req.ClientID, "method": method})
+		return
+	}
+
+	// Users of a domain with an identity provider sign in there
+	provider, err := services.HomeRealm(c.PostForm("email"))
+	if err != nil {
+		status, message := loginFormError(c, err)
+		renderLogin(c, status, &req, message)
+		return
+	}
+	if provider != nil {
+		startFederatedLogin(c, provider, &req, c.PostForm("email"))
+		return
+	}
+
+	user, err := authenticate(c, c.PostForm("email"), c.PostForm("password"))
+	if err == nil {
+		err = checkFormMFA(c, user)
+	}
+	if err == nil {
+		err = services.CountPasswordLogin(user)
+	}
+	if errors.Is(err, services.ErrPasskeyRequired) {
+		if mfaToken, err := startFormMFA(c, user, req.ClientID); err == nil {
+			c.HTML(http.StatusOK, "login.html", gin.H{"request": &req, "mfaToken": mfaToken, "passkey": true, "csrf": newFormCSRFToken(c)})
+			return
+		}
+	}
+	if err != nil {
+		status, message := loginFormError(c, err)
+		renderLogin(c, status, &req, message)
+		return
+	}
+
+	redirectWithCode(c, &req, user, gin.H{"message": "Login successful", "user": user.Email, "client_id": req.ClientID})
+}
+
+// redirectWithCode issues an authorization code for the user and redirects
+// back to the client, auditing the login with the given details.
+func redirectWithCode(c *gin.Context, req *AuthorizeRequest, user *services.User, details gin.H) {
+	code, err := services.CreateAuthorizationCode(services.AuthorizationCode{
+		ClientID:      req.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		c.Error(err)
+		redirectWithParams(c, req.RedirectURI, map[string]string{"error": "server_error", "state": req.State})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, details, "LOGIN_SUCCESS")
+
+	redirectWithParams(c, req.RedirectURI, map[string]string{"code": code, "state": req.State})
+}
+
+// Token godoc
+// @Summary OAuth2 token endpoint
+// @Description Exchanges an authorization code and PKCE verifier, a refresh token, the credentials of a confidential client (client_credentials), an approved device code (urn:ietf:params:oauth:grant-type:device_code), or a staff access token for a short-lived token of another user (urn:ietf:params:oauth:grant-type:token-exchange) for tokens. Device polling returns authorization_pending until the user approves and slow_down when polling faster than the interval.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code, refresh_token, client_credentials, urn:ietf:params:oauth:grant-type:device_code or urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param client_id formData string false "Client id, unless sent with HTTP Basic"
+// @Param code formData string false "Authorization code"
+// @Param redirect_uri formData string false "Redirect URI used at the authorization endpoint"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Param refresh_token formData string false "Refresh token"
+// @Param device_code formData string false "Device code"
+// @Param subject_token formData string false "Access token of the staff member (token exchange)"
+// @Param subject_token_type formData string false "urn:ietf:params:oauth:token-type:access_token"
+// @Param requested_subject formData string false "Id of the user to impersonate (token exchange)"
+// @Param reason formData string false "Why the user is impersonated; required for token exchange"
+// @Param scope formData string false "Requested scopes; on refresh, at most the scopes granted with the original code"
+// @Param audience formData string false "Requested audience (client_credentials)"
+// @Success 200 {object} TokenResponse
+// @Failure 400 {object} OAuthErrorResponse
+// @Failure 401 {object} OAuthErrorResponse
+// @Router /oauth/token [post]
+func Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	client, err := tokenEndpointClient(c)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		c.JSON(http.StatusUnauthorized, OAuthErrorResponse{Error: "invalid_client"})
+		return
+	}
+
+	var response *TokenResponse
+	grantType := c.PostForm("grant_type")
+	if slices.Contains(services.GrantTypes, grantType) && !client.AllowsGrantType(grantType) {
+		c.JSON(http.StatusBadRequest, OAuthErrorResponse{Error: "unauthorized_client", ErrorDescription: "grant type " + grantType + " is not allowed for this client"})
+		return
+	}
+
+	switch grantType {
+	case "authorization_code":
+		response, err = authorizationCodeGrant(c, client)
+	case "refresh_token":
+		response, err = refreshTokenGrant(c, client)
+	case "client_credentials":
+		response, err = clientCredentialsGrant(c, client)
+	case services.DeviceCodeGrantType:
+		response, err = deviceCodeGrant(c, client)
+	case services.TokenExchangeGrantType:
+		response, err = tokenExchangeGrant(c, client)
+	default:
+		err = &oauthError{Code: "unsupported_grant_type", Description: "grant type " + grantType + " is not supported"}
+	}
+
+	var oauthErr *oauthError
+	if errors.As(err, &oauthErr) {
+		c.JSON(http.StatusBadRequest, OAuthErrorResponse{Error: oauthErr.Code, ErrorDescription: oauthErr.Description})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, OAuthErrorResponse{Error: "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func authorizationCodeGrant(c *gin.Context, client *services.Client) (*TokenResponse, error) {
+	code, err := services.ExchangeAuthorizationCode(c.PostForm("code"), client.ID, c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	if errors.Is(err, services.ErrInvalidGrant) {
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid authorization code or code verifier"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := services.GetUserByID(code.UserID)
+	if err != nil || !user.IsActive {
+		return nil, &oauthError{Code: "invalid_grant", Description: "user is not active"}
+	}
+
+	options := clientOptions(client)
+	options.Nonce = code.Nonce
+	options.Scope = code.Scope
+	response, err := issueTokens(user, options)
+	if err != nil {
+		return nil, err
+	}
+	return newTokenResponse(response, code.Scope), nil
+}
+
+func refreshTokenGrant(c *gin.Context, client *services.Client) (*TokenResponse, error) {
+	// A wider scope is refused before the refresh token is consumed
+	scope := c.PostForm("scope")
+	previous, err := services.GetRefreshToken(c.PostForm("refresh_token"))
+	if err != nil && !errors.Is(err, services.ErrRefreshTokenInvalid) {
+		return nil, err
+	}
+	if previous != nil && !previous.AllowsScope(scope) {
+		return nil, &oauthError{Code: "invalid_scope", Description: "scope exceeds the scope granted to the refresh token"}
+	}
+
+	refreshToken, next, err := services.RotateRefreshToken(c.PostForm("refresh_token"), client.ID, client.RefreshTokenLifetime())
+	if errors.Is(err, services.ErrRefreshTokenReused) || errors.Is(err, services.ErrRefreshTokenInvalid) {
+		return nil, &oauthError{Code: "invalid_grant", Description: "invalid refresh token"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := services.GetUserByID(next.UserID)
+	if err != nil || !user.IsActive {
+		_ = services.RevokeUserRefreshTokens(next.UserID)
+		return nil, &oauthError{Code: "invalid_grant", Description: "user is not active"}
+	}
+
+	response, err := issueAccessToken(user, clientOptions(client))
+	if err != nil {
+		return nil, err
+	}
+	response.RefreshToken = refreshToken
+	if scope == "" {
+		scope = next.Scope
+	}
+	return newTokenResponse(response, scope), nil
+}
+
+func clientCredentialsGrant(c *gin.Context, client *services.Client) (*TokenResponse, error) {
+	if !client.IsConfidential() {
+		return nil, &oauthError{Code: "unauthorized_client", Description: "public clients cannot use client_credentials"}
+	}
+
+	scopes, ok := client.GrantScopes(c.PostForm("scope"))
+	if !ok {
+		return nil, &oauthError{Code: "invalid_scope", Description: "scope not allowed for this client"}
+	}
+	audience := c.PostForm("audience")
+	if audience != "" && !slices.Contains(client.Audiences, audience) {
+		return nil, &oauthError{Code: "invalid_target", Description: "audience not allowed for this client"}
+	}
+
+	token, expiredAt, err := services.IssueClientToken(client, scopes, audience)
+	if err != nil {
+		return nil, err
+	}
+
+	services.NewLoggingService().Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Client token issued", "client_id": client.ID}, "CLIENT_TOKEN_ISSUED")
+
+	return &TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   expiredAt - time.Now().Unix(),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// newTokenResponse converts the login response into the OAuth2 shape. The
+// id_token is only returned for the openid scope.
+func newTokenResponse(response LoginResponse, scope string) *TokenResponse {
+	tokenResponse := &TokenResponse{
+		AccessToken:  response.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    response.ExpiredAt - time.Now().Unix(),
+		RefreshToken: response.RefreshToken,
+		Scope:        scope,
+	}
+	if slices.Contains(strings.Fields(scope), "openid") {
+		tokenResponse.IDToken = response.IDToken
+	}
+	return tokenResponse
+}
+
+// tokenEndpointClient identifies the client calling the token endpoint.
+// Confidential clients must authenticate; public clients only send client_id.
+func tokenEndpointClient(c *gin.Context) (*services.Client, error) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, err := services.GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.IsConfidential() {
+		return services.AuthenticateClient(clientID, secret)
+	}
+	return client, nil
+}
+
+// validateAuthorizeRequest checks the authorization request. Problems with
+// the client or redirect URI are shown on the page, since redirecting to an
+// unregistered URI would be an open redirect; any other problem is reported
+// back to the client.
+func validateAuthorizeRequest(c *gin.Context, req *AuthorizeRequest) (*services.Client, bool) {
+	client, err := services.GetClient(req.ClientID)
+	if err != nil || !client.AllowsRedirectURI(req.RedirectURI) {
+		c.HTML(http.StatusBadRequest, "login.html", gin.H{
+			"fatal": "La aplicación cliente o la URL de retorno no están registradas",
+		})
+		return nil, false
+	}
+
+	if req.ResponseType != "code" {
+		redirectWithParams(c, req.RedirectURI, map[string]string{"error": "unsupported_response_type", "state": req.State})
+		return nil, false
+	}
+	if !client.AllowsGrantType("authorization_code") {
+		redirectWithParams(c, req.RedirectURI, map[string]string{"error": "unauthorized_client", "state": req.State})
+		return nil, false
+	}
+	if !client.AllowsUserScopes(req.Scope) {
+		redirectWithParams(c, req.RedirectURI, map[string]string{
+			"error":             "invalid_scope",
+			"error_description": "a requested scope is not allowed for this client",
+			"state":             req.State,
+		})
+		return nil, false
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		redirectWithParams(c, req.RedirectURI, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "PKCE with code_challenge_method S256 is required",
+			"state":             req.State,
+		})
+		return nil, false
+	}
+	return client, true
+}
+
+// loginFormError maps a failed authentication to the status and message
+// shown on the hosted pages.
+func loginFormError(c *gin.Context, err error) (int, string) {
+	var locked *services.AccountLockedError
+	var federated *services.FederatedLoginError
+	switch {
+	case errors.As(err, &locked):
+		return http.StatusLocked, "Cuenta bloqueada por demasiados intentos fallidos hasta las " + locked.Until.Local().Format("15:04") + "; puede restablecer su contraseña para desbloquearla"
+	case errors.Is(err, services.ErrInvalidCredentials):
+		return http.StatusUnauthorized, "Usuario o contraseña inválidos"
+	case errors.Is(err, services.ErrUserInactive):
+		return http.StatusForbidden, "El usuario está inactivo"
+	case errors.Is(err, services.ErrPasswordExpired):
+		return http.StatusForbidden, "Ha excedido el uso de la contraseña actual; restablézcala con la opción de recuperación de contraseña"
+	case errors.Is(err, services.ErrMFARequired):
+		return http.StatusUnauthorized, "Introduzca el código de verificación"
+	case errors.Is(err, services.ErrInvalidMFACode):
+		return http.StatusUnauthorized, "Código de verificación incorrecto"
+	case errors.Is(err, services.ErrInvalidMFAChallenge), errors.Is(err, services.ErrWebAuthnSession):
+		return http.StatusUnauthorized, "La verificación expiró; vuelva a iniciar sesión"
+	case errors.Is(err, services.ErrWebAuthnVerification):
+		return http.StatusUnauthorized, "No se pudo verificar la llave de acceso"
+	case errors.Is(err, services.ErrMFAEnrollmentRequired):
+		return http.StatusForbidden, "Debe activar la verificación en dos pasos antes de continuar"
+	case errors.As(err, &federated):
+		return http.StatusForbidden, "Su organización inicia sesión con su propio proveedor de identidad; use el inicio de sesión web"
+	case errors.Is(err, services.ErrIdentityLinkedToOtherUser), errors.As(err, new(*services.UsernameTakenError)):
+		return http.StatusConflict, "Su cuenta de la organización no se pudo asociar a un usuario; contacte con el administrador"
+	default:
+		c.Error(err)
+		return http.StatusInternalServerError, "No se pudo verificar el usuario"
+	}
+}
+
+func renderLogin(c *gin.Context, status int, req *AuthorizeRequest, message string) {
+	c.HTML(status, "login.html", gin.H{
+		"request": req,
+		"error":   message,
+		"csrf":    newFormCSRFToken(c),
+	})
+}
+
+// formCSRFCookie holds the anti-CSRF token of the hosted forms. Each render
+// sets a new one and echoes it in a hidden field, which a form posted from
+// another site cannot know.
+const formCSRFCookie = "form_csrf"
+
+// newFormCSRFToken sets a fresh anti-CSRF cookie and returns its value for
+// the csrf_token field of the form.
+func newFormCSRFToken(c *gin.Context) string {
+	token, _, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(err)
+		return ""
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(formCSRFCookie, token, 1800, "/oauth", "", strings.HasPrefix(publicBaseURL(c), "https://"), true)
+	return token
+}
+
+// checkFormCSRF reports whether the posted csrf_token matches the cookie set
+// when the form was rendered.
+func checkFormCSRF(c *gin.Context) bool {
+	cookie, err := c.Cookie(formCSRFCookie)
+	token := c.PostForm("csrf_token")
+	return err == nil && token != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(token)) == 1
+}
+
+// redirectWithParams redirects to a registered URI adding query parameters;
+// empty values are skipped.
+func redirectWithParams(c *gin.Context, redirectURI string, params map[string]string) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid redirect_uri")
+		return
+	}
+	query := target.Query()
+	for name, value := range params {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"encoding/json"
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserInfoResponse represents the OpenID Connect userinfo response. Standard
+// claims are mapped from the user; bank_id, filial_id and roles are custom.
+type UserInfoResponse struct {
+	Sub               string          `json:"sub"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	BankID            *string         `json:"bank_id,omitempty"`
+	FilialID          *string         `json:"filial_id,omitempty"`
+	Roles             []services.Role `json:"roles"`
+}
+
+// OpenIDConfiguration represents the OpenID Connect discovery document.
+type OpenIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint      string   `json:"device_authorization_endpoint"`
+	UserInfoEndpoint                 string   `json:"userinfo_endpoint"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+}
+
+// OpenIDConfigurationDocument godoc
+// @Summary OpenID Connect discovery
+// @Description Returns the OpenID Connect provider metadata. Requires PUBLIC_URL, and an issuer (JWT_ISSUER, which defaults to PUBLIC_URL) that is a URL.
+// @Tags well-known
+// @Produce json
+// @Success 200 {object} OpenIDConfiguration
+// @Failure 503 {object} ErrorResponse
+// @Router /.well-known/openid-configuration [get]
+func OpenIDConfigurationDocument(c *gin.Context) {
+	// The document is cached publicly, so it never depends on the request
+	baseURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	issuer := libs.GetTokenConfig().Issuer
+	if baseURL == "" || !isAbsoluteURL(issuer) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OpenID Connect is not configured"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age="+jwksMaxAge)
+	c.JSON(http.StatusOK, OpenIDConfiguration{
+		Issuer:                           issuer,
+		AuthorizationEndpoint:            baseURL + "/oauth/authorize",
+		TokenEndpoint:                    baseURL + "/oauth/token",
+		DeviceAuthorizationEndpoint:      baseURL + "/oauth/device_authorization",
+		UserInfoEndpoint:                 baseURL + "/api/auth/userinfo",
+		JWKSURI:                          baseURL + "/.well-known/jwks.json",
+		IntrospectionEndpoint:            baseURL + "/api/auth/introspect",
+		ScopesSupported:                  services.OpenIDScopes,
+		ResponseTypesSupported:           []string{"code"},
+		GrantTypesSupported:              services.GrantTypes,
+		CodeChallengeMethodsSupported:    []string{"S256"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: libs.SupportedAlgorithms,
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"name", "preferred_username", "email", "bank_id", "filial_id", "roles",
+		},
+	})
+}
+
+// UserInfo godoc
+// @Summary OpenID Connect userinfo
+// @Description Returns the claims of the user the access token was issued to.
+// @Tags auth
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} UserInfoResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /auth/userinfo [get]
+func UserInfo(c *gin.Context) {
+	claims := authclient.GetClaims(c)
+	user, err := services.GetUserByID(claims.UserID)
+	if err != nil || !user.IsActive {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	roles, err := services.GetRolesByUserID(user.ID)
+	if err != nil {
+		roles = []services.Role{}
+	}
+	// Tokens issued for a registered client only expose its roles
+	for _, audience := range claims.Audience {
+		if client, err := services.GetClient(audience); err == nil {
+			roles = client.FilterRoles(roles)
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, newUserInfo(user, roles))
+}
+
+func newUserInfo(user *services.User, roles []services.Role) UserInfoResponse {
+	return UserInfoResponse{
+		Sub:               user.ID,
+		Name:              user.Names,
+		PreferredUsername: user.Username,
+		Email:             user.Email,
+		BankID:            user.BankID,
+		FilialID:          user.FilialID,
+		Roles:             roles,
+	}
+}
+
+// claims converts the userinfo response into a JWT payload.
+func (info UserInfoResponse) claims() map[string]any {
+	payload := map[string]any{}
+	data, _ := json.Marshal(info)
+	_ = json.Unmarshal(data, &payload)
+	return payload
+}
+
+// isAbsoluteURL reports whether value is an http or https URL, as OpenID
+// Connect requires of the issuer.
+func isAbsoluteURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "https" || parsed.Scheme == "http") && parsed.Host != ""
+}
+
+// publicBaseURL is the externally visible URL of the server, from PUBLIC_URL
+// or, when unset, from the incoming request.
+func publicBaseURL(c *gin.Context) string {
+	if baseURL := os.Getenv("PUBLIC_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
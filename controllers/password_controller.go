@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChangePasswordRequest represents the request body for the password change
+// endpoint. Both passwords are base64 encoded, as in the login.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword godoc
+// @Summary Change the password
+// @Description Verifies the current password and replaces it with a new one that meets the password policy (PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES). The usage counter of the password is reset and every other session is revoked; the response carries new tokens for the current one. Users whose password is kept by LDAP or an identity provider get a 403.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body ChangePasswordRequest true "Current and new password, base64 encoded"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/password [post]
+func ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	claims := authclient.GetClaims(c)
+	if claims.Actor != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password cannot be changed while impersonating"})
+		return
+	}
+
+	current, err := base64.StdEncoding.DecodeString(req.CurrentPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password format"})
+		return
+	}
+	password, err := base64.StdEncoding.DecodeString(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password format"})
+		return
+	}
+
+	loggingService := services.NewLoggingService()
+	user, err := services.ChangePassword(claims.UserID, string(current), string(password))
+	var locked *services.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		if locked.JustLocked {
+			loggingService.Log(locked.UserID, c.Request.URL.Path, nil, gin.H{"message": "Account locked", "locked_until": locked.Until.Unix()}, "ACCOUNT_LOCKED")
+		}
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(locked.Until).Seconds())+1, 10))
+		c.JSON(http.StatusLocked, LockedResponse{Error: "Account locked", LockedUntil: locked.Until.Unix()})
+		return
+	case errors.Is(err, services.ErrInvalidCredentials):
+		loggingService.Log(claims.UserID, c.Request.URL.Path, nil, gin.H{"message": "Invalid current password"}, "PASSWORD_CHANGE_FAILED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid current password"})
+		return
+	case errors.Is(err, services.ErrUserInactive):
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is inactive"})
+		return
+	case errors.Is(err, services.ErrPasswordNotLocal):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password is managed by your organization's directory"})
+		return
+	case errors.Is(err, services.ErrWeakPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not change password"})
+		return
+	}
+
+	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Password changed", "user": user.Email}, "PASSWORD_CHANGED")
+
+	// Keep the session that changed the password, bound to the same client
+	options := tokenOptions{}
+	if len(claims.Audience) == 1 {
+		if audience, err := audienceOptions(claims.Audience[0]); err == nil {
+			options = audience
+		}
+	}
+	response, err := issueTokens(user, options)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	response.Message = "Password changed"
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ForgotPasswordRequest represents the request body for the forgot password
+// endpoint.
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// ResetPasswordRequest represents the request body for the password reset
+// endpoint. The new password is base64 encoded, as in the login.
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset
+// @Description Emails a single-use reset token to an active user with the email and a local password. The token expires after PASSWORD_RESET_TTL. The response is the same whether or not the user exists.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body ForgotPasswordRequest true "User email"
+// @Success 202 {object} MessageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/password/forgot [post]
+func ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	// The token is sent in the background, so the response time does not
+	// tell whether the email belongs to a user
+	if !services.QueuePasswordReset(req.Email, c.Request.URL.Path) {
+		services.NewLoggingService().Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Password reset queue is full"}, "PASSWORD_RESET_FAILED")
+	}
+
+	c.JSON(http.StatusAccepted, MessageResponse{Message: "If the email belongs to an active account, a reset link has been sent"})
+}
+
+// ResetPassword godoc
+// @Summary Reset the password
+// @Description Sets a new password with a reset token sent by /auth/password/forgot. The token is single-use; the new password must meet the password policy. The account is unlocked, every session is revoked and other pending reset tokens stop working. Users whose password is kept by LDAP or an identity provider get a 403.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body ResetPasswordRequest true "Reset token and new password, base64 encoded"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/password/reset [post]
+func ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	password, err := base64.StdEncoding.DecodeString(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password format"})
+		return
+	}
+
+	user, err := services.ResetPassword(req.Token, string(password))
+	switch {
+	case errors.Is(err, services.ErrInvalidResetToken):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	case errors.Is(err, services.ErrUserInactive):
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is inactive"})
+		return
+	case errors.Is(err, services.ErrPasswordNotLocal):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password is managed by your organization's directory"})
+		return
+	case errors.Is(err, services.ErrWeakPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Password reset", "user": user.Email}, "PASSWORD_RESET")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Password reset"})
+}
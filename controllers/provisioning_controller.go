@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListProvisioningRules godoc
+// @Summary List provisioning rules
+// @Description Returns the rules that create LDAP and federated users on their first login. Requires the admin role.
+// @Tags provisioning
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} services.ProvisioningRule
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/provisioning-rules [get]
+func ListProvisioningRules(c *gin.Context) {
+	rules, err := services.ListProvisioningRules()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list provisioning rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// SaveProvisioningRule godoc
+// @Summary Create or replace a provisioning rule
+// @Description An LDAP or federated user without a local account is created on the first login when a rule matches its source (ldap or an identity provider id), email domain and upstream group; empty fields match anything. The user gets the roles of every matching rule. Requires the admin role.
+// @Tags provisioning
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param rule_id path string true "Rule id"
+// @Param body body services.ProvisioningRuleInput true "Rule"
+// @Success 200 {object} services.ProvisioningRule
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /admin/provisioning-rules/{rule_id} [put]
+func SaveProvisioningRule(c *gin.Context) {
+	var input services.ProvisioningRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	rule, err := services.SaveProvisioningRule(c.Param("rule_id"), input)
+	if errors.Is(err, services.ErrInvalidProvisioningRuleData) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save provisioning rule"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, input, gin.H{"message": "Provisioning rule saved", "rule_id": rule.ID}, "PROVISIONING_RULE_SAVED")
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteProvisioningRule godoc
+// @Summary Delete a provisioning rule
+// @Description Removes a rule. Users it already created keep their roles. Requires the admin role.
+// @Tags provisioning
+// @Produce json
+// @Security BearerAuth
+// @Param rule_id path string true "Rule id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/provisioning-rules/{rule_id} [delete]
+func DeleteProvisioningRule(c *gin.Context) {
+	ruleID := c.Param("rule_id")
+	err := services.DeleteProvisioningRule(ruleID)
+	if errors.Is(err, services.ErrProvisioningRuleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provisioning rule not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete provisioning rule"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Provisioning rule deleted", "rule_id": ruleID}, "PROVISIONING_RULE_DELETED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Provisioning rule deleted"})
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogoutRequest represents the optional request body for the logout endpoint.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RevokeRequest represents the request body for the revoke endpoint.
+// Exactly one of JTI or UserID must be set.
+type RevokeRequest struct {
+	JTI    string `json:"jti"`
+	UserID string `json:"user_id"`
+}
+
+// MessageResponse represents a generic success response.
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// Logout godoc
+// @Summary Log out
+// @Description Revoke the access token used for the request and, when given, the refresh token of the same login. A token without a jti cannot be revoked alone, so every token of the user is revoked instead.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body LogoutRequest false "Refresh token to revoke"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /auth/logout [post]
+func Logout(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	var req LogoutRequest
+	_ = c.ShouldBindJSON(&req)
+
+	claims := authclient.GetClaims(c)
+	userID := claims.UserID
+	jti := claims.ID
+
+	var err error
+	if jti != "" && claims.ExpiresAt != nil {
+		err = services.RevokeToken(jti, userID, claims.ExpiresAt.Time)
+	} else {
+		// The denylist is keyed by jti; without one only revoking every
+		// token of the user ends this session
+		err = services.RevokeUserTokens(userID)
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke token"})
+		return
+	}
+
+	if req.RefreshToken != "" {
+		err := services.RevokeRefreshToken(req.RefreshToken, userID)
+		if err != nil && !errors.Is(err, services.ErrRefreshTokenInvalid) {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke refresh token"})
+			return
+		}
+	}
+
+	loggingService.Log(userID, c.Request.URL.Path, nil, gin.H{"message": "Logout successful", "jti": jti}, "LOGOUT")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Logout successful"})
+}
+
+// Revoke godoc
+// @Summary Revoke tokens
+// @Description Revoke a single access token by jti, or every access and refresh token of a user. Requires the admin role.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body RevokeRequest true "Token or user to revoke"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /auth/revoke [post]
+func Revoke(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	var req RevokeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.JTI == "") == (req.UserID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either jti or user_id is required"})
+		return
+	}
+
+	var err error
+	if req.JTI != "" {
+		// The expiry of the token is unknown, keep it as long as any token can verify
+		expiresAt := time.Now().Add(libs.LoadKeyRingConfigFromEnv().Retention)
+		err = services.RevokeToken(req.JTI, "", expiresAt)
+	} else {
+		err = services.RevokeUserTokens(req.UserID)
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke tokens"})
+		return
+	}
+
+	loggingService.Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, req, gin.H{"message": "Tokens revoked"}, "TOKEN_REVOKED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Tokens revoked"})
+}
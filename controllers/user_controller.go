@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"errors"
+	"global-auth-server/authclient"
+	"global-auth-server/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthBackendRequest represents the request body for assigning the
+// credential backend of a user.
+type AuthBackendRequest struct {
+	// Backend is "local", "ldap", or empty to follow LDAP_DOMAINS.
+	Backend string `json:"backend"`
+}
+
+// UnlockUser godoc
+// @Summary Unlock a user account
+// @Description Lifts the lock placed on an account after too many failed logins and resets its failure count. Requires the admin role.
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/unlock [post]
+func UnlockUser(c *gin.Context) {
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := services.UnlockUser(user.ID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not unlock user"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Account unlocked", "user_id": user.ID, "user": user.Email}, "ACCOUNT_UNLOCKED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Account unlocked"})
+}
+
+// ResetUserMFA godoc
+// @Summary Reset the MFA of a user
+// @Description Removes the TOTP secret and the recovery codes of a user who lost access to them. If a role requires MFA, the user enrolls again on the next login with an enrollment token from /admin/users/{user_id}/mfa/enrollment. Requires the admin role.
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/mfa [delete]
+func ResetUserMFA(c *gin.Context) {
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := services.DisableMFA(user.ID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset MFA"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "MFA reset", "user_id": user.ID, "user": user.Email}, "MFA_RESET")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "MFA reset"})
+}
+
+// MFAEnrollmentTokenResponse holds an enrollment token, shown to the admin
+// once.
+type MFAEnrollmentTokenResponse struct {
+	EnrollmentToken string `json:"enrollment_token"`
+	ExpiresIn       int64  `json:"expires_in"`
+}
+
+// IssueMFAEnrollment godoc
+// @Summary Issue an MFA enrollment token
+// @Description Returns a single-use token a user whose role requires MFA enters on /auth/mfa/challenge/enroll to add an authenticator app during a login. Tokens issued before stop working; the token expires after MFA_ENROLLMENT_TTL. Hand it to the user through a trusted channel. Requires the admin role.
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Success 200 {object} MFAEnrollmentTokenResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/mfa/enrollment [post]
+func IssueMFAEnrollment(c *gin.Context) {
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	token, ttl, err := services.IssueMFAEnrollmentToken(user.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not issue enrollment token"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "MFA enrollment token issued", "user_id": user.ID, "user": user.Email}, "MFA_ENROLLMENT_ISSUED")
+
+	c.JSON(http.StatusOK, MFAEnrollmentTokenResponse{EnrollmentToken: token, ExpiresIn: int64(ttl.Seconds())})
+}
+
+// SetUserAuthBackend godoc
+// @Summary Set the credential backend of a user
+// @Description Makes the user authenticate with the local password or with LDAP regardless of the email domain. An empty backend goes back to the domains in LDAP_DOMAINS. Requires the admin role.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Param body body AuthBackendRequest true "Backend"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/auth-backend [put]
+func SetUserAuthBackend(c *gin.Context) {
+	var req AuthBackendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	err = services.SetUserAuthBackend(user.ID, req.Backend)
+	if errors.Is(err, services.ErrUnknownAuthBackend) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Backend must be local, ldap or empty"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not set authentication backend"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, req, gin.H{"message": "Authentication backend set", "user_id": user.ID, "user": user.Email, "backend": req.Backend}, "AUTH_BACKEND_SET")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Authentication backend set"})
+}
+
+// ListUserIdentities godoc
+// @Summary List the external identities of a user
+// @Description Returns the LDAP entries and identity provider accounts linked to a user. Requires the admin role.
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Success 200 {array} services.UserIdentity
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/identities [get]
+func ListUserIdentities(c *gin.Context) {
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	identities, err := services.ListUserIdentities(user.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list identities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+// UnlinkUserIdentity godoc
+// @Summary Unlink an external identity from a user
+// @Description Removes the link between a user and an LDAP entry or identity provider account, e.g. one linked to the wrong user. The next login with that identity is linked again by email, or provisioned when no user has that email. Requires the admin role.
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User id"
+// @Param identity_id path int true "Identity id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /admin/users/{user_id}/identities/{identity_id} [delete]
+func UnlinkUserIdentity(c *gin.Context) {
+	identityID, err := strconv.ParseInt(c.Param("identity_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+	user, err := services.GetUserByID(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	err = services.UnlinkUserIdentity(user.ID, identityID)
+	if errors.Is(err, services.ErrIdentityNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not unlink identity"})
+		return
+	}
+
+	services.NewLoggingService().Log(c.GetString(authclient.UserIDKey), c.Request.URL.Path, nil, gin.H{"message": "Identity unlinked", "user_id": user.ID, "user": user.Email, "identity_id": identityID}, "IDENTITY_UNLINKED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Identity unlinked"})
+}
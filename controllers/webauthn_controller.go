@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebAuthnOptionsResponse holds the options to pass to
+// navigator.credentials.create or navigator.credentials.get, and the session
+// id to send back with the result.
+type WebAuthnOptionsResponse struct {
+	SessionID string `json:"session_id"`
+	Options   any    `json:"options" swaggertype:"object"`
+}
+
+// WebAuthnRegisterRequest represents the request body for finishing a
+// passkey registration. Credential is the PublicKeyCredential returned by
+// navigator.credentials.create, serialized as JSON.
+type WebAuthnRegisterRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+}
+
+// WebAuthnLoginOptionsRequest represents the request body for starting a
+// passkey login. With MFAToken the passkey completes the MFA challenge of a
+// password login; without it the login is passwordless.
+type WebAuthnLoginOptionsRequest struct {
+	MFAToken string `json:"mfa_token,omitempty"`
+	// Audience optionally restricts the token of a passwordless login to
+	// one client application.
+	Audience string `json:"audience,omitempty"`
+}
+
+// WebAuthnLoginRequest represents the request body for finishing a passkey
+// login. Credential is the PublicKeyCredential returned by
+// navigator.credentials.get, serialized as JSON.
+type WebAuthnLoginRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	MFAToken   string          `json:"mfa_token,omitempty"`
+	Credential json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+}
+
+// WebAuthnRegisterOptions godoc
+// @Summary Start a passkey registration
+// @Description Returns the options for navigator.credentials.create to register a passkey for the user. As for /auth/mfa/enroll, the access token must be at most 5 minutes old and the user proves the account again: with a code from the authenticator app or a passkey when it has MFA or passkeys, otherwise with the current password.
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body StepUpRequest true "Current password, verification code or passkey assertion"
+// @Success 200 {object} WebAuthnOptionsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 423 {object} LockedResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /auth/webauthn/register/options [post]
+func WebAuthnRegisterOptions(c *gin.Context) {
+	var req StepUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok || !stepUp(c, user, req) {
+		return
+	}
+
+	creation, sessionID, err := services.BeginWebAuthnRegistration(user)
+	if err != nil {
+		webAuthnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnOptionsResponse{SessionID: sessionID, Options: creation})
+}
+
+// WebAuthnRegister godoc
+// @Summary Finish a passkey registration
+// @Description Verifies the credential created by the browser and stores it for the user. The access token must still be at most 5 minutes old.
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body WebAuthnRegisterRequest true "Session id, passkey name and credential"
+// @Success 201 {object} services.WebAuthnCredential
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/webauthn/register [post]
+func WebAuthnRegister(c *gin.Context) {
+	var req WebAuthnRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	user, ok := mfaUser(c)
+	if !ok || !recentToken(c) {
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	credential, err := services.FinishWebAuthnRegistration(user, req.SessionID, name, req.Credential)
+	if err != nil {
+		webAuthnError(c, err)
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Passkey registered", "user": user.Email, "credential_id": credential.ID, "name": credential.Name}, "WEBAUTHN_REGISTERED")
+
+	c.JSON(http.StatusCreated, credential)
+}
+
+// ListWebAuthnCredentials godoc
+// @Summary List passkeys
+// @Description Lists the passkeys registered by the user.
+// @Tags webauthn
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} services.WebAuthnCredential
+// @Failure 401 {object} ErrorResponse
+// @Router /auth/webauthn/credentials [get]
+func ListWebAuthnCredentials(c *gin.Context) {
+	user, ok := mfaUser(c)
+	if !ok {
+		return
+	}
+
+	credentials, err := services.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list passkeys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// DeleteWebAuthnCredential godoc
+// @Summary Remove a passkey
+// @Description Removes a passkey of the user.
+// @Tags webauthn
+// @Produce json
+// @Security BearerAuth
+// @Param credential_id path string true "Credential id"
+// @Success 200 {object} MessageResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/webauthn/credentials/{credential_id} [delete]
+func DeleteWebAuthnCredential(c *gin.Context) {
+	user, ok := mfaUser(c)
+	if !ok {
+		return
+	}
+
+	err := services.DeleteWebAuthnCredential(user.ID, c.Param("credential_id"))
+	if errors.Is(err, services.ErrWebAuthnCredentialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove passkey"})
+		return
+	}
+
+	services.NewLoggingService().Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Passkey removed", "user": user.Email, "credential_id": c.Param("credential_id")}, "WEBAUTHN_REMOVED")
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Passkey removed"})
+}
+
+// WebAuthnLoginOptions godoc
+// @Summary Start a passkey login
+// @Description Returns the options for navigator.credentials.get. With the mfa_token of a login challenge, only the passkeys of that user are accepted and the passkey is the second factor; without it any passkey logs its user in without a password.
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param body body WebAuthnLoginOptionsRequest false "MFA token or audience"
+// @Success 200 {object} WebAuthnOptionsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /auth/webauthn/login/options [post]
+func WebAuthnLoginOptions(c *gin.Context) {
+	var req WebAuthnLoginOptionsRequest
+	_ = c.ShouldBindJSON(&req)
+
+	userID, audience := "", req.Audience
+	if req.MFAToken != "" {
+		challenge, err := services.GetMFAChallenge(req.MFAToken)
+		if errors.Is(err, services.ErrInvalidMFAChallenge) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+			return
+		}
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start passkey login"})
+			return
+		}
+		userID, audience = challenge.UserID, challenge.Audience
+	} else if _, err := audienceOptions(audience); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid audience"})
+		return
+	}
+
+	assertion, sessionID, err := services.BeginWebAuthnLogin(userID, audience)
+	if err != nil {
+		webAuthnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnOptionsResponse{SessionID: sessionID, Options: assertion})
+}
+
+// WebAuthnLogin godoc
+// @Summary Finish a passkey login
+// @Description Verifies the assertion of a passkey and returns the same response as the login. With the mfa_token the passkey completes the MFA challenge of a password login.
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param body body WebAuthnLoginRequest true "Session id, MFA token and credential"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/webauthn/login [post]
+func WebAuthnLogin(c *gin.Context) {
+	loggingService := services.NewLoggingService()
+	var req WebAuthnLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+
+	var userID, audience string
+	if req.MFAToken != "" {
+		challenge, err := services.CompleteMFAChallengeWithWebAuthn(req.MFAToken, req.SessionID, req.Credential)
+		if errors.Is(err, services.ErrInvalidMFAChallenge) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+			return
+		}
+		if err != nil {
+			webAuthnLoginError(c, err)
+			return
+		}
+		userID, audience = challenge.UserID, challenge.Audience
+	} else {
+		user, sessionAudience, err := services.FinishWebAuthnLogin(req.SessionID, "", req.Credential)
+		if err != nil {
+			webAuthnLoginError(c, err)
+			return
+		}
+		userID, audience = user.ID, sessionAudience
+	}
+
+	// Only a passkey used as second factor follows a password
+	user, loginResponse, ok := completeLogin(c, userID, audience, req.MFAToken != "")
+	if !ok {
+		return
+	}
+
+	loggingService.Log(user.ID, c.Request.URL.Path, nil, gin.H{"message": "Login successful", "user": user.Email, "method": "webauthn", "mfa": req.MFAToken != ""}, "LOGIN_SUCCESS")
+
+	c.JSON(http.StatusOK, loginResponse)
+}
+
+// webAuthnLoginError answers a failed passkey login and audits it.
+func webAuthnLoginError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrWebAuthnVerification) {
+		services.NewLoggingService().Log(nil, c.Request.URL.Path, nil, gin.H{"message": "Passkey verification failed"}, "WEBAUTHN_FAILED")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed"})
+		return
+	}
+	webAuthnError(c, err)
+}
+
+// webAuthnError maps the errors of the WebAuthn ceremonies to responses.
+func webAuthnError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrWebAuthnSession):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired session"})
+	case errors.Is(err, services.ErrWebAuthnVerification):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey verification failed"})
+	case errors.Is(err, services.ErrNoWebAuthnCredentials):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No passkeys registered"})
+	case errors.Is(err, libs.ErrWebAuthnNotConfigured):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Passkeys are not configured"})
+	default:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not process passkey"})
+	}
+}
@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"global-auth-server/libs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwksMaxAge is how long (in seconds) consumers may cache the key set.
+const jwksMaxAge = "3600"
+
+// JWKS godoc
+// @Summary Public signing keys
+// @Description Returns the JSON Web Key Set used to verify tokens issued by this server.
+// @Tags well-known
+// @Produce json
+// @Success 200 {object} libs.JWKS
+// @Failure 500 {object} ErrorResponse
+// @Router /.well-known/jwks.json [get]
+func JWKS(c *gin.Context) {
+	jwks, err := libs.PublicJWKS()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load signing keys"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age="+jwksMaxAge)
+	c.JSON(http.StatusOK, jwks)
+}
@@ -101,3 +101,10 @@ func GetDB() *sql.DB {
 	})
 	return dbInstance
 }
+
+// SetDB replaces the shared connection, so tests can run the services
+// against a mock database.
+func SetDB(db *sql.DB) {
+	once.Do(func() {})
+	dbInstance = db
+}
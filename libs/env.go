@@ -0,0 +1,68 @@
+package libs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DurationFromEnv reads a Go duration (e.g. "15m" or "720h") from the
+// environment, falling back when it is unset or invalid.
+func DurationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Invalid %s %q, using %s\n", name, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// IntFromEnv reads an integer from the environment, falling back when it is
+// unset or invalid.
+func IntFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Invalid %s %q, using %d\n", name, value, fallback)
+		return fallback
+	}
+	return number
+}
+
+// BoolFromEnv reads a boolean ("true", "false", "1", "0") from the
+// environment, falling back when it is unset or invalid.
+func BoolFromEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Invalid %s %q, using %t\n", name, value, fallback)
+		return fallback
+	}
+	return enabled
+}
+
+// TimeFromEnv reads an RFC 3339 timestamp from the environment, returning the
+// zero time when it is unset or invalid.
+func TimeFromEnv(name string) time.Time {
+	value := os.Getenv(name)
+	if value == "" {
+		return time.Time{}
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Printf("Invalid %s %q, ignoring it\n", name, value)
+		return time.Time{}
+	}
+	return parsed
+}
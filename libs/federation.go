@@ -0,0 +1,219 @@
+package libs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"global-auth-server/authclient"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidIDToken is returned when the id_token of an upstream provider
+// fails verification.
+var ErrInvalidIDToken = errors.New("invalid id_token")
+
+// OIDCProvider is an upstream OpenID Connect provider this server signs users
+// in with, as described by its discovery document.
+type OIDCProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys      *authclient.RemoteKeySet
+	fetchedAt time.Time
+}
+
+// federationClient bounds the calls made to upstream providers.
+var federationClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscoveryTTL is how long a discovery document is used before it is
+// fetched again, so providers that move their endpoints are picked up.
+const oidcDiscoveryTTL = time.Hour
+
+var (
+	oidcProviders   = map[string]*OIDCProvider{}
+	oidcProvidersMu sync.Mutex
+)
+
+// DiscoverOIDCProvider returns the discovery document of the issuer, fetched
+// again once it is older than oidcDiscoveryTTL. While the issuer cannot be
+// reached the last document is kept. The signing keys are fetched when first
+// needed and again when an unknown kid shows up.
+func DiscoverOIDCProvider(issuer string) (*OIDCProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	oidcProvidersMu.Lock()
+	cached, ok := oidcProviders[issuer]
+	oidcProvidersMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < oidcDiscoveryTTL {
+		return cached, nil
+	}
+
+	// The lock is not held during the fetch, so a slow provider does not
+	// hold up the logins of every other one
+	provider, err := fetchOIDCProvider(issuer)
+	if err != nil {
+		if ok {
+			fmt.Printf("Error refreshing OIDC discovery of %s: %v\n", issuer, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	oidcProvidersMu.Lock()
+	oidcProviders[issuer] = provider
+	oidcProvidersMu.Unlock()
+	return provider, nil
+}
+
+// fetchOIDCProvider reads and checks the discovery document of the issuer.
+func fetchOIDCProvider(issuer string) (*OIDCProvider, error) {
+	resp, err := federationClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching OIDC discovery: status %d", resp.StatusCode)
+	}
+
+	var provider OIDCProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("error decoding OIDC discovery: %w", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC discovery issuer %q does not match %q", provider.Issuer, issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery of %s is missing endpoints", issuer)
+	}
+	provider.keys = authclient.NewRemoteKeySet(provider.JWKSURI, 0, federationClient)
+	provider.fetchedAt = time.Now()
+	return &provider, nil
+}
+
+// AuthorizationURL builds the URL the browser is sent to. The code verifier
+// is sent as an S256 challenge (PKCE) and the login hint pre-fills the email
+// at the provider.
+func (p *OIDCProvider) AuthorizationURL(clientID string, redirectURI string, scopes []string, state string, nonce string, codeVerifier string, loginHint string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {PKCEChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if loginHint != "" {
+		query.Set("login_hint", loginHint)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// ExchangeCode redeems an authorization code at the token endpoint and
+// returns the id_token. Confidential clients authenticate with HTTP Basic.
+func (p *OIDCProvider) ExchangeCode(clientID string, clientSecret string, code string, redirectURI string, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error building token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// VerifyIDToken checks the signature of the id_token against the keys of the
+// provider, its issuer, audience, expiry and nonce, and returns its claims.
+func (p *OIDCProvider) VerifyIDToken(idToken string, clientID string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, alg, err := p.keys.PublicKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Providers may omit alg from their keys; the parser still checks
+		// that the method fits the key type
+		if alg != "" && token.Method.Alg() != alg {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if value, _ := claims["nonce"].(string); value != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+	// With several audiences the token must have been issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != clientID {
+		return nil, fmt.Errorf("%w: azp mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// PKCEChallenge returns the S256 code challenge of a verifier (RFC 7636).
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
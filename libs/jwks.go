@@ -0,0 +1,141 @@
+package libs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"global-auth-server/authclient"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK and JWKS are shared with the authclient package that consumes them.
+type (
+	JWK  = authclient.JWK
+	JWKS = authclient.JWKS
+)
+
+// SigningMethodFor returns the JWS algorithm used with a key: RS256 for RSA,
+// ES256 for ECDSA P-256 and EdDSA for Ed25519.
+func SigningMethodFor(pub crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// NewJWK builds the public JWK for a signing key. The kid is the RFC 7638
+// thumbprint of the key.
+func NewJWK(pub crypto.PublicKey) (JWK, error) {
+	method, err := SigningMethodFor(pub)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	jwk := JWK{Alg: method.Alg(), Use: "sig"}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeBigInt(key.N)
+		jwk.E = encodeBigInt(big.NewInt(int64(key.E)))
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encodeCoordinate(key.X)
+		jwk.Y = encodeCoordinate(key.Y)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	}
+	jwk.Kid = thumbprint(jwk)
+	return jwk, nil
+}
+
+// KeyID computes the RFC 7638 thumbprint of a public key, used as kid.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	jwk, err := NewJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	return jwk.Kid, nil
+}
+
+// thumbprint hashes the required members of the key in lexicographic order
+// and without whitespace, as RFC 7638 mandates.
+func thumbprint(jwk JWK) string {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PublicJWKS returns the public half of every key in the key ring: the
+// current signing key (the one in SecretData.PublicPem) and the retired keys
+// whose tokens may still be live.
+func PublicJWKS() (*JWKS, error) {
+	return GetKeyRing().PublicJWKS()
+}
+
+// PublicJWKS returns the public half of every key in the key ring.
+func (kr *KeyRing) PublicJWKS() (*JWKS, error) {
+	keys, err := kr.Keys()
+	if err != nil {
+		return nil, err
+	}
+	jwks := &JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwk, err := NewJWK(key.Key.Public())
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// encodeCoordinate pads a P-256 coordinate to its full 32 bytes.
+func encodeCoordinate(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+}
@@ -0,0 +1,246 @@
+package libs
+
+import (
+	"crypto"
+	"fmt"
+	"global-auth-server/authclient"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/joho/godotenv"
+)
+
+// KeyRingConfig controls how signing keys are refreshed and retired.
+type KeyRingConfig struct {
+	// RefreshInterval is how often the ring reloads keys from the provider.
+	// Zero disables the background refresh.
+	RefreshInterval time.Duration
+	// Retention is how long a key stays published after the provider last
+	// returned it. It must cover the longest token lifetime.
+	Retention time.Duration
+}
+
+// SigningKey is a private key held by the key ring, identified by its kid.
+// The signing algorithm follows from the key type.
+type SigningKey struct {
+	ID     string
+	Key    crypto.Signer
+	Method jwt.SigningMethod
+	// lastSeen is the last refresh in which the provider still returned the key.
+	lastSeen time.Time
+}
+
+// KeyProviderFunc adapts a plain function to the KeyProvider interface.
+type KeyProviderFunc func() (current crypto.Signer, previous []crypto.Signer, err error)
+
+// LoadKeys implements KeyProvider.
+func (f KeyProviderFunc) LoadKeys() (crypto.Signer, []crypto.Signer, error) {
+	return f()
+}
+
+// KeyRing holds the current signing key plus the retired keys that stay
+// published until the tokens they signed have expired.
+type KeyRing struct {
+	mu       sync.RWMutex
+	config   KeyRingConfig
+	provider KeyProvider
+	current  *SigningKey
+	keys     map[string]*SigningKey
+	stop     chan struct{}
+}
+
+var (
+	keyRingInstance *KeyRing
+	onceKeyRing     sync.Once
+)
+
+// LoadKeyRingConfigFromEnv reads JWT_KEY_REFRESH_INTERVAL and JWT_KEY_RETENTION
+// (Go durations, e.g. "1h" or "720h").
+func LoadKeyRingConfigFromEnv() KeyRingConfig {
+	_ = godotenv.Load()
+
+	return KeyRingConfig{
+		RefreshInterval: DurationFromEnv("JWT_KEY_REFRESH_INTERVAL", time.Hour),
+		Retention:       DurationFromEnv("JWT_KEY_RETENTION", 30*24*time.Hour),
+	}
+}
+
+// GetKeyRing returns the shared key ring backed by the configured KeyProvider.
+func GetKeyRing() *KeyRing {
+	onceKeyRing.Do(func() {
+		provider, err := NewKeyProviderFromEnv()
+		if err != nil {
+			// Surface the configuration error on every key lookup
+			provider = KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+				return nil, nil, err
+			})
+		}
+		keyRingInstance = NewKeyRing(LoadKeyRingConfigFromEnv(), provider)
+	})
+	return keyRingInstance
+}
+
+// NewKeyRing creates an empty key ring; keys are loaded on first use.
+func NewKeyRing(config KeyRingConfig, provider KeyProvider) *KeyRing {
+	return &KeyRing{
+		config:   config,
+		provider: provider,
+		keys:     make(map[string]*SigningKey),
+	}
+}
+
+// Refresh reloads the keys and drops the retired ones past their retention.
+// The new key set is built before it replaces the current one, so a key the
+// ring cannot use leaves it as it was.
+func (kr *KeyRing) Refresh() error {
+	current, previous, err := kr.provider.LoadKeys()
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("no current signing key available")
+	}
+
+	now := time.Now()
+	currentKey, err := newSigningKey(current, now)
+	if err != nil {
+		return err
+	}
+	loaded := []*SigningKey{currentKey}
+	for _, key := range previous {
+		signingKey, err := newSigningKey(key, now)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, signingKey)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	keys := make(map[string]*SigningKey, len(kr.keys)+len(loaded))
+	for kid, key := range kr.keys {
+		if now.Sub(key.lastSeen) <= kr.config.Retention {
+			keys[kid] = key
+		}
+	}
+	for _, key := range loaded {
+		keys[key.ID] = key
+	}
+	kr.keys = keys
+	kr.current = keys[currentKey.ID]
+	return nil
+}
+
+// newSigningKey identifies a key returned by the provider.
+func newSigningKey(key crypto.Signer, now time.Time) (*SigningKey, error) {
+	method, err := SigningMethodFor(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: kid, Key: key, Method: method, lastSeen: now}, nil
+}
+
+// Current returns the key used to sign new tokens, loading the ring if needed.
+func (kr *KeyRing) Current() (*SigningKey, error) {
+	kr.mu.RLock()
+	current := kr.current
+	kr.mu.RUnlock()
+	if current != nil {
+		return current, nil
+	}
+
+	if err := kr.Refresh(); err != nil {
+		return nil, err
+	}
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current, nil
+}
+
+// Key returns the published key with the given kid.
+func (kr *KeyRing) Key(kid string) (*SigningKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[kid]
+	return key, ok
+}
+
+// PublicKey implements authclient.KeySource so the server verifies its own
+// tokens the same way downstream services do. An empty kid (tokens minted
+// before kids were introduced) resolves to the current key.
+func (kr *KeyRing) PublicKey(kid string) (crypto.PublicKey, string, error) {
+	key, err := kr.Current()
+	if err != nil {
+		return nil, "", err
+	}
+	if kid != "" {
+		var ok bool
+		if key, ok = kr.Key(kid); !ok {
+			return nil, "", fmt.Errorf("%w %q", authclient.ErrUnknownKey, kid)
+		}
+	}
+	return key.Key.Public(), key.Method.Alg(), nil
+}
+
+// Keys returns every published key, the current one first.
+func (kr *KeyRing) Keys() ([]*SigningKey, error) {
+	current, err := kr.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := []*SigningKey{current}
+	for _, key := range kr.keys {
+		if key.ID != current.ID {
+			keys = append(keys, key)
+		}
+	}
+	retired := keys[1:]
+	sort.Slice(retired, func(i, j int) bool {
+		return retired[i].lastSeen.After(retired[j].lastSeen)
+	})
+	return keys, nil
+}
+
+// StartRefresh reloads the ring every RefreshInterval until Stop is called.
+func (kr *KeyRing) StartRefresh() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.config.RefreshInterval <= 0 || kr.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	kr.stop = stop
+	go func() {
+		ticker := time.NewTicker(kr.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := kr.Refresh(); err != nil {
+					fmt.Println("Error refreshing signing keys:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background refresh.
+func (kr *KeyRing) Stop() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.stop != nil {
+		close(kr.stop)
+		kr.stop = nil
+	}
+}
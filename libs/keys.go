@@ -0,0 +1,258 @@
+package libs
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/joho/godotenv"
+)
+
+// KeyProvider is a source of signing keys for the key ring. RSA keys sign
+// with RS256, ECDSA P-256 keys with ES256 and Ed25519 keys with EdDSA.
+type KeyProvider interface {
+	// LoadKeys returns the current signing key and the previous keys that
+	// must remain valid for verification.
+	LoadKeys() (current crypto.Signer, previous []crypto.Signer, err error)
+}
+
+// SecretData is the JSON document stored in AWS Secrets Manager.
+type SecretData struct {
+	PrivatePem string `json:"private.pem"`
+	PublicPem  string `json:"public.pem"`
+}
+
+// FileKeyProvider reads PEM keys from the local filesystem.
+type FileKeyProvider struct {
+	Path          string
+	PreviousPaths []string
+}
+
+// EnvKeyProvider reads PEM keys from environment variables.
+type EnvKeyProvider struct {
+	Variable         string
+	PreviousVariable string
+}
+
+// AWSSecretKeyProvider reads the AWSCURRENT and AWSPREVIOUS versions of a
+// secret in AWS Secrets Manager.
+type AWSSecretKeyProvider struct {
+	SecretARN       string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// NewKeyProviderFromEnv builds the provider selected by JWT_KEY_PROVIDER
+// ("aws", "file" or "env"). It defaults to AWS Secrets Manager.
+func NewKeyProviderFromEnv() (KeyProvider, error) {
+	_ = godotenv.Load()
+
+	switch provider := os.Getenv("JWT_KEY_PROVIDER"); provider {
+	case "", "aws":
+		return &AWSSecretKeyProvider{
+			SecretARN:       os.Getenv("AWS_SECRET_ARN"),
+			Region:          os.Getenv("AWS_REGION"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, nil
+	case "file":
+		path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+		if path == "" {
+			path = "certificates/private.pem"
+		}
+		return &FileKeyProvider{
+			Path:          path,
+			PreviousPaths: splitList(os.Getenv("JWT_PREVIOUS_KEY_FILES")),
+		}, nil
+	case "env":
+		return &EnvKeyProvider{
+			Variable:         "JWT_PRIVATE_KEY",
+			PreviousVariable: "JWT_PREVIOUS_PRIVATE_KEY",
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown JWT_KEY_PROVIDER %q", provider)
+	}
+}
+
+// LoadKeys implements KeyProvider.
+func (p *FileKeyProvider) LoadKeys() (crypto.Signer, []crypto.Signer, error) {
+	current, err := readKeyFile(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var previous []crypto.Signer
+	for _, path := range p.PreviousPaths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = append(previous, key)
+	}
+	return current, previous, nil
+}
+
+func readKeyFile(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	key, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// LoadKeys implements KeyProvider.
+func (p *EnvKeyProvider) LoadKeys() (crypto.Signer, []crypto.Signer, error) {
+	value := os.Getenv(p.Variable)
+	if value == "" {
+		return nil, nil, fmt.Errorf("missing %s environment variable", p.Variable)
+	}
+	current, err := ParsePrivateKeyPEM([]byte(value))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", p.Variable, err)
+	}
+
+	value = os.Getenv(p.PreviousVariable)
+	if p.PreviousVariable == "" || value == "" {
+		return current, nil, nil
+	}
+	previous, err := ParsePrivateKeyPEM([]byte(value))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", p.PreviousVariable, err)
+	}
+	return current, []crypto.Signer{previous}, nil
+}
+
+// LoadKeys implements KeyProvider.
+func (p *AWSSecretKeyProvider) LoadKeys() (crypto.Signer, []crypto.Signer, error) {
+	if p.SecretARN == "" || p.Region == "" || p.AccessKeyID == "" || p.SecretAccessKey == "" {
+		return nil, nil, fmt.Errorf("missing required AWS environment variables")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(p.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			p.AccessKeyID,
+			p.SecretAccessKey,
+			"",
+		)),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	svc := secretsmanager.NewFromConfig(cfg)
+	current, err := p.loadVersion(svc, "AWSCURRENT")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The previous version does not exist until the secret is rotated once
+	previous, err := p.loadVersion(svc, "AWSPREVIOUS")
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return current, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return current, []crypto.Signer{previous}, nil
+}
+
+func (p *AWSSecretKeyProvider) loadVersion(svc *secretsmanager.Client, stage string) (crypto.Signer, error) {
+	result, err := svc.GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(p.SecretARN),
+		VersionStage: aws.String(stage),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret value (%s): %w", stage, err)
+	}
+
+	var secretData SecretData
+	if err := json.Unmarshal([]byte(*result.SecretString), &secretData); err != nil {
+		return nil, fmt.Errorf("error parsing secret JSON (%s): %w", stage, err)
+	}
+
+	if secretData.PrivatePem == "" {
+		return nil, fmt.Errorf("private key not found in secret (%s)", stage)
+	}
+
+	key, err := ParsePrivateKeyPEM([]byte(secretData.PrivatePem))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key (%s): %w", stage, err)
+	}
+	return key, nil
+}
+
+var pemArmor = regexp.MustCompile(`-----(BEGIN|END) [A-Z ]+-----`)
+
+// ParsePrivateKeyPEM parses an RSA (PKCS#1 or PKCS#8), ECDSA P-256 (SEC 1 or
+// PKCS#8) or Ed25519 (PKCS#8) private key. Keys whose line breaks were lost
+// (as happens when a PEM is pasted into a secret or an environment variable)
+// are accepted as well.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	der, err := decodePEMBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+			if key, err = x509.ParseECPrivateKey(der); err != nil {
+				return nil, fmt.Errorf("key is not a PKCS#1, PKCS#8 or SEC 1 private key")
+			}
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if _, err := SigningMethodFor(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func decodePEMBody(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+
+	// Fall back to the base64 body between the armor lines
+	body := pemArmor.ReplaceAllString(string(data), "")
+	body = strings.Join(strings.Fields(strings.ReplaceAll(body, `\n`, "\n")), "")
+	der, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PEM data: %w", err)
+	}
+	return der, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,291 @@
+package libs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/joho/godotenv"
+)
+
+var (
+	// ErrLDAPInvalidCredentials is returned when the directory rejects the
+	// password of the user.
+	ErrLDAPInvalidCredentials = errors.New("invalid LDAP credentials")
+	// ErrLDAPUserNotFound is returned when the directory has no entry for
+	// the user.
+	ErrLDAPUserNotFound = errors.New("LDAP user not found")
+	// ErrLDAPUnavailable is returned when the directory cannot be reached
+	// or drops the connection.
+	ErrLDAPUnavailable = errors.New("LDAP server unavailable")
+)
+
+// LDAPConfig holds the settings of the corporate directory (OpenLDAP or
+// Active Directory) that verifies passwords by binding as the user.
+//
+// The templates accept the placeholders {username} and {email}, and
+// GroupFilter also {dn}; the values are escaped for a DN or a filter.
+type LDAPConfig struct {
+	// URL of the server, ldap://host:389 or ldaps://host:636. Empty
+	// disables LDAP.
+	URL string
+	// StartTLS upgrades an ldap:// connection before binding.
+	StartTLS bool
+	// InsecureSkipVerify disables the certificate check. Only for tests.
+	InsecureSkipVerify bool
+	// UserDN is bound directly with the password of the user, e.g.
+	// "uid={username},ou=people,dc=example,dc=com" or
+	// "{username}@corp.example.com" for Active Directory. When empty the
+	// entry is searched first with the service account.
+	UserDN string
+	// BindDN and BindPassword are the service account used to search the
+	// entry of the user.
+	BindDN       string
+	BindPassword string
+	// BaseDN and UserFilter locate the entry of the user, e.g.
+	// "(mail={email})" (the default).
+	BaseDN     string
+	UserFilter string
+	// GroupAttribute lists the groups on the entry of the user (default
+	// memberOf).
+	GroupAttribute string
+	// GroupFilter, when set, searches the groups under GroupBaseDN (default
+	// BaseDN) instead, e.g. "(member={dn})".
+	GroupFilter string
+	GroupBaseDN string
+	// Domains are the email domains whose users authenticate with LDAP.
+	Domains []string
+	// Fallback checks the local password when the directory cannot be
+	// reached. A user the directory no longer has is never let in with the
+	// local password.
+	Fallback bool
+	// Timeout bounds the connection and each request.
+	Timeout time.Duration
+}
+
+// LDAPEntry is the directory entry of an authenticated user. Email and Name
+// are read from mail and displayName (or cn) when the entry was searched.
+type LDAPEntry struct {
+	DN     string
+	Email  string
+	Name   string
+	Groups []string
+}
+
+var (
+	ldapConfigInstance LDAPConfig
+	onceLDAPConfig     sync.Once
+)
+
+// LoadLDAPConfigFromEnv reads LDAP_URL, LDAP_STARTTLS,
+// LDAP_INSECURE_SKIP_VERIFY, LDAP_USER_DN, LDAP_BIND_DN, LDAP_BIND_PASSWORD,
+// LDAP_BASE_DN, LDAP_USER_FILTER, LDAP_GROUP_ATTRIBUTE, LDAP_GROUP_FILTER,
+// LDAP_GROUP_BASE_DN, LDAP_DOMAINS (comma-separated), LDAP_FALLBACK_LOCAL
+// (default false) and LDAP_TIMEOUT (default 5s).
+func LoadLDAPConfigFromEnv() LDAPConfig {
+	_ = godotenv.Load()
+
+	config := LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           BoolFromEnv("LDAP_STARTTLS", false),
+		InsecureSkipVerify: BoolFromEnv("LDAP_INSECURE_SKIP_VERIFY", false),
+		UserDN:             os.Getenv("LDAP_USER_DN"),
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		GroupAttribute:     os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		GroupFilter:        os.Getenv("LDAP_GROUP_FILTER"),
+		GroupBaseDN:        os.Getenv("LDAP_GROUP_BASE_DN"),
+		Fallback:           BoolFromEnv("LDAP_FALLBACK_LOCAL", false),
+		Timeout:            DurationFromEnv("LDAP_TIMEOUT", 5*time.Second),
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(mail={email})"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+	for _, domain := range strings.Split(os.Getenv("LDAP_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			config.Domains = append(config.Domains, domain)
+		}
+	}
+	return config
+}
+
+// GetLDAPConfig returns the shared LDAP settings.
+func GetLDAPConfig() LDAPConfig {
+	onceLDAPConfig.Do(func() {
+		ldapConfigInstance = LoadLDAPConfigFromEnv()
+	})
+	return ldapConfigInstance
+}
+
+// Enabled reports whether a directory is configured.
+func (c LDAPConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// HandlesEmail reports whether the domain of the email is one of Domains.
+func (c LDAPConfig) HandlesEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, candidate := range c.Domains {
+		if candidate == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// LDAPAuthenticate binds to the directory as the user and returns the entry
+// of the user with its groups. A wrong password is ErrLDAPInvalidCredentials
+// and a missing entry ErrLDAPUserNotFound. A directory that cannot be
+// reached is ErrLDAPUnavailable; any other error, such as a rejected service
+// account, is a problem of the configuration or the directory data. With
+// UserDN a missing entry cannot be told apart from a wrong password and is
+// reported as the latter.
+func LDAPAuthenticate(config LDAPConfig, username string, email string, password string) (*LDAPEntry, error) {
+	entry, err := authenticateLDAP(config, username, email, password)
+	var netErr net.Error
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || errors.As(err, &netErr) {
+		return nil, fmt.Errorf("%w: %w", ErrLDAPUnavailable, err)
+	}
+	return entry, err
+}
+
+func authenticateLDAP(config LDAPConfig, username string, email string, password string) (*LDAPEntry, error) {
+	if !config.Enabled() {
+		return nil, errors.New("LDAP is not configured")
+	}
+	if password == "" {
+		// An empty password is an unauthenticated bind, which succeeds
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := dialLDAP(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if config.UserDN == "" {
+		if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+			return nil, fmt.Errorf("error binding LDAP service account: %w", err)
+		}
+		if entry, err = searchLDAPUser(conn, config, username, email); err != nil {
+			return nil, err
+		}
+		err = conn.Bind(entry.DN, password)
+	} else {
+		err = conn.Bind(expandLDAPTemplate(config.UserDN, ldap.EscapeDN, username, email, ""), password)
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error binding LDAP user: %w", err)
+	}
+
+	result := &LDAPEntry{DN: expandLDAPTemplate(config.UserDN, ldap.EscapeDN, username, email, "")}
+	if entry == nil && config.BaseDN != "" {
+		// Bound with the template: read the entry as the user
+		if entry, err = searchLDAPUser(conn, config, username, email); err != nil {
+			return nil, err
+		}
+	}
+	if entry != nil {
+		result.DN = entry.DN
+		result.Email = entry.GetAttributeValue("mail")
+		result.Name = entry.GetAttributeValue("displayName")
+		if result.Name == "" {
+			result.Name = entry.GetAttributeValue("cn")
+		}
+		result.Groups = entry.GetAttributeValues(config.GroupAttribute)
+	}
+
+	if config.GroupFilter != "" {
+		groups, err := conn.Search(ldap.NewSearchRequest(
+			config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(config.Timeout.Seconds()), false,
+			expandLDAPTemplate(config.GroupFilter, ldap.EscapeFilter, username, email, result.DN),
+			[]string{"dn"}, nil,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("error searching LDAP groups: %w", err)
+		}
+		result.Groups = nil
+		for _, group := range groups.Entries {
+			result.Groups = append(result.Groups, group.DN)
+		}
+	}
+	return result, nil
+}
+
+// dialLDAP connects to the directory, upgrading to TLS when configured.
+func dialLDAP(config LDAPConfig) (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if server, err := url.Parse(config.URL); err == nil {
+		tlsConfig.ServerName = server.Hostname()
+	}
+
+	conn, err := ldap.DialURL(config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: config.Timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to LDAP: %w", err)
+	}
+	conn.SetTimeout(config.Timeout)
+	if config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting TLS with LDAP: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// searchLDAPUser finds the single entry matching UserFilter under BaseDN.
+func searchLDAPUser(conn *ldap.Conn, config LDAPConfig, username string, email string) (*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(config.Timeout.Seconds()), false,
+		expandLDAPTemplate(config.UserFilter, ldap.EscapeFilter, username, email, ""),
+		[]string{config.GroupAttribute, "mail", "displayName", "cn"}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, ErrLDAPUserNotFound
+	}
+	if result == nil || (err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded)) {
+		return nil, fmt.Errorf("error searching LDAP user: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrLDAPUserNotFound
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, errors.New("LDAP filter matches several entries")
+	}
+}
+
+// expandLDAPTemplate replaces the placeholders of a DN or filter template
+// with the escaped values.
+func expandLDAPTemplate(template string, escape func(string) string, username string, email string, dn string) string {
+	return strings.NewReplacer(
+		"{username}", escape(username),
+		"{email}", escape(email),
+		"{dn}", escape(dn),
+	).Replace(template)
+}
@@ -0,0 +1,165 @@
+package libs
+
+import (
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// MailMessage is a plain text email.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users.
+type Mailer interface {
+	Send(message MailMessage) error
+}
+
+// MailConfig holds the mail sender settings.
+type MailConfig struct {
+	// Driver is "log" (default) or "smtp".
+	Driver string
+	// From is the sender address.
+	From string
+	// SMTPHost and SMTPPort locate the SMTP server; STARTTLS is used when
+	// the server offers it.
+	SMTPHost string
+	SMTPPort int
+	// SMTPUsername and SMTPPassword enable PLAIN authentication when set.
+	SMTPUsername string
+	SMTPPassword string
+	// File is where the log driver appends the messages; empty prints them.
+	File string
+}
+
+var (
+	mailerInstance Mailer
+	onceMailer     sync.Once
+)
+
+// LoadMailConfigFromEnv reads MAIL_DRIVER, MAIL_FROM, MAIL_FILE, SMTP_HOST,
+// SMTP_PORT (default 587), SMTP_USERNAME and SMTP_PASSWORD.
+func LoadMailConfigFromEnv() MailConfig {
+	_ = godotenv.Load()
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	return MailConfig{
+		Driver:       os.Getenv("MAIL_DRIVER"),
+		From:         from,
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     IntFromEnv("SMTP_PORT", 587),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		File:         os.Getenv("MAIL_FILE"),
+	}
+}
+
+// GetMailer returns the shared mailer selected by MAIL_DRIVER. A
+// misconfigured SMTP mailer falls back to the log mailer.
+func GetMailer() Mailer {
+	onceMailer.Do(func() {
+		config := LoadMailConfigFromEnv()
+		if config.Driver == "smtp" {
+			mailer, err := NewSMTPMailer(config)
+			if err == nil {
+				mailerInstance = mailer
+				return
+			}
+			fmt.Println("Error configuring SMTP mailer, using log:", err)
+		}
+		mailerInstance = NewLogMailer(config.From, config.File)
+	})
+	return mailerInstance
+}
+
+// SMTPMailer sends the messages through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer for the SMTP server of the config.
+func NewSMTPMailer(config MailConfig) (*SMTPMailer, error) {
+	if config.SMTPHost == "" {
+		return nil, fmt.Errorf("missing SMTP_HOST")
+	}
+	mailer := &SMTPMailer{
+		addr: fmt.Sprintf("%s:%d", config.SMTPHost, config.SMTPPort),
+		from: config.From,
+	}
+	if config.SMTPUsername != "" {
+		mailer.auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+	}
+	return mailer, nil
+}
+
+// Send implements Mailer.
+func (m *SMTPMailer) Send(message MailMessage) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, formatMail(m.from, message)); err != nil {
+		return fmt.Errorf("error sending mail: %w", err)
+	}
+	return nil
+}
+
+// LogMailer writes the messages to a file, or to stdout, instead of sending
+// them. It is meant for local development.
+type LogMailer struct {
+	mu   sync.Mutex
+	from string
+	file string
+}
+
+// NewLogMailer creates a mailer appending to file, or printing when empty.
+func NewLogMailer(from string, file string) *LogMailer {
+	return &LogMailer{from: from, file: file}
+}
+
+// Send implements Mailer.
+func (m *LogMailer) Send(message MailMessage) error {
+	content := formatMail(m.from, message)
+	if m.file == "" {
+		fmt.Printf("%s\n", content)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening mail file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		return fmt.Errorf("error writing mail file: %w", err)
+	}
+	return nil
+}
+
+// formatMail builds the RFC 5322 message. Header values are stripped of line
+// breaks so they cannot inject headers.
+func formatMail(from string, message MailMessage) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(message.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", header.Replace(message.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,36 @@
+package libs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// GenerateOpaqueToken returns a random URL-safe token and the hash to store
+// in place of it.
+func GenerateOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("error generating token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashOpaqueToken(token), nil
+}
+
+// HashOpaqueToken hashes an opaque token for storage and lookup. The tokens
+// carry 256 bits of entropy, so a fast hash is sufficient.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateTokenID returns a random identifier used as the jti of a JWT.
+func GenerateTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating token id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
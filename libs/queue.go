@@ -26,6 +26,8 @@ type LogSenderConfig struct {
 	MaxRetries    int
 	BatchSize     int
 	BatchInterval time.Duration
+	// TokenSource returns the bearer token presented to the log API.
+	TokenSource func() (string, error)
 }
 
 // LogSender es la estructura principal para enviar logs a una API.
@@ -111,8 +113,11 @@ func (ls *LogSender) startWorker() {
 }
 
 func (ls *LogSender) sendLogs(logs []LogEntry) {
-    emptyPayload := map[string]any{}
-    token, _, err := GenerateJWT(emptyPayload, 1*24*time.Hour)
+    if ls.config.TokenSource == nil {
+        fmt.Println("Error sending logs: no token source configured")
+        return
+    }
+    token, err := ls.config.TokenSource()
     if err != nil {
         fmt.Println("Error generating JWT:", err)
         return
@@ -0,0 +1,221 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Requests
+// per Period.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// rate is the number of tokens added per second.
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitStore keeps the token buckets.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of the key. When the bucket is
+	// empty it returns false and how long until the next token.
+	Take(key string, limit RateLimit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitConfig holds the limits of the authentication endpoints.
+type RateLimitConfig struct {
+	// Store is "memory" (default) or "redis".
+	Store string
+	// RedisURL is used by the redis store, e.g. redis://localhost:6379/0.
+	RedisURL string
+	// PerIP limits requests per client IP.
+	PerIP RateLimit
+	// PerAccount limits requests per submitted email.
+	PerAccount RateLimit
+	// Token limits requests per client IP on the token endpoints, which
+	// device polling and refreshes call more often than a login form.
+	Token RateLimit
+}
+
+var (
+	rateLimitStoreInstance RateLimitStore
+	onceRateLimitStore     sync.Once
+)
+
+// LoadRateLimitConfigFromEnv reads RATE_LIMIT_STORE, REDIS_URL,
+// RATE_LIMIT_IP_REQUESTS/RATE_LIMIT_IP_PERIOD (default 20 per minute) and
+// RATE_LIMIT_ACCOUNT_REQUESTS/RATE_LIMIT_ACCOUNT_PERIOD (default 5 per
+// minute) and RATE_LIMIT_TOKEN_REQUESTS/RATE_LIMIT_TOKEN_PERIOD (default 60
+// per minute). The burst equals the number of requests.
+func LoadRateLimitConfigFromEnv() RateLimitConfig {
+	_ = godotenv.Load()
+
+	ipRequests := IntFromEnv("RATE_LIMIT_IP_REQUESTS", 20)
+	accountRequests := IntFromEnv("RATE_LIMIT_ACCOUNT_REQUESTS", 5)
+	tokenRequests := IntFromEnv("RATE_LIMIT_TOKEN_REQUESTS", 60)
+	return RateLimitConfig{
+		Store:    os.Getenv("RATE_LIMIT_STORE"),
+		RedisURL: os.Getenv("REDIS_URL"),
+		PerIP: RateLimit{
+			Requests: ipRequests,
+			Period:   DurationFromEnv("RATE_LIMIT_IP_PERIOD", time.Minute),
+			Burst:    ipRequests,
+		},
+		PerAccount: RateLimit{
+			Requests: accountRequests,
+			Period:   DurationFromEnv("RATE_LIMIT_ACCOUNT_PERIOD", time.Minute),
+			Burst:    accountRequests,
+		},
+		Token: RateLimit{
+			Requests: tokenRequests,
+			Period:   DurationFromEnv("RATE_LIMIT_TOKEN_PERIOD", time.Minute),
+			Burst:    tokenRequests,
+		},
+	}
+}
+
+// GetRateLimitStore returns the shared store selected by RATE_LIMIT_STORE.
+// A misconfigured redis store falls back to memory.
+func GetRateLimitStore() RateLimitStore {
+	onceRateLimitStore.Do(func() {
+		config := LoadRateLimitConfigFromEnv()
+		if config.Store == "redis" {
+			store, err := NewRedisRateLimitStore(config.RedisURL)
+			if err == nil {
+				rateLimitStoreInstance = store
+				return
+			}
+			fmt.Println("Error configuring redis rate limit store, using memory:", err)
+		}
+		rateLimitStoreInstance = NewMemoryRateLimitStore()
+	})
+	return rateLimitStoreInstance
+}
+
+// takeToken refills a bucket holding tokens as of updated and takes one
+// token from it, returning the tokens left.
+func takeToken(tokens float64, updated time.Time, limit RateLimit, now time.Time) (float64, bool, time.Duration) {
+	tokens = math.Min(float64(limit.Burst), tokens+now.Sub(updated).Seconds()*limit.rate())
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / limit.rate() * float64(time.Second))
+	return tokens, false, wait
+}
+
+// MemoryRateLimitStore keeps the buckets in the process; each replica
+// limits on its own.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket), lastSweep: time.Now()}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, allowed, wait := takeToken(bucket.tokens, bucket.updated, limit, now)
+	bucket.tokens = tokens
+	bucket.updated = now
+	bucket.full = now.Add(time.Duration((float64(limit.Burst) - tokens) / limit.rate() * float64(time.Second)))
+	return allowed, wait, nil
+}
+
+// sweep drops the buckets that have refilled, once a minute at most.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.After(bucket.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// takeTokenScript is the token bucket of takeToken run atomically in Redis.
+// The bucket expires once it would be full again.
+var takeTokenScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// RedisRateLimitStore shares the buckets between replicas through Redis or
+// any server speaking its protocol with Lua scripting.
+type RedisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisRateLimitStore connects to the server at the redis:// URL.
+func NewRedisRateLimitStore(url string) (*RedisRateLimitStore, error) {
+	if url == "" {
+		return nil, fmt.Errorf("missing REDIS_URL")
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return &RedisRateLimitStore{client: redis.NewClient(options), prefix: "ratelimit:"}, nil
+}
+
+// Take implements RateLimitStore.
+func (s *RedisRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := takeTokenScript.Run(ctx, s.client, []string{s.prefix + key},
+		limit.Burst, limit.rate(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("error taking rate limit token: %w", err)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,71 @@
+package libs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks a value sealed with SealSecret, so values stored
+// before encryption was introduced are still read.
+const sealedPrefix = "v1:"
+
+// ErrSecretKeyMissing is returned when SECRET_ENCRYPTION_KEY is not set or
+// is not a base64 encoded 32-byte key.
+var ErrSecretKeyMissing = errors.New("SECRET_ENCRYPTION_KEY must be a base64 encoded 32-byte key")
+
+// secretAEAD builds AES-256-GCM with the key in SECRET_ENCRYPTION_KEY.
+func secretAEAD() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("SECRET_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, ErrSecretKeyMissing
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealSecret encrypts a secret kept in the database, such as a TOTP seed.
+// The result carries a random nonce and is safe to store as text.
+func SealSecret(plaintext string) (string, error) {
+	aead, err := secretAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSecret decrypts a value of SealSecret. Values without the prefix were
+// stored in plain text and are returned as they are.
+func OpenSecret(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+	aead, err := secretAEAD()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed sealed secret")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting secret: %w", err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,89 @@
+package libs
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/joho/godotenv"
+)
+
+// WebAuthnConfig identifies the server as a WebAuthn relying party.
+type WebAuthnConfig struct {
+	// RPID is the domain passkeys are bound to, e.g. auth.example.com.
+	RPID string
+	// RPName is shown by the browser and the authenticator.
+	RPName string
+	// Origins are the origins allowed to run the ceremonies.
+	Origins []string
+}
+
+// ErrWebAuthnNotConfigured is returned when the relying party is not set up.
+var ErrWebAuthnNotConfigured = errors.New("WebAuthn is not configured")
+
+var (
+	webAuthnInstance *webauthn.WebAuthn
+	webAuthnErr      error
+	onceWebAuthn     sync.Once
+)
+
+// LoadWebAuthnConfigFromEnv reads WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and
+// WEBAUTHN_ORIGINS (comma-separated). The RP id and the origin default to
+// the host and the origin of PUBLIC_URL.
+func LoadWebAuthnConfigFromEnv() WebAuthnConfig {
+	_ = godotenv.Load()
+
+	config := WebAuthnConfig{
+		RPID:   os.Getenv("WEBAUTHN_RP_ID"),
+		RPName: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+	if config.RPName == "" {
+		config.RPName = "Global Auth"
+	}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.Origins = append(config.Origins, origin)
+		}
+	}
+
+	if public, err := url.Parse(os.Getenv("PUBLIC_URL")); err == nil && public.Host != "" {
+		if config.RPID == "" {
+			config.RPID = public.Hostname()
+		}
+		if len(config.Origins) == 0 {
+			config.Origins = []string{public.Scheme + "://" + public.Host}
+		}
+	}
+	return config
+}
+
+// GetWebAuthn returns the shared relying party, or an error when it is not
+// configured.
+func GetWebAuthn() (*webauthn.WebAuthn, error) {
+	onceWebAuthn.Do(func() {
+		config := LoadWebAuthnConfigFromEnv()
+		if config.RPID == "" || len(config.Origins) == 0 {
+			webAuthnErr = fmt.Errorf("%w: set WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS, or PUBLIC_URL", ErrWebAuthnNotConfigured)
+			return
+		}
+		webAuthnInstance, webAuthnErr = webauthn.New(&webauthn.Config{
+			RPID:          config.RPID,
+			RPDisplayName: config.RPName,
+			RPOrigins:     config.Origins,
+			// Passkeys: discoverable credentials that verify the user
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				ResidentKey:      protocol.ResidentKeyRequirementRequired,
+				UserVerification: protocol.VerificationRequired,
+			},
+		})
+		if webAuthnErr != nil {
+			webAuthnErr = fmt.Errorf("error configuring WebAuthn: %w", webAuthnErr)
+		}
+	})
+	return webAuthnInstance, webAuthnErr
+}
@@ -14,6 +14,10 @@
 // @host localhost:4000
 // @BasePath /api
 
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+
 // @externalDocs.description Swagger Open API Specification
 // @externalDocs.url https://swagger.io/specification/
 
@@ -25,8 +29,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	_ "global-auth-server/docs"
+	"global-auth-server/libs"
 	"global-auth-server/routes"
+	"global-auth-server/services"
 	"os"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -53,8 +61,37 @@ func main() {
 	r.Use(cors.Default())
 	r.Use(gin.Logger(), gin.Recovery())
 	r.LoadHTMLGlob("templates/*")
-	// Set trusted proxies (for production, set your proxy IPs or use "localhost" for local dev)
-	r.SetTrustedProxies([]string{"127.0.0.1", "localhost"})
+	// Set trusted proxies (for production, set TRUSTED_PROXIES to the comma
+	// separated IPs or CIDRs of your proxies; loopback is trusted by default).
+	// The client IP used by the rate limits is only taken from X-Forwarded-For
+	// when the request comes through one of them.
+	trustedProxies := []string{"127.0.0.1", "::1"}
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		trustedProxies = nil
+		for _, proxy := range strings.Split(value, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				trustedProxies = append(trustedProxies, proxy)
+			}
+		}
+	}
+	// Refuse to start rather than keep gin's default of trusting every proxy
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		fmt.Printf("Invalid TRUSTED_PROXIES: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Clients of the deprecated AUTH_CLIENTS variable move to the clients table
+	if imported, err := services.ImportEnvClients(); err != nil {
+		fmt.Printf("Error importing AUTH_CLIENTS: %v\n", err)
+	} else if len(imported) > 0 {
+		fmt.Printf("Imported clients %v from AUTH_CLIENTS; manage them through /api/admin/clients and remove the variable\n", imported)
+	}
+
+	// Reload the signing keys periodically so secret rotations are picked up
+	libs.GetKeyRing().StartRefresh()
+
+	// Drop expired entries from the token denylist
+	services.StartRevocationPurge(time.Hour)
 
 	// App routes
 	routes.RegisterRoutes(r)
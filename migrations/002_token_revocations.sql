@@ -0,0 +1,17 @@
+-- Access tokens revoked before their expiry, keyed by the jti claim. Rows are
+-- purged by the server once expires_at has passed.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti         TEXT PRIMARY KEY,
+    user_id     TEXT,
+    revoked_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at_idx ON revoked_tokens (expires_at);
+
+-- Every token of the user issued at or before revoked_before is revoked.
+CREATE TABLE IF NOT EXISTS user_revocations (
+    user_id         TEXT PRIMARY KEY,
+    revoked_before  TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL
+);
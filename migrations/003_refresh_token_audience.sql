@@ -0,0 +1,2 @@
+-- Audience requested at login, reused when the refresh token is rotated.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS audience TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- Client applications registered with the authorization server. Public
+-- clients (browser apps using PKCE) have no secret_hash; confidential
+-- clients authenticate with a bcrypt-hashed secret.
+--
+-- This table replaces the AUTH_CLIENTS variable ("client_id:secret" pairs).
+-- The server imports the pairs of that variable at startup as confidential
+-- clients without grant types, which may only introspect tokens, and skips
+-- client ids already registered here.
+CREATE TABLE IF NOT EXISTS clients (
+    client_id      TEXT PRIMARY KEY,
+    name           TEXT NOT NULL DEFAULT '',
+    secret_hash    TEXT,
+    redirect_uris  TEXT[] NOT NULL DEFAULT '{}',
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,13 @@
+-- One-time codes issued by /oauth/authorize and exchanged at /oauth/token.
+CREATE TABLE IF NOT EXISTS authorization_codes (
+    code_hash       TEXT PRIMARY KEY,
+    client_id       TEXT NOT NULL,
+    user_id         TEXT NOT NULL,
+    redirect_uri    TEXT NOT NULL,
+    scope           TEXT NOT NULL DEFAULT '',
+    nonce           TEXT NOT NULL DEFAULT '',
+    code_challenge  TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMPTZ NOT NULL,
+    used_at         TIMESTAMPTZ
+);
@@ -0,0 +1,10 @@
+-- Scopes and audiences a client may request for its own access tokens
+-- (client_credentials grant).
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS audiences TEXT[] NOT NULL DEFAULT '{}';
+
+-- Identity the log sender uses to call the log API. It has no secret: the
+-- server issues its tokens directly, nothing requests them over the network.
+INSERT INTO clients (client_id, name, scopes)
+VALUES ('log-sender', 'Log sender', '{logs:write}')
+ON CONFLICT (client_id) DO NOTHING;
@@ -0,0 +1,17 @@
+-- Per-client settings managed through /api/admin/clients: allowed grant
+-- types, token lifetimes in seconds (NULL uses the server defaults) and the
+-- codes of the roles from rols that tokens issued for the client may carry.
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS grant_types TEXT[] NOT NULL DEFAULT '{authorization_code,refresh_token}';
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS access_token_ttl INTEGER;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS refresh_token_ttl INTEGER;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{}';
+
+-- Confidential clients registered with scopes already use client_credentials
+UPDATE clients
+SET grant_types = array_append(grant_types, 'client_credentials')
+WHERE secret_hash IS NOT NULL
+  AND cardinality(scopes) > 0
+  AND NOT ('client_credentials' = ANY (grant_types));
+
+-- The log sender never calls the token endpoint
+UPDATE clients SET grant_types = '{}' WHERE client_id = 'log-sender';
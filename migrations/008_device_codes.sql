@@ -0,0 +1,19 @@
+-- Device authorization requests (RFC 8628) created by
+-- /oauth/device_authorization. The CLI polls /oauth/token with the device
+-- code (stored as a SHA-256 hash) while the user approves the user code on
+-- /oauth/device.
+CREATE TABLE IF NOT EXISTS device_codes (
+    device_code_hash  TEXT PRIMARY KEY,
+    user_code         TEXT NOT NULL UNIQUE,
+    client_id         TEXT NOT NULL,
+    scope             TEXT NOT NULL DEFAULT '',
+    status            TEXT NOT NULL DEFAULT 'pending',
+    user_id           TEXT,
+    poll_interval     INTEGER NOT NULL,
+    last_polled_at    TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at        TIMESTAMPTZ NOT NULL,
+    used_at           TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS device_codes_expires_at_idx ON device_codes (expires_at);
@@ -0,0 +1,9 @@
+-- Consecutive failed logins per user. After LOGIN_LOCKOUT_THRESHOLD failures
+-- the account is locked until locked_until; lock_count doubles the next lock.
+CREATE TABLE IF NOT EXISTS login_failures (
+    user_id          TEXT PRIMARY KEY,
+    failed_attempts  INTEGER NOT NULL DEFAULT 0,
+    lock_count       INTEGER NOT NULL DEFAULT 0,
+    locked_until     TIMESTAMPTZ,
+    last_failed_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,12 @@
+-- One-time password reset tokens sent by /api/auth/password/forgot. Only the
+-- SHA-256 hash of the token is stored; it is consumed by
+-- /api/auth/password/reset.
+CREATE TABLE IF NOT EXISTS password_resets (
+    token_hash  TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    used_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_id_idx ON password_resets (user_id);
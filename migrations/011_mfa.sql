@@ -0,0 +1,41 @@
+-- TOTP multi-factor authentication (RFC 6238). The secret is sealed with
+-- SECRET_ENCRYPTION_KEY. A secret without enabled_at is an enrollment waiting
+-- for its first code; last_used_step keeps a code from being used twice.
+CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id         TEXT PRIMARY KEY,
+    secret          TEXT NOT NULL,
+    enabled_at      TIMESTAMPTZ,
+    last_used_step  BIGINT NOT NULL DEFAULT 0,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Single-use recovery codes, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    code_hash   TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    used_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id);
+
+-- Pending second steps of a login, completed on /api/auth/mfa/verify
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+    token_hash  TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    audience    TEXT NOT NULL DEFAULT '',
+    attempts    INTEGER NOT NULL DEFAULT 0,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    used_at     TIMESTAMPTZ
+);
+
+-- Single-use tokens an admin issues so a user a role requires MFA from can
+-- enroll during a login, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS mfa_enrollment_tokens (
+    token_hash  TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    used_at     TIMESTAMPTZ
+);
+
+-- Holders of these roles must complete MFA to log in
+ALTER TABLE rols ADD COLUMN IF NOT EXISTS requires_mfa BOOLEAN NOT NULL DEFAULT false;
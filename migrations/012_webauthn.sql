@@ -0,0 +1,24 @@
+-- WebAuthn credentials (passkeys) of the users. id is the base64url
+-- credential id and credential holds the public key, the flags and the
+-- signature counter as stored by the WebAuthn library.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id            TEXT PRIMARY KEY,
+    user_id       TEXT NOT NULL,
+    name          TEXT NOT NULL DEFAULT '',
+    credential    JSONB NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+-- Ceremonies in progress, between the options and the verify endpoints. The
+-- session id given to the browser is stored as a SHA-256 hash.
+CREATE TABLE IF NOT EXISTS webauthn_sessions (
+    session_hash  TEXT PRIMARY KEY,
+    purpose       TEXT NOT NULL,
+    user_id       TEXT NOT NULL DEFAULT '',
+    audience      TEXT NOT NULL DEFAULT '',
+    data          JSONB NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL
+);
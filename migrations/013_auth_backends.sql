@@ -0,0 +1,13 @@
+-- Credential backend assigned to a user, overriding the email domains in
+-- LDAP_DOMAINS: 'local' checks users.password, 'ldap' binds to the
+-- directory (and falls back to users.password when LDAP_FALLBACK_LOCAL is on).
+CREATE TABLE IF NOT EXISTS user_auth_backends (
+    user_id     TEXT PRIMARY KEY,
+    backend     TEXT NOT NULL CHECK (backend IN ('local', 'ldap')),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Directory group (the DN listed in memberOf or found by LDAP_GROUP_FILTER)
+-- whose members get the role. Roles with a group are granted and removed on
+-- every LDAP login; roles without one are managed locally.
+ALTER TABLE rols ADD COLUMN IF NOT EXISTS ldap_group TEXT;
@@ -0,0 +1,30 @@
+-- Upstream OpenID Connect providers managed through
+-- /api/admin/identity-providers. Users whose email domain is listed in
+-- domains sign in at the provider instead of with a password (home-realm
+-- discovery). client_secret is sent to the provider, so it is kept as is.
+CREATE TABLE IF NOT EXISTS identity_providers (
+    provider_id    TEXT PRIMARY KEY,
+    name           TEXT NOT NULL DEFAULT '',
+    issuer         TEXT NOT NULL,
+    client_id      TEXT NOT NULL,
+    client_secret  TEXT NOT NULL DEFAULT '',
+    scopes         TEXT[] NOT NULL DEFAULT '{openid,email,profile}',
+    domains        TEXT[] NOT NULL DEFAULT '{}',
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Logins waiting for the provider to redirect back, keyed by the SHA-256
+-- hash of the state parameter. request holds the /oauth/authorize request
+-- resumed by the callback.
+CREATE TABLE IF NOT EXISTS federation_states (
+    state_hash     TEXT PRIMARY KEY,
+    provider_id    TEXT NOT NULL,
+    nonce          TEXT NOT NULL,
+    code_verifier  TEXT NOT NULL,
+    redirect_uri   TEXT NOT NULL,
+    request        JSONB NOT NULL,
+    expires_at     TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federation_states_expires_at_idx ON federation_states (expires_at);
@@ -0,0 +1,31 @@
+-- External identities linked to local users: the subject of a user at a
+-- provider, or for LDAP provider_id 'ldap' and the DN of the entry. A user
+-- can be linked to several identities, an identity to one user only.
+-- identity_id keys an identity in the admin API, since subjects such as
+-- LDAP DNs do not fit in a URL path.
+CREATE TABLE IF NOT EXISTS user_identities (
+    identity_id    BIGSERIAL UNIQUE,
+    provider_id    TEXT NOT NULL,
+    subject        TEXT NOT NULL,
+    user_id        TEXT NOT NULL,
+    email          TEXT NOT NULL DEFAULT '',
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_login_at  TIMESTAMPTZ,
+    PRIMARY KEY (provider_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- Just-in-time provisioning: the first login of an LDAP or federated user
+-- without a row in users creates it when a rule matches, with the roles of
+-- every matching rule. Empty source (ldap or a provider_id), domain and
+-- upstream_group match anything; groups compare case-insensitively.
+CREATE TABLE IF NOT EXISTS provisioning_rules (
+    rule_id         TEXT PRIMARY KEY,
+    source          TEXT NOT NULL DEFAULT '',
+    domain          TEXT NOT NULL DEFAULT '',
+    upstream_group  TEXT NOT NULL DEFAULT '',
+    roles           TEXT[] NOT NULL DEFAULT '{}',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
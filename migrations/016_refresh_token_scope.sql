@@ -0,0 +1,3 @@
+-- Scope granted with the authorization, kept when the refresh token is
+-- rotated so a refresh cannot widen it.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,235 @@
+// Package oidcmock runs an upstream OpenID Connect provider in memory, for
+// testing federated login without a real identity provider. The
+// authorization endpoint signs in the configured user without showing a page
+// and redirects straight back with a code.
+//
+//	idp := oidcmock.NewServer()
+//	defer idp.Close()
+//	idp.SetUser(oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+//	// register idp.Issuer(), idp.ClientID and idp.ClientSecret
+package oidcmock
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"global-auth-server/authclient"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "oidcmock"
+
+// User is the account the mock provider signs in.
+type User struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+	// Claims are added to the id_token, overriding the defaults, e.g.
+	// {"email_verified": false}.
+	Claims map[string]any
+}
+
+// Server is a mock OpenID Connect provider listening on a local port.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	user  User
+	codes map[string]grant
+}
+
+// grant is an authorization code waiting to be redeemed.
+type grant struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	user          User
+}
+
+// NewServer starts a provider with the client "oidcmock-client" and a
+// default user.
+func NewServer() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidcmock: " + err.Error())
+	}
+	s := &Server{
+		ClientID:     "oidcmock-client",
+		ClientSecret: "oidcmock-secret",
+		key:          key,
+		user:         User{Subject: "oidcmock-user", Email: "user@example.com", Name: "Mock User"},
+		codes:        map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Issuer returns the issuer identifier of the provider.
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// SetUser changes the account signed in by the next authorization.
+func (s *Server) SetUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+// IDToken signs an id_token for the user, as the token endpoint does.
+func (s *Server) IDToken(user User, audience string, nonce string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.Issuer(),
+		"sub":            user.Subject,
+		"aud":            audience,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          user.Email,
+		"email_verified": true,
+		"name":           user.Name,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if user.Groups != nil {
+		claims["groups"] = user.Groups
+	}
+	for name, value := range user.Claims {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(s.key)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.Issuer(),
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("client_id") != s.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := rand.Text()
+	s.mu.Lock()
+	s.codes[code] = grant{
+		clientID:      query.Get("client_id"),
+		redirectURI:   query.Get("redirect_uri"),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		user:          s.user,
+	}
+	s.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	if state := query.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != s.ClientID || (s.ClientSecret != "" && secret != s.ClientSecret) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	s.mu.Lock()
+	code, found := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || code.clientID != clientID || code.redirectURI != r.PostFormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != code.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := s.IDToken(code.user, clientID, code.nonce)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	public := s.key.PublicKey
+	writeJSON(w, http.StatusOK, authclient.JWKS{Keys: []authclient.JWK{{
+		Kty: "RSA",
+		Kid: keyID,
+		Alg: "RS256",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
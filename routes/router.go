@@ -2,6 +2,7 @@ package routes
 
 import (
 	"global-auth-server/controllers"
+	"global-auth-server/middlewares"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -12,14 +13,77 @@ import (
 func RegisterRoutes(r *gin.Engine) {
 	r.GET("/", controllers.Home)
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	r.GET("/.well-known/jwks.json", controllers.JWKS)
+	r.GET("/.well-known/openid-configuration", controllers.OpenIDConfigurationDocument)
+
+	// OAuth2 authorization server
+	oauth := r.Group("/oauth")
+	{
+		oauth.GET("/authorize", controllers.Authorize)
+		oauth.POST("/authorize", middlewares.RateLimitLogin("authorize"), controllers.AuthorizeLogin)
+		oauth.POST("/token", middlewares.RateLimitToken("token"), controllers.Token)
+		oauth.POST("/device_authorization", middlewares.RateLimitToken("device-authorization"), controllers.DeviceAuthorization)
+		oauth.GET("/device", controllers.DeviceVerification)
+		oauth.POST("/device", middlewares.RateLimitLogin("device"), controllers.DeviceVerify)
+		oauth.GET("/federation/callback", controllers.FederationCallback)
+	}
 
 	// Group of routes with prefix /API
 	api := r.Group("/api")
 	{
-		api.POST("/auth/login", controllers.Login)
-		api.POST("/auth/can-login", controllers.CanLogin)
+		api.POST("/auth/login", middlewares.RateLimitLogin("login"), controllers.Login)
+		api.POST("/auth/can-login", middlewares.RateLimitLogin("can-login"), controllers.CanLogin)
+		api.POST("/auth/refresh", middlewares.RateLimitToken("refresh"), controllers.Refresh)
+		api.POST("/auth/mfa/verify", middlewares.RateLimitLogin("mfa"), controllers.MFAVerify)
+		api.POST("/auth/mfa/challenge/enroll", middlewares.RateLimitLogin("mfa-enroll"), controllers.MFAChallengeEnroll)
+		api.POST("/auth/webauthn/login/options", middlewares.RateLimitLogin("webauthn-options"), controllers.WebAuthnLoginOptions)
+		api.POST("/auth/webauthn/login", middlewares.RateLimitLogin("webauthn"), controllers.WebAuthnLogin)
+		api.POST("/auth/password/forgot", middlewares.RateLimitLogin("password-forgot"), controllers.ForgotPassword)
+		api.POST("/auth/password/reset", middlewares.RateLimitLogin("password-reset"), controllers.ResetPassword)
+		api.POST("/auth/introspect", middlewares.RateLimitToken("introspect"), controllers.Introspect)
 		api.GET("/health", func(c *gin.Context) {
 			c.Status(http.StatusOK)
 		})
 	}
+
+	// Routes that require a valid access token
+	authenticated := api.Group("/auth", middlewares.RequireAuth())
+	{
+		authenticated.POST("/logout", controllers.Logout)
+		authenticated.POST("/password", middlewares.RateLimitUser(), controllers.ChangePassword)
+		authenticated.POST("/mfa/enroll", middlewares.RateLimitUser(), controllers.MFAEnroll)
+		authenticated.POST("/mfa/enable", middlewares.RateLimitUser(), controllers.MFAEnable)
+		authenticated.POST("/mfa/disable", middlewares.RateLimitUser(), controllers.MFADisable)
+		authenticated.POST("/mfa/recovery-codes", middlewares.RateLimitUser(), controllers.MFARecoveryCodes)
+		authenticated.POST("/webauthn/register/options", middlewares.RateLimitUser(), controllers.WebAuthnRegisterOptions)
+		authenticated.POST("/webauthn/register", middlewares.RateLimitUser(), controllers.WebAuthnRegister)
+		authenticated.GET("/webauthn/credentials", controllers.ListWebAuthnCredentials)
+		authenticated.DELETE("/webauthn/credentials/:credential_id", middlewares.RateLimitUser(), controllers.DeleteWebAuthnCredential)
+		authenticated.GET("/userinfo", controllers.UserInfo)
+		authenticated.POST("/userinfo", controllers.UserInfo)
+		authenticated.POST("/revoke", middlewares.RequireAdmin(), controllers.Revoke)
+	}
+
+	// Administration endpoints, restricted to the admin role
+	admin := api.Group("/admin", middlewares.RequireAuth(), middlewares.RequireAdmin())
+	{
+		admin.GET("/clients", controllers.ListClients)
+		admin.POST("/clients", controllers.CreateClient)
+		admin.GET("/clients/:client_id", controllers.GetClient)
+		admin.PUT("/clients/:client_id", controllers.UpdateClient)
+		admin.DELETE("/clients/:client_id", controllers.DeleteClient)
+		admin.POST("/clients/:client_id/secret", controllers.RotateClientSecret)
+		admin.POST("/users/:user_id/unlock", controllers.UnlockUser)
+		admin.DELETE("/users/:user_id/mfa", controllers.ResetUserMFA)
+		admin.POST("/users/:user_id/mfa/enrollment", controllers.IssueMFAEnrollment)
+		admin.PUT("/users/:user_id/auth-backend", controllers.SetUserAuthBackend)
+		admin.GET("/users/:user_id/identities", controllers.ListUserIdentities)
+		admin.DELETE("/users/:user_id/identities/:identity_id", controllers.UnlinkUserIdentity)
+		admin.GET("/identity-providers", controllers.ListIdentityProviders)
+		admin.PUT("/identity-providers/:provider_id", controllers.SaveIdentityProvider)
+		admin.DELETE("/identity-providers/:provider_id", controllers.DeleteIdentityProvider)
+		admin.GET("/provisioning-rules", controllers.ListProvisioningRules)
+		admin.PUT("/provisioning-rules/:rule_id", controllers.SaveProvisioningRule)
+		admin.DELETE("/provisioning-rules/:rule_id", controllers.DeleteProvisioningRule)
+	}
 }
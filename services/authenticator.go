@@ -0,0 +1,268 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credential backends a user can be assigned in user_auth_backends.
+const (
+	LocalBackend = "local"
+	LDAPBackend  = "ldap"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator that holds no
+	// password for the user.
+	ErrNoCredentials = errors.New("no credentials for the user")
+	// ErrBackendUnavailable is returned by an Authenticator whose backend
+	// cannot be reached; only then is the next authenticator tried.
+	ErrBackendUnavailable = errors.New("authentication backend unavailable")
+	// ErrUnknownAuthBackend is returned for a backend name other than
+	// LocalBackend or LDAPBackend.
+	ErrUnknownAuthBackend = errors.New("unknown authentication backend")
+)
+
+// Authenticator verifies the password of a user against one credential
+// backend.
+type Authenticator interface {
+	// Name identifies the backend, e.g. LocalBackend.
+	Name() string
+	// Authenticate returns ErrInvalidCredentials for a wrong password and
+	// ErrNoCredentials when the backend does not know the user, and wraps
+	// ErrBackendUnavailable when the backend could not be reached. The
+	// identity is the entry of the user in an external directory, nil for
+	// the local password.
+	Authenticate(user *User, password string) (*ExternalIdentity, error)
+}
+
+// LocalAuthenticator checks the bcrypt hash in users.password.
+type LocalAuthenticator struct{}
+
+// Name implements Authenticator.
+func (LocalAuthenticator) Name() string {
+	return LocalBackend
+}
+
+// Authenticate implements Authenticator.
+func (LocalAuthenticator) Authenticate(user *User, password string) (*ExternalIdentity, error) {
+	if user.Password == nil {
+		return nil, ErrNoCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*user.Password), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return nil, nil
+}
+
+// LDAPAuthenticator binds to the corporate directory as the user.
+type LDAPAuthenticator struct {
+	Config libs.LDAPConfig
+}
+
+// Name implements Authenticator.
+func (LDAPAuthenticator) Name() string {
+	return LDAPBackend
+}
+
+// Authenticate implements Authenticator. The email of the identity is the
+// mail attribute of the entry, or the email of the user without one. The
+// groups are never nil, so the roles mapped to directory groups are synced
+// on every LDAP login.
+func (a LDAPAuthenticator) Authenticate(user *User, password string) (*ExternalIdentity, error) {
+	entry, err := libs.LDAPAuthenticate(a.Config, user.Username, user.Email, password)
+	switch {
+	case errors.Is(err, libs.ErrLDAPInvalidCredentials):
+		return nil, ErrInvalidCredentials
+	case errors.Is(err, libs.ErrLDAPUserNotFound):
+		return nil, ErrNoCredentials
+	case errors.Is(err, libs.ErrLDAPUnavailable):
+		return nil, fmt.Errorf("%w: %w", ErrBackendUnavailable, err)
+	case err != nil:
+		return nil, err
+	}
+	identity := &ExternalIdentity{
+		Source:  LDAPBackend,
+		Subject: entry.DN,
+		Email:   entry.Email,
+		Name:    entry.Name,
+		Groups:  entry.Groups,
+	}
+	if identity.Email == "" {
+		identity.Email = user.Email
+	}
+	if identity.Groups == nil {
+		identity.Groups = []string{}
+	}
+	return identity, nil
+}
+
+// Authenticators returns the backends tried in order for the user: the one
+// assigned to the user in user_auth_backends, otherwise LDAP for the email
+// domains in LDAP_DOMAINS, otherwise the local password. LDAP is followed by
+// the local password when LDAP_FALLBACK_LOCAL is on, for outages of the
+// directory only (see ErrBackendUnavailable). Users of a domain with an
+// identity provider and no assigned backend get a FederatedLoginError.
+func Authenticators(user *User) ([]Authenticator, error) {
+	config := libs.GetLDAPConfig()
+
+	backend, err := GetUserAuthBackend(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if backend == "" {
+		provider, err := FindIdentityProviderForEmail(user.Email)
+		if err != nil {
+			return nil, err
+		}
+		if provider != nil {
+			return nil, &FederatedLoginError{ProviderID: provider.ID}
+		}
+	}
+	if backend == "" && config.Enabled() && config.HandlesEmail(user.Email) {
+		backend = LDAPBackend
+	}
+
+	if backend != LDAPBackend {
+		return []Authenticator{LocalAuthenticator{}}, nil
+	}
+	if config.Fallback {
+		return []Authenticator{LDAPAuthenticator{Config: config}, LocalAuthenticator{}}, nil
+	}
+	return []Authenticator{LDAPAuthenticator{Config: config}}, nil
+}
+
+// verifyPassword tries the authenticators of the user in order and returns
+// the one that accepted the password. Only a backend that cannot be reached
+// passes to the next; a wrong password, a backend that does not know the
+// user and any other error, such as a misconfigured directory, stop the
+// chain. Failures are logged with the user id only.
+func verifyPassword(user *User, password string) (Authenticator, *ExternalIdentity, error) {
+	authenticators, err := Authenticators(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, authenticator := range authenticators {
+		var identity *ExternalIdentity
+		identity, err = authenticator.Authenticate(user, password)
+		if err == nil {
+			return authenticator, identity, nil
+		}
+		if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrNoCredentials) {
+			return nil, nil, ErrInvalidCredentials
+		}
+		NewLoggingService().Log(user.ID, "", nil, map[string]any{"message": "Password backend failed", "backend": authenticator.Name()}, "AUTH_BACKEND_FAILED")
+		if !errors.Is(err, ErrBackendUnavailable) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+// hasLocalPassword reports whether users.password is the only password of
+// the user, so this server may change it. Users of LDAP, even with
+// LDAP_FALLBACK_LOCAL, and of an identity provider change their password
+// there.
+func hasLocalPassword(user *User) (bool, error) {
+	authenticators, err := Authenticators(user)
+	var federated *FederatedLoginError
+	if errors.As(err, &federated) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(authenticators) == 1 && authenticators[0].Name() == LocalBackend, nil
+}
+
+// GetUserAuthBackend returns the backend assigned to the user, or "" when
+// the user follows the identity providers and LDAP_DOMAINS.
+func GetUserAuthBackend(userID string) (string, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var backend string
+	err := sqlxdb.Get(&backend, `SELECT backend FROM user_auth_backends WHERE user_id = $1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading authentication backend: %w", err)
+	}
+	return backend, nil
+}
+
+// SetUserAuthBackend assigns a backend to the user. An empty backend removes
+// the assignment so the user follows LDAP_DOMAINS again.
+func SetUserAuthBackend(userID string, backend string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var err error
+	switch backend {
+	case "":
+		_, err = sqlxdb.Exec(`DELETE FROM user_auth_backends WHERE user_id = $1`, userID)
+	case LocalBackend, LDAPBackend:
+		_, err = sqlxdb.Exec(`
+			INSERT INTO user_auth_backends (user_id, backend)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET backend = EXCLUDED.backend, updated_at = now()
+		`, userID, backend)
+	default:
+		return ErrUnknownAuthBackend
+	}
+	if err != nil {
+		return fmt.Errorf("error setting authentication backend: %w", err)
+	}
+	return nil
+}
+
+// SyncDirectoryRoles gives the user the roles whose rols.ldap_group is one of
+// the directory groups and removes the other roles that name a group. Roles
+// without ldap_group are managed locally and left alone. Group DNs are
+// compared case-insensitively.
+func SyncDirectoryRoles(userID string, groups []string) error {
+	lowered := make([]string, len(groups))
+	for i, group := range groups {
+		lowered[i] = strings.ToLower(group)
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return fmt.Errorf("error syncing directory roles: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM user_roles ur
+		USING rols r
+		WHERE ur.rol_id = r.id
+		  AND ur.user_id::text = $1
+		  AND r.ldap_group IS NOT NULL
+		  AND NOT (lower(r.ldap_group) = ANY ($2))
+	`, userID, textArray(lowered)); err != nil {
+		return fmt.Errorf("error removing directory roles: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_roles (user_id, rol_id)
+		SELECT u.id, r.id
+		FROM users u
+		CROSS JOIN rols r
+		WHERE u.id::text = $1
+		  AND lower(r.ldap_group) = ANY ($2)
+		  AND NOT EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id AND ur.rol_id = r.id)
+	`, userID, textArray(lowered)); err != nil {
+		return fmt.Errorf("error adding directory roles: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error syncing directory roles: %w", err)
+	}
+	return nil
+}
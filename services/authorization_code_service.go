@@ -0,0 +1,85 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// authorizationCodeTTL is how long a code can wait before being exchanged.
+const authorizationCodeTTL = time.Minute
+
+// ErrInvalidGrant is returned for unknown, expired, used or mismatched codes.
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// AuthorizationCode represents a row of the authorization_codes table.
+type AuthorizationCode struct {
+	ClientID      string `db:"client_id"`
+	UserID        string `db:"user_id"`
+	RedirectURI   string `db:"redirect_uri"`
+	Scope         string `db:"scope"`
+	Nonce         string `db:"nonce"`
+	CodeChallenge string `db:"code_challenge"`
+}
+
+// CreateAuthorizationCode stores a one-time code for the authorization and
+// returns its opaque value.
+func CreateAuthorizationCode(code AuthorizationCode) (string, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	value, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = sqlxdb.Exec(`
+		INSERT INTO authorization_codes (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, hash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, time.Now().Add(authorizationCodeTTL))
+	if err != nil {
+		return "", fmt.Errorf("error storing authorization code: %w", err)
+	}
+	return value, nil
+}
+
+// ExchangeAuthorizationCode consumes a code for the client. The redirect URI
+// must be the one used at /oauth/authorize and the PKCE verifier must match
+// the S256 challenge.
+func ExchangeAuthorizationCode(value string, clientID string, redirectURI string, codeVerifier string) (*AuthorizationCode, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var code AuthorizationCode
+	err := sqlxdb.Get(&code, `
+		UPDATE authorization_codes
+		SET used_at = now()
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING client_id, user_id, redirect_uri, scope, nonce, code_challenge
+	`, libs.HashOpaqueToken(value))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error consuming authorization code: %w", err)
+	}
+
+	if code.ClientID != clientID || code.RedirectURI != redirectURI || !VerifyPKCE(codeVerifier, code.CodeChallenge) {
+		return nil, ErrInvalidGrant
+	}
+	return &code, nil
+}
+
+// VerifyPKCE checks a code verifier against an S256 code challenge (RFC 7636).
+func VerifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
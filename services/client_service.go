@@ -0,0 +1,455 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/joho/godotenv"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidClient is returned for unknown clients or wrong client secrets.
+	ErrInvalidClient = errors.New("invalid client")
+	// ErrClientExists is returned when registering a client id already in use.
+	ErrClientExists = errors.New("client already exists")
+	// ErrInvalidClientData wraps validation errors of the client admin API.
+	ErrInvalidClientData = errors.New("invalid client data")
+)
+
+// GrantTypes lists the grant types the token endpoint supports.
+var GrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", DeviceCodeGrantType, TokenExchangeGrantType}
+
+// PasswordGrantType lets a client be named as the audience of /auth/login,
+// where the user signs in with a password instead of through the token
+// endpoint.
+const PasswordGrantType = "password"
+
+// clientColumns is the column list shared by the client lookups
+const clientColumns = `
+			client_id,
+			name,
+			secret_hash,
+			redirect_uris,
+			scopes,
+			audiences,
+			grant_types,
+			access_token_ttl,
+			refresh_token_ttl,
+			roles,
+			created_at,
+			updated_at`
+
+// Client represents the structure of the clients table
+type Client struct {
+	ID           string         `db:"client_id" json:"client_id"`
+	Name         string         `db:"name" json:"name"`
+	SecretHash   *string        `db:"secret_hash" json:"-"`
+	RedirectURIs pq.StringArray `db:"redirect_uris" json:"redirect_uris" swaggertype:"array,string"`
+	Scopes       pq.StringArray `db:"scopes" json:"scopes" swaggertype:"array,string"`
+	Audiences    pq.StringArray `db:"audiences" json:"audiences" swaggertype:"array,string"`
+	GrantTypes   pq.StringArray `db:"grant_types" json:"grant_types" swaggertype:"array,string"`
+	// AccessTokenTTL and RefreshTokenTTL are in seconds; nil uses the
+	// server defaults.
+	AccessTokenTTL  *int64 `db:"access_token_ttl" json:"access_token_ttl"`
+	RefreshTokenTTL *int64 `db:"refresh_token_ttl" json:"refresh_token_ttl"`
+	// Roles are the codes of the roles from rols that tokens issued for the
+	// client may carry.
+	Roles     pq.StringArray `db:"roles" json:"roles" swaggertype:"array,string"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// ClientInput holds the fields of a client that the admin API can set.
+type ClientInput struct {
+	ClientID        string   `json:"client_id"`
+	Name            string   `json:"name"`
+	Confidential    bool     `json:"confidential"`
+	RedirectURIs    []string `json:"redirect_uris"`
+	Scopes          []string `json:"scopes"`
+	Audiences       []string `json:"audiences"`
+	GrantTypes      []string `json:"grant_types"`
+	AccessTokenTTL  *int64   `json:"access_token_ttl"`
+	RefreshTokenTTL *int64   `json:"refresh_token_ttl"`
+	Roles           []string `json:"roles"`
+}
+
+// IsConfidential reports whether the client must authenticate with a secret.
+func (c *Client) IsConfidential() bool {
+	return c.SecretHash != nil
+}
+
+// AllowsRedirectURI reports whether the URI is registered for the client.
+// Redirect URIs are compared exactly.
+func (c *Client) AllowsRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// AllowsGrantType reports whether the client may use the grant type.
+func (c *Client) AllowsGrantType(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// AccessTokenLifetime is the lifetime of access tokens issued for the client.
+func (c *Client) AccessTokenLifetime() time.Duration {
+	if c.AccessTokenTTL != nil {
+		return time.Duration(*c.AccessTokenTTL) * time.Second
+	}
+	return libs.GetTokenConfig().AccessTokenTTL
+}
+
+// RefreshTokenLifetime is the lifetime of refresh tokens issued for the client.
+func (c *Client) RefreshTokenLifetime() time.Duration {
+	if c.RefreshTokenTTL != nil {
+		return time.Duration(*c.RefreshTokenTTL) * time.Second
+	}
+	return libs.GetTokenConfig().RefreshTokenTTL
+}
+
+// FilterRoles keeps the roles the client is entitled to see.
+func (c *Client) FilterRoles(roles []Role) []Role {
+	filtered := []Role{}
+	for _, role := range roles {
+		if slices.Contains(c.Roles, role.Code) {
+			filtered = append(filtered, role)
+		}
+	}
+	return filtered
+}
+
+// OpenIDScopes are the OpenID Connect scopes any client may request for a
+// user, on top of its own scopes.
+var OpenIDScopes = []string{"openid", "profile", "email"}
+
+// AllowsUserScopes reports whether the client may request the space
+// separated scopes for a user: each must be an OpenID Connect scope or one
+// of the client's scopes.
+func (c *Client) AllowsUserScopes(requested string) bool {
+	for _, scope := range strings.Fields(requested) {
+		if !slices.Contains(OpenIDScopes, scope) && !slices.Contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// GrantScopes checks the space separated requested scopes against the ones
+// the client may request. An empty request grants every allowed scope.
+func (c *Client) GrantScopes(requested string) ([]string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return c.Scopes, true
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// IssueClientToken signs an access token for a client acting on its own
+// behalf: sub and client_id are the client id and scope lists the granted
+// scopes. An empty audience means every audience allowed for the client.
+func IssueClientToken(client *Client, scopes []string, audience string) (string, int64, error) {
+	payload := map[string]any{
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"scope":     strings.Join(scopes, " "),
+	}
+	if audience != "" {
+		payload["aud"] = audience
+	} else if len(client.Audiences) > 0 {
+		payload["aud"] = []string(client.Audiences)
+	}
+	return libs.GenerateJWT(payload, client.AccessTokenLifetime())
+}
+
+// GetClient looks for a registered client by its id
+func GetClient(clientID string) (*Client, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var client Client
+	err := sqlxdb.Get(&client, `
+		SELECT `+clientColumns+`
+		FROM clients
+		WHERE client_id = $1
+	`, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching client: %w", err)
+	}
+	return &client, nil
+}
+
+// AuthenticateClient checks the credentials of a confidential client.
+func AuthenticateClient(clientID string, secret string) (*Client, error) {
+	client, err := GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.IsConfidential() || bcrypt.CompareHashAndPassword([]byte(*client.SecretHash), []byte(secret)) != nil {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// ImportEnvClients registers the clients of the deprecated AUTH_CLIENTS
+// variable, a comma separated list of "client_id:secret" pairs, as
+// confidential clients that can only introspect tokens. Clients already in
+// the clients table are left untouched, so the variable can be removed once
+// they are managed through /api/admin/clients. It returns the ids of the
+// clients it registered.
+func ImportEnvClients() ([]string, error) {
+	_ = godotenv.Load()
+
+	value := os.Getenv("AUTH_CLIENTS")
+	if value == "" {
+		return nil, nil
+	}
+	var imported []string
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	for _, pair := range strings.Split(value, ",") {
+		clientID, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || clientID == "" || secret == "" {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return imported, fmt.Errorf("error hashing client secret: %w", err)
+		}
+		result, err := sqlxdb.Exec(`
+			INSERT INTO clients (client_id, name, secret_hash, grant_types)
+			VALUES ($1, $1, $2, '{}')
+			ON CONFLICT (client_id) DO NOTHING
+		`, clientID, string(hash))
+		if err != nil {
+			return imported, fmt.Errorf("error importing client %s: %w", clientID, err)
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			imported = append(imported, clientID)
+		}
+	}
+	return imported, nil
+}
+
+// ListClients returns every registered client ordered by id.
+func ListClients() ([]Client, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	clients := []Client{}
+	err := sqlxdb.Select(&clients, `
+		SELECT `+clientColumns+`
+		FROM clients
+		ORDER BY client_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing clients: %w", err)
+	}
+	return clients, nil
+}
+
+// CreateClient registers a client. Confidential clients get a generated
+// secret, which is returned once and only stored as a bcrypt hash.
+func CreateClient(input ClientInput) (*Client, string, error) {
+	if err := validateClientInput(input); err != nil {
+		return nil, "", err
+	}
+
+	var secret string
+	var secretHash *string
+	if input.Confidential {
+		var err error
+		if secret, secretHash, err = generateClientSecret(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var client Client
+	err := sqlxdb.Get(&client, `
+		INSERT INTO clients (client_id, name, secret_hash, redirect_uris, scopes, audiences, grant_types, access_token_ttl, refresh_token_ttl, roles)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (client_id) DO NOTHING
+		RETURNING `+clientColumns,
+		input.ClientID, input.Name, secretHash, textArray(input.RedirectURIs), textArray(input.Scopes),
+		textArray(input.Audiences), textArray(input.GrantTypes), input.AccessTokenTTL, input.RefreshTokenTTL, textArray(input.Roles))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrClientExists
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating client: %w", err)
+	}
+	return &client, secret, nil
+}
+
+// UpdateClient replaces the settings of a client. The client id and secret
+// do not change; a client cannot switch between public and confidential.
+func UpdateClient(clientID string, input ClientInput) (*Client, error) {
+	current, err := GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	input.ClientID = clientID
+	input.Confidential = current.IsConfidential()
+	if err := validateClientInput(input); err != nil {
+		return nil, err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var client Client
+	err = sqlxdb.Get(&client, `
+		UPDATE clients
+		SET name = $2, redirect_uris = $3, scopes = $4, audiences = $5, grant_types = $6,
+			access_token_ttl = $7, refresh_token_ttl = $8, roles = $9, updated_at = now()
+		WHERE client_id = $1
+		RETURNING `+clientColumns,
+		clientID, input.Name, textArray(input.RedirectURIs), textArray(input.Scopes), textArray(input.Audiences),
+		textArray(input.GrantTypes), input.AccessTokenTTL, input.RefreshTokenTTL, textArray(input.Roles))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating client: %w", err)
+	}
+	return &client, nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client and
+// returns the new one.
+func RotateClientSecret(clientID string) (string, error) {
+	secret, secretHash, err := generateClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE clients
+		SET secret_hash = $2, updated_at = now()
+		WHERE client_id = $1 AND secret_hash IS NOT NULL
+	`, clientID, secretHash)
+	if err != nil {
+		return "", fmt.Errorf("error rotating client secret: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return "", ErrInvalidClient
+	}
+	return secret, nil
+}
+
+// DeleteClient removes a client and revokes the refresh tokens issued for it.
+func DeleteClient(clientID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM clients WHERE client_id = $1`, clientID)
+	if err != nil {
+		return fmt.Errorf("error deleting client: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidClient
+	}
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = now()
+		WHERE audience = $1 AND revoked_at IS NULL
+	`, clientID)
+	if err != nil {
+		return fmt.Errorf("error revoking client refresh tokens: %w", err)
+	}
+	return tx.Commit()
+}
+
+// textArray converts a nil slice to an empty array, since the array columns
+// are NOT NULL.
+func textArray(values []string) pq.StringArray {
+	if values == nil {
+		return pq.StringArray{}
+	}
+	return values
+}
+
+func generateClientSecret() (string, *string, error) {
+	secret, _, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", nil, fmt.Errorf("error hashing client secret: %w", err)
+	}
+	secretHash := string(hash)
+	return secret, &secretHash, nil
+}
+
+// validateClientInput checks the settings of a client before storing them.
+// Roles must exist in rols.
+func validateClientInput(input ClientInput) error {
+	if err := ValidateClientSettings(input); err != nil {
+		return err
+	}
+	if len(input.Roles) == 0 {
+		return nil
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var known []string
+	err := sqlxdb.Select(&known, `SELECT code FROM rols WHERE code = ANY($1)`, textArray(input.Roles))
+	if err != nil {
+		return fmt.Errorf("error checking roles: %w", err)
+	}
+	for _, code := range input.Roles {
+		if !slices.Contains(known, code) {
+			return fmt.Errorf("%w: unknown role %q", ErrInvalidClientData, code)
+		}
+	}
+	return nil
+}
+
+// ValidateClientSettings checks the settings of a client that do not depend
+// on the database.
+func ValidateClientSettings(input ClientInput) error {
+	if strings.TrimSpace(input.ClientID) == "" {
+		return fmt.Errorf("%w: client_id is required", ErrInvalidClientData)
+	}
+	for _, grantType := range input.GrantTypes {
+		if !slices.Contains(GrantTypes, grantType) && grantType != PasswordGrantType {
+			return fmt.Errorf("%w: unsupported grant type %q", ErrInvalidClientData, grantType)
+		}
+	}
+	if slices.Contains(input.GrantTypes, "client_credentials") && !input.Confidential {
+		return fmt.Errorf("%w: client_credentials requires a confidential client", ErrInvalidClientData)
+	}
+	if slices.Contains(input.GrantTypes, "authorization_code") && len(input.RedirectURIs) == 0 {
+		return fmt.Errorf("%w: authorization_code requires a redirect URI", ErrInvalidClientData)
+	}
+	for _, uri := range input.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return fmt.Errorf("%w: invalid redirect URI %q", ErrInvalidClientData, uri)
+		}
+	}
+	for _, ttl := range []*int64{input.AccessTokenTTL, input.RefreshTokenTTL} {
+		if ttl != nil && *ttl <= 0 {
+			return fmt.Errorf("%w: token lifetimes must be positive", ErrInvalidClientData)
+		}
+	}
+	return nil
+}
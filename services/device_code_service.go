@@ -0,0 +1,243 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DeviceCodeGrantType is the grant type used to poll for device tokens.
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	// deviceCodeTTL is how long the user has to approve a device.
+	deviceCodeTTL = 10 * time.Minute
+	// devicePollInterval is the minimum number of seconds between polls.
+	devicePollInterval = 5
+	// userCodeAlphabet leaves out vowels and look-alike characters, as
+	// RFC 8628 section 6.1 suggests.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// Polling errors of the device authorization grant (RFC 8628 section 3.5).
+var (
+	ErrAuthorizationPending = errors.New("authorization pending")
+	ErrSlowDown             = errors.New("slow down")
+	ErrAccessDenied         = errors.New("access denied")
+	ErrExpiredToken         = errors.New("device code expired")
+)
+
+// DeviceAuthorization is returned to the device that started the flow.
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ExpiresIn  int64
+	Interval   int
+}
+
+// DeviceCode represents a row of the device_codes table.
+type DeviceCode struct {
+	UserCode     string     `db:"user_code"`
+	ClientID     string     `db:"client_id"`
+	Scope        string     `db:"scope"`
+	Status       string     `db:"status"`
+	UserID       *string    `db:"user_id"`
+	PollInterval int        `db:"poll_interval"`
+	LastPolledAt *time.Time `db:"last_polled_at"`
+	ExpiresAt    time.Time  `db:"expires_at"`
+	UsedAt       *time.Time `db:"used_at"`
+}
+
+// CreateDeviceAuthorization starts a device authorization for the client.
+func CreateDeviceAuthorization(clientID string, scope string) (*DeviceAuthorization, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	// Expired requests are no longer useful and would hold on to user codes
+	if _, err := sqlxdb.Exec(`DELETE FROM device_codes WHERE expires_at < now()`); err != nil {
+		return nil, fmt.Errorf("error purging device codes: %w", err)
+	}
+
+	deviceCode, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqlxdb.Exec(`
+		INSERT INTO device_codes (device_code_hash, user_code, client_id, scope, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hash, userCode, clientID, scope, devicePollInterval, time.Now().Add(deviceCodeTTL))
+	if err != nil {
+		return nil, fmt.Errorf("error storing device code: %w", err)
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ExpiresIn:  int64(deviceCodeTTL.Seconds()),
+		Interval:   devicePollInterval,
+	}, nil
+}
+
+// GetPendingDeviceCode looks for a device request waiting for the user to
+// approve it.
+func GetPendingDeviceCode(userCode string) (*DeviceCode, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var code DeviceCode
+	err := sqlxdb.Get(&code, `
+		SELECT user_code, client_id, scope, status, user_id, poll_interval, last_polled_at, expires_at, used_at
+		FROM device_codes
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > now()
+	`, NormalizeUserCode(userCode))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching device code: %w", err)
+	}
+	return &code, nil
+}
+
+// ApproveDeviceCode records that the user authorized the device.
+func ApproveDeviceCode(userCode string, userID string) error {
+	return completeDeviceCode(userCode, "approved", &userID)
+}
+
+// DenyDeviceCode records that the user rejected the device.
+func DenyDeviceCode(userCode string) error {
+	return completeDeviceCode(userCode, "denied", nil)
+}
+
+func completeDeviceCode(userCode string, status string, userID *string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE device_codes
+		SET status = $2, user_id = $3
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > now()
+	`, NormalizeUserCode(userCode), status, userID)
+	if err != nil {
+		return fmt.Errorf("error updating device code: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidGrant
+	}
+	return nil
+}
+
+// PollDeviceCode is called by the device on every poll of the token
+// endpoint. It returns the approved request once, or one of the RFC 8628
+// polling errors; polling faster than the interval adds 5 seconds to it.
+func PollDeviceCode(deviceCode string, clientID string) (*DeviceCode, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	hash := libs.HashOpaqueToken(deviceCode)
+
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var code DeviceCode
+	err = tx.Get(&code, `
+		SELECT user_code, client_id, scope, status, user_id, poll_interval, last_polled_at, expires_at, used_at
+		FROM device_codes
+		WHERE device_code_hash = $1 AND client_id = $2
+		FOR UPDATE
+	`, hash, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching device code: %w", err)
+	}
+	if code.UsedAt != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	now := time.Now()
+	if now.After(code.ExpiresAt) {
+		return nil, ErrExpiredToken
+	}
+
+	var pollErr error
+	switch {
+	case code.LastPolledAt != nil && now.Sub(*code.LastPolledAt) < time.Duration(code.PollInterval)*time.Second:
+		code.PollInterval += devicePollInterval
+		pollErr = ErrSlowDown
+	case code.Status == "pending":
+		pollErr = ErrAuthorizationPending
+	case code.Status == "denied":
+		code.UsedAt = &now
+		pollErr = ErrAccessDenied
+	default:
+		code.UsedAt = &now
+	}
+
+	_, err = tx.Exec(`
+		UPDATE device_codes
+		SET last_polled_at = $2, poll_interval = $3, used_at = $4
+		WHERE device_code_hash = $1
+	`, hash, now, code.PollInterval, code.UsedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error updating device code: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing device code: %w", err)
+	}
+	if pollErr != nil {
+		return nil, pollErr
+	}
+	return &code, nil
+}
+
+// NormalizeUserCode uppercases a user code and drops the separators users
+// may type, so "bcdf-ghjk" matches "BCDFGHJK".
+func NormalizeUserCode(userCode string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// FormatUserCode splits a user code in two groups for display.
+func FormatUserCode(userCode string) string {
+	if len(userCode) != 8 {
+		return userCode
+	}
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// generateUserCode returns 8 characters from userCodeAlphabet, about 34 bits
+// of entropy.
+func generateUserCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating user code: %w", err)
+	}
+	code := make([]byte, len(buf))
+	for i, b := range buf {
+		// 240 is the largest multiple of 20 below 256; higher bytes would bias the modulo
+		for b >= 240 {
+			var one [1]byte
+			if _, err := rand.Read(one[:]); err != nil {
+				return "", fmt.Errorf("error generating user code: %w", err)
+			}
+			b = one[0]
+		}
+		code[i] = userCodeAlphabet[int(b)%len(userCodeAlphabet)]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// federationStateTTL is how long the user has to sign in at the provider.
+const federationStateTTL = 10 * time.Minute
+
+var (
+	// ErrIdentityProviderNotFound is returned for unknown provider ids.
+	ErrIdentityProviderNotFound = errors.New("identity provider not found")
+	// ErrInvalidIdentityProviderData wraps validation errors of the
+	// identity provider admin API.
+	ErrInvalidIdentityProviderData = errors.New("invalid identity provider data")
+	// ErrInvalidFederationState is returned when the provider redirects back
+	// with an unknown, used or expired state.
+	ErrInvalidFederationState = errors.New("invalid or expired federation state")
+	// ErrFederatedEmailRejected is returned when the provider asserts an
+	// email that is unverified or outside its domains, so it cannot be
+	// linked to a local user.
+	ErrFederatedEmailRejected = errors.New("federated email is unverified or outside the provider domains")
+	// ErrNoLocalAccount is returned when no local user matches the email of
+	// an external identity and no provisioning rule creates one.
+	ErrNoLocalAccount = errors.New("no local account for the federated identity")
+)
+
+// FederatedLoginError is returned when the user has to sign in at the
+// identity provider of the email domain instead of with a password.
+type FederatedLoginError struct {
+	ProviderID string
+}
+
+func (e *FederatedLoginError) Error() string {
+	return "user must sign in with identity provider " + e.ProviderID
+}
+
+// identityProviderColumns is the column list shared by the provider lookups
+const identityProviderColumns = `
+			provider_id,
+			name,
+			issuer,
+			client_id,
+			client_secret,
+			scopes,
+			domains,
+			created_at,
+			updated_at`
+
+// IdentityProvider represents the structure of the identity_providers table
+type IdentityProvider struct {
+	ID           string         `db:"provider_id" json:"provider_id"`
+	Name         string         `db:"name" json:"name"`
+	Issuer       string         `db:"issuer" json:"issuer"`
+	ClientID     string         `db:"client_id" json:"client_id"`
+	ClientSecret string         `db:"client_secret" json:"-"`
+	Scopes       pq.StringArray `db:"scopes" json:"scopes" swaggertype:"array,string"`
+	// Domains are the email domains that sign in at the provider.
+	Domains   pq.StringArray `db:"domains" json:"domains" swaggertype:"array,string"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// IdentityProviderInput holds the fields of a provider that the admin API
+// can set.
+type IdentityProviderInput struct {
+	Name     string `json:"name"`
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	// ClientSecret is kept when omitted; an empty string removes it for
+	// providers that accept public clients.
+	ClientSecret *string  `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	Domains      []string `json:"domains"`
+}
+
+// HandlesEmail reports whether the domain of the email is one of the
+// provider domains.
+func (p *IdentityProvider) HandlesEmail(email string) bool {
+	return slices.Contains(p.Domains, emailDomain(email))
+}
+
+// FederationState represents a row of the federation_states table.
+type FederationState struct {
+	ProviderID   string `db:"provider_id"`
+	Nonce        string `db:"nonce"`
+	CodeVerifier string `db:"code_verifier"`
+	RedirectURI  string `db:"redirect_uri"`
+	// Request is the login request resumed after the callback.
+	Request json.RawMessage `db:"request"`
+}
+
+// GetIdentityProvider looks for a provider by its id
+func GetIdentityProvider(providerID string) (*IdentityProvider, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var provider IdentityProvider
+	err := sqlxdb.Get(&provider, `
+		SELECT `+identityProviderColumns+`
+		FROM identity_providers
+		WHERE provider_id = $1
+	`, providerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdentityProviderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching identity provider: %w", err)
+	}
+	return &provider, nil
+}
+
+// FindIdentityProviderForEmail returns the provider of the email domain, or
+// nil when the domain signs in with passwords.
+func FindIdentityProviderForEmail(email string) (*IdentityProvider, error) {
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil, nil
+	}
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var provider IdentityProvider
+	err := sqlxdb.Get(&provider, `
+		SELECT `+identityProviderColumns+`
+		FROM identity_providers
+		WHERE $1 = ANY (domains)
+	`, domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching identity provider: %w", err)
+	}
+	return &provider, nil
+}
+
+// HomeRealm returns the provider the email must sign in with, or nil when it
+// signs in with a password: its domain has no provider, or the user was
+// assigned a backend in user_auth_backends (e.g. a service account).
+func HomeRealm(email string) (*IdentityProvider, error) {
+	provider, err := FindIdentityProviderForEmail(email)
+	if err != nil || provider == nil {
+		return nil, err
+	}
+	if user, err := GetUserByEmail(email); err == nil {
+		backend, err := GetUserAuthBackend(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if backend != "" {
+			return nil, nil
+		}
+	}
+	return provider, nil
+}
+
+// ListIdentityProviders returns every provider ordered by id.
+func ListIdentityProviders() ([]IdentityProvider, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	providers := []IdentityProvider{}
+	err := sqlxdb.Select(&providers, `
+		SELECT `+identityProviderColumns+`
+		FROM identity_providers
+		ORDER BY provider_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing identity providers: %w", err)
+	}
+	return providers, nil
+}
+
+// SaveIdentityProvider creates or replaces a provider. A domain can only
+// belong to one provider.
+func SaveIdentityProvider(providerID string, input IdentityProviderInput) (*IdentityProvider, error) {
+	if err := validateIdentityProviderInput(providerID, &input); err != nil {
+		return nil, err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var owner string
+	err := sqlxdb.Get(&owner, `
+		SELECT provider_id FROM identity_providers
+		WHERE provider_id <> $1 AND domains && $2
+		LIMIT 1
+	`, providerID, textArray(input.Domains))
+	if err == nil {
+		return nil, fmt.Errorf("%w: a domain already belongs to provider %q", ErrInvalidIdentityProviderData, owner)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error checking provider domains: %w", err)
+	}
+
+	var provider IdentityProvider
+	err = sqlxdb.Get(&provider, `
+		INSERT INTO identity_providers (provider_id, name, issuer, client_id, client_secret, scopes, domains)
+		VALUES ($1, $2, $3, $4, COALESCE($5, ''), $6, $7)
+		ON CONFLICT (provider_id) DO UPDATE
+		SET name = EXCLUDED.name, issuer = EXCLUDED.issuer, client_id = EXCLUDED.client_id,
+			client_secret = COALESCE($5, identity_providers.client_secret),
+			scopes = EXCLUDED.scopes, domains = EXCLUDED.domains, updated_at = now()
+		RETURNING `+identityProviderColumns,
+		providerID, input.Name, input.Issuer, input.ClientID, input.ClientSecret, textArray(input.Scopes), textArray(input.Domains))
+	if err != nil {
+		return nil, fmt.Errorf("error saving identity provider: %w", err)
+	}
+	return &provider, nil
+}
+
+// DeleteIdentityProvider removes a provider with its pending logins, the
+// identities linked through it and its provisioning rules. Its domains sign
+// in with passwords again.
+func DeleteIdentityProvider(providerID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM identity_providers WHERE provider_id = $1`, providerID)
+	if err != nil {
+		return fmt.Errorf("error deleting identity provider: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrIdentityProviderNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM federation_states WHERE provider_id = $1`, providerID); err != nil {
+		return fmt.Errorf("error deleting federation states: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE provider_id = $1`, providerID); err != nil {
+		return fmt.Errorf("error deleting linked identities: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM provisioning_rules WHERE source = $1`, providerID); err != nil {
+		return fmt.Errorf("error deleting provisioning rules: %w", err)
+	}
+	return tx.Commit()
+}
+
+// validateIdentityProviderInput checks and normalizes the settings of a
+// provider before storing them.
+func validateIdentityProviderInput(providerID string, input *IdentityProviderInput) error {
+	if strings.TrimSpace(providerID) == "" || providerID == LocalBackend || providerID == LDAPBackend {
+		return fmt.Errorf("%w: invalid provider id %q", ErrInvalidIdentityProviderData, providerID)
+	}
+	issuer, err := url.Parse(input.Issuer)
+	if err != nil || !issuer.IsAbs() || issuer.Host == "" {
+		return fmt.Errorf("%w: issuer must be an absolute URL", ErrInvalidIdentityProviderData)
+	}
+	if strings.TrimSpace(input.ClientID) == "" {
+		return fmt.Errorf("%w: client_id is required", ErrInvalidIdentityProviderData)
+	}
+	if len(input.Domains) == 0 {
+		return fmt.Errorf("%w: at least one domain is required", ErrInvalidIdentityProviderData)
+	}
+	for i, domain := range input.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, "@/ ") {
+			return fmt.Errorf("%w: invalid domain %q", ErrInvalidIdentityProviderData, input.Domains[i])
+		}
+		input.Domains[i] = domain
+	}
+	if len(input.Scopes) == 0 {
+		input.Scopes = []string{"openid", "email", "profile"}
+	}
+	if !slices.Contains(input.Scopes, "openid") {
+		return fmt.Errorf("%w: scopes must include openid", ErrInvalidIdentityProviderData)
+	}
+	return nil
+}
+
+// StartFederatedLogin stores the state of a login at the provider and
+// returns the URL to send the browser to. The provider redirects back to
+// redirectURI, where request is resumed.
+func StartFederatedLogin(provider *IdentityProvider, redirectURI string, loginHint string, request json.RawMessage) (string, error) {
+	upstream, err := libs.DiscoverOIDCProvider(provider.Issuer)
+	if err != nil {
+		return "", err
+	}
+	state, stateHash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, _, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, _, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	if _, err := sqlxdb.Exec(`DELETE FROM federation_states WHERE expires_at <= now()`); err != nil {
+		return "", fmt.Errorf("error purging federation states: %w", err)
+	}
+	_, err = sqlxdb.Exec(`
+		INSERT INTO federation_states (state_hash, provider_id, nonce, code_verifier, redirect_uri, request, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, stateHash, provider.ID, nonce, codeVerifier, redirectURI, []byte(request), time.Now().Add(federationStateTTL))
+	if err != nil {
+		return "", fmt.Errorf("error storing federation state: %w", err)
+	}
+
+	return upstream.AuthorizationURL(provider.ClientID, redirectURI, provider.Scopes, state, nonce, codeVerifier, loginHint), nil
+}
+
+// TakeFederationState consumes the state the provider redirected back with.
+func TakeFederationState(state string) (*FederationState, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var stored FederationState
+	err := sqlxdb.Get(&stored, `
+		DELETE FROM federation_states
+		WHERE state_hash = $1 AND expires_at > now()
+		RETURNING provider_id, nonce, code_verifier, redirect_uri, request
+	`, libs.HashOpaqueToken(state))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidFederationState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error consuming federation state: %w", err)
+	}
+	return &stored, nil
+}
+
+// CompleteFederatedLogin redeems the code at the provider, verifies the
+// id_token and returns the local user linked to the upstream subject. An
+// identity seen for the first time is linked to the user with the same
+// email, provided the provider verified it and it belongs to its domains;
+// without such a user it is provisioned when a provisioning rule matches.
+// Inactive and locked accounts are refused as on the password login. The
+// flag tells whether the provider asserts a multi-factor login, which then
+// stands for the second factor of the user here.
+func CompleteFederatedLogin(state *FederationState, code string) (*User, bool, error) {
+	provider, err := GetIdentityProvider(state.ProviderID)
+	if err != nil {
+		return nil, false, err
+	}
+	upstream, err := libs.DiscoverOIDCProvider(provider.Issuer)
+	if err != nil {
+		return nil, false, err
+	}
+	idToken, err := upstream.ExchangeCode(provider.ClientID, provider.ClientSecret, code, state.RedirectURI, state.CodeVerifier)
+	if err != nil {
+		return nil, false, err
+	}
+	claims, err := upstream.VerifyIDToken(idToken, provider.ClientID, state.Nonce)
+	if err != nil {
+		return nil, false, err
+	}
+
+	user, err := linkFederatedIdentity(provider, claims)
+	if err != nil {
+		return nil, false, err
+	}
+	if !user.IsActive {
+		return nil, false, ErrUserInactive
+	}
+	lockedUntil, err := GetLockedUntil(user.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if lockedUntil != nil {
+		return nil, false, &AccountLockedError{UserID: user.ID, Until: *lockedUntil}
+	}
+	return user, federatedMFA(claims), nil
+}
+
+// linkFederatedIdentity returns the user linked to the subject of the
+// claims. An identity seen for the first time is linked to the user with its
+// email, or provisioned when there is none.
+func linkFederatedIdentity(provider *IdentityProvider, claims map[string]any) (*User, error) {
+	identity := &ExternalIdentity{Source: provider.ID}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	groups, _ := claims["groups"].([]any)
+	for _, group := range groups {
+		if name, ok := group.(string); ok {
+			identity.Groups = append(identity.Groups, name)
+		}
+	}
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var userID string
+	err := sqlxdb.Get(&userID, `
+		UPDATE user_identities
+		SET last_login_at = now(), email = COALESCE(NULLIF($3, ''), email)
+		WHERE provider_id = $1 AND subject = $2
+		RETURNING user_id
+	`, provider.ID, identity.Subject, identity.Email)
+	if err == nil {
+		return GetUserByID(userID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error reading linked identity: %w", err)
+	}
+
+	if identity.Email == "" || !emailVerified(claims) || !provider.HandlesEmail(identity.Email) {
+		return nil, ErrFederatedEmailRejected
+	}
+	user, err := GetUserByEmail(identity.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProvisionUser(identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := linkIdentity(sqlxdb, user.ID, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// emailVerified reads the email_verified claim. Only an explicit true links
+// an identity to an existing account by email, so a provider that omits the
+// claim cannot take over accounts of its domains, staff included.
+func emailVerified(claims map[string]any) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	default:
+		return false
+	}
+}
+
+// federatedMFA reports whether the amr claim (RFC 8176) of the id_token
+// lists "mfa", i.e. the user signed in at the provider with more than one
+// factor.
+func federatedMFA(claims map[string]any) bool {
+	methods, _ := claims["amr"].([]any)
+	for _, method := range methods {
+		if method == "mfa" {
+			return true
+		}
+	}
+	return false
+}
+
+// emailDomain returns the lowercased domain of an email, or "".
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrIdentityNotFound is returned when unlinking an identity the user
+	// does not have.
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrIdentityLinkedToOtherUser is returned when an identity signs in as
+	// a user other than the one it is linked to, e.g. a directory entry
+	// whose email was given to someone else.
+	ErrIdentityLinkedToOtherUser = errors.New("identity is linked to another user")
+)
+
+// ExternalIdentity is a user as asserted by a directory or an upstream
+// identity provider.
+type ExternalIdentity struct {
+	// Source is LDAPBackend or the id of the identity provider.
+	Source string
+	// Subject identifies the user at the source: the DN of the LDAP entry
+	// or the sub claim.
+	Subject string
+	Email   string
+	Name    string
+	// Groups are the directory groups or the groups claim.
+	Groups []string
+}
+
+// UserIdentity represents the structure of the user_identities table
+type UserIdentity struct {
+	ID          int64      `db:"identity_id" json:"identity_id"`
+	ProviderID  string     `db:"provider_id" json:"provider_id"`
+	Subject     string     `db:"subject" json:"subject"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	Email       string     `db:"email" json:"email"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	LastLoginAt *time.Time `db:"last_login_at" json:"last_login_at,omitempty"`
+}
+
+// ListUserIdentities returns the external identities linked to the user.
+func ListUserIdentities(userID string) ([]UserIdentity, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	identities := []UserIdentity{}
+	err := sqlxdb.Select(&identities, `
+		SELECT identity_id, provider_id, subject, user_id, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing identities: %w", err)
+	}
+	return identities, nil
+}
+
+// UnlinkUserIdentity removes an identity of the user. The next login with
+// it is linked again by email, or provisioned when no user has that email.
+func UnlinkUserIdentity(userID string, identityID int64) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	result, err := sqlxdb.Exec(`DELETE FROM user_identities WHERE user_id = $1 AND identity_id = $2`, userID, identityID)
+	if err != nil {
+		return fmt.Errorf("error unlinking identity: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+// linkIdentity links the identity to the user, or records the login when it
+// is already linked to them. It returns ErrIdentityLinkedToOtherUser when
+// the identity belongs to another user; an admin has to unlink it first.
+func linkIdentity(db sqlx.Execer, userID string, identity *ExternalIdentity) error {
+	result, err := db.Exec(`
+		INSERT INTO user_identities (provider_id, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (provider_id, subject) DO UPDATE
+		SET last_login_at = now(), email = EXCLUDED.email
+		WHERE user_identities.user_id = EXCLUDED.user_id
+	`, identity.Source, identity.Subject, userID, identity.Email)
+	if err != nil {
+		return fmt.Errorf("error linking identity: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrIdentityLinkedToOtherUser
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/joho/godotenv"
+)
+
+// ErrAccountLocked is matched by AccountLockedError.
+var ErrAccountLocked = errors.New("account locked")
+
+// AccountLockedError is returned by AuthenticateUser while an account is
+// locked after too many failed logins.
+type AccountLockedError struct {
+	UserID string
+	Until  time.Time
+	// JustLocked is set when the failed attempt being reported locked the
+	// account.
+	JustLocked bool
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("account locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// Unwrap lets errors.Is match ErrAccountLocked.
+func (e *AccountLockedError) Unwrap() error {
+	return ErrAccountLocked
+}
+
+// LockoutConfig controls when and for how long accounts are locked.
+type LockoutConfig struct {
+	// Threshold is the number of consecutive failures that locks the account.
+	Threshold int
+	// Duration is the first lock; each further lock doubles it.
+	Duration time.Duration
+	// MaxDuration caps the lock. Once an account has been unlocked for this
+	// long the escalation starts over.
+	MaxDuration time.Duration
+}
+
+var (
+	lockoutConfig     LockoutConfig
+	onceLockoutConfig sync.Once
+)
+
+// LoadLockoutConfigFromEnv reads LOGIN_LOCKOUT_THRESHOLD (default 5),
+// LOGIN_LOCKOUT_DURATION (default 15m) and LOGIN_LOCKOUT_MAX_DURATION
+// (default 24h).
+func LoadLockoutConfigFromEnv() LockoutConfig {
+	_ = godotenv.Load()
+
+	return LockoutConfig{
+		Threshold:   libs.IntFromEnv("LOGIN_LOCKOUT_THRESHOLD", 5),
+		Duration:    libs.DurationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		MaxDuration: libs.DurationFromEnv("LOGIN_LOCKOUT_MAX_DURATION", 24*time.Hour),
+	}
+}
+
+// GetLockoutConfig returns the lockout configuration loaded once from the environment.
+func GetLockoutConfig() LockoutConfig {
+	onceLockoutConfig.Do(func() {
+		lockoutConfig = LoadLockoutConfigFromEnv()
+	})
+	return lockoutConfig
+}
+
+// LockDuration is the length of the lock number lockCount (starting at 0).
+func (c LockoutConfig) LockDuration(lockCount int) time.Duration {
+	duration := c.Duration
+	for i := 0; i < lockCount && duration < c.MaxDuration; i++ {
+		duration *= 2
+	}
+	return min(duration, c.MaxDuration)
+}
+
+// GetLockedUntil returns the end of the current lock of the user, or nil.
+func GetLockedUntil(userID string) (*time.Time, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var lockedUntil *time.Time
+	err := sqlxdb.Get(&lockedUntil, `
+		SELECT locked_until
+		FROM login_failures
+		WHERE user_id = $1 AND locked_until > now()
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error checking account lock: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+// RecordLoginFailure counts a failed login and locks the account when the
+// threshold is reached, returning the end of the new lock.
+func RecordLoginFailure(userID string) (*time.Time, error) {
+	config := GetLockoutConfig()
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var failures struct {
+		FailedAttempts int        `db:"failed_attempts"`
+		LockCount      int        `db:"lock_count"`
+		LockedUntil    *time.Time `db:"locked_until"`
+	}
+	err = tx.Get(&failures, `
+		INSERT INTO login_failures (user_id, failed_attempts, last_failed_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (user_id) DO UPDATE
+		SET failed_attempts = login_failures.failed_attempts + 1, last_failed_at = now()
+		RETURNING failed_attempts, lock_count, locked_until
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error recording login failure: %w", err)
+	}
+
+	if config.Threshold <= 0 || failures.FailedAttempts < config.Threshold {
+		return nil, tx.Commit()
+	}
+
+	now := time.Now()
+	lockCount := failures.LockCount
+	if failures.LockedUntil != nil && now.Sub(*failures.LockedUntil) > config.MaxDuration {
+		lockCount = 0
+	}
+	lockedUntil := now.Add(config.LockDuration(lockCount))
+	_, err = tx.Exec(`
+		UPDATE login_failures
+		SET failed_attempts = 0, lock_count = $2, locked_until = $3
+		WHERE user_id = $1
+	`, userID, lockCount+1, lockedUntil)
+	if err != nil {
+		return nil, fmt.Errorf("error locking account: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error locking account: %w", err)
+	}
+	return &lockedUntil, nil
+}
+
+// ResetLoginFailures clears the failure count after a successful login. The
+// lock count is kept so the next lock keeps escalating.
+func ResetLoginFailures(userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err := sqlxdb.Exec(`
+		UPDATE login_failures
+		SET failed_attempts = 0
+		WHERE user_id = $1 AND failed_attempts > 0
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("error resetting login failures: %w", err)
+	}
+	return nil
+}
+
+// UnlockUser lifts the lock of an account and forgets its failures.
+func UnlockUser(userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err := sqlxdb.Exec(`DELETE FROM login_failures WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("error unlocking account: %w", err)
+	}
+	return nil
+}
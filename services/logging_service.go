@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"global-auth-server/libs"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -40,6 +41,7 @@ func NewLoggingService() *LoggingService {
 			MaxRetries:    3,                               
 			BatchSize:     10,                              
 			BatchInterval: 2 * time.Second,               
+			TokenSource:   logSenderToken,
 		}
 		loggingServiceInstance = &LoggingService{
 			logSender: libs.GetLogSender(config),
@@ -48,6 +50,25 @@ func NewLoggingService() *LoggingService {
 	return loggingServiceInstance
 }
 
+// logSenderToken issues the client_credentials token the log sender presents
+// to the log API. The identity is configured with LOG_CLIENT_ID,
+// LOG_CLIENT_SCOPES and LOG_CLIENT_AUDIENCE.
+func logSenderToken() (string, error) {
+	client := &Client{
+		ID:        os.Getenv("LOG_CLIENT_ID"),
+		Scopes:    strings.Fields(os.Getenv("LOG_CLIENT_SCOPES")),
+		Audiences: strings.Fields(os.Getenv("LOG_CLIENT_AUDIENCE")),
+	}
+	if client.ID == "" {
+		client.ID = "log-sender"
+	}
+	if len(client.Scopes) == 0 {
+		client.Scopes = []string{"logs:write"}
+	}
+	token, _, err := IssueClientToken(client, client.Scopes, "")
+	return token, err
+}
+
 // Log Calls the logsender log method with the data provided.
 func (ls *LoggingService) Log(userID any, url string, payload any, response any, action string) {
 	ls.logSender.Log(userID, url, payload, response, action)
@@ -70,7 +91,7 @@ func CanLogin(email string) (*LoginResponse, error) {
 		return nil, fmt.Errorf("el usuario con email '%s' no existe o está inactivo", email)
 	}
 
-	if user.Logins != nil && *user.Logins >= 30 {
+	if limit := MaxPasswordLogins(); limit > 0 && user.Logins != nil && *user.Logins >= limit {
 		return nil, fmt.Errorf("el usuario '%s' ha excedido el uso de la contraseña actual, actualícela", email)
 	}
 
@@ -0,0 +1,635 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// mfaChallengeTTL is how long the second step of a login can take.
+	mfaChallengeTTL = 5 * time.Minute
+	// maxMFAAttempts is the number of codes tried per challenge.
+	maxMFAAttempts = 5
+	// recoveryCodeCount is the number of recovery codes of a user.
+	recoveryCodeCount = 10
+	// recoveryCodeAlphabet has 32 characters without look-alikes, so each
+	// random byte maps to one without bias.
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz023456789"
+)
+
+var (
+	// ErrMFARequired is returned when a verification code is needed.
+	ErrMFARequired = errors.New("verification code required")
+	// ErrPasskeyRequired is returned by CheckMFA when the user completes the
+	// second step with a passkey.
+	ErrPasskeyRequired = errors.New("passkey required")
+	// ErrMFAEnrollmentRequired is returned when a role of the user requires
+	// MFA and the user has not enabled it.
+	ErrMFAEnrollmentRequired = errors.New("MFA enrollment required")
+	// ErrInvalidMFACode is returned for a wrong, reused or expired code.
+	ErrInvalidMFACode = errors.New("invalid verification code")
+	// ErrMFAAlreadyEnabled is returned when enrolling a user with MFA.
+	ErrMFAAlreadyEnabled = errors.New("MFA already enabled")
+	// ErrMFANotEnabled is returned for users without MFA.
+	ErrMFANotEnabled = errors.New("MFA not enabled")
+	// ErrMFARequiredByRole is returned when disabling MFA a role requires.
+	ErrMFARequiredByRole = errors.New("MFA is required by a role of the user")
+	// ErrInvalidMFAChallenge is returned for an unknown, used or expired
+	// challenge token.
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA token")
+	// ErrInvalidEnrollmentToken is returned for an unknown, used or expired
+	// enrollment token, or one issued for another user.
+	ErrInvalidEnrollmentToken = errors.New("invalid or expired enrollment token")
+	// ErrStepUpRequired is returned by VerifyStepUp when the proof the user
+	// must give is missing.
+	ErrStepUpRequired = errors.New("current password or second factor required")
+)
+
+// MFAEnrollmentTTL is how long an enrollment token issued by an admin can be
+// used, read from MFA_ENROLLMENT_TTL (default 72h).
+func MFAEnrollmentTTL() time.Duration {
+	return libs.DurationFromEnv("MFA_ENROLLMENT_TTL", 72*time.Hour)
+}
+
+// MFAState tells whether the user has MFA enabled, whether a role of the
+// user requires it and whether the user has passkeys, which can be used as
+// the second factor too.
+type MFAState struct {
+	Enabled  bool
+	Required bool
+	Passkeys bool
+}
+
+// MFAEnrollment is the secret of a new enrollment and its provisioning URI.
+type MFAEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// MFAChallenge represents a row of the mfa_challenges table.
+type MFAChallenge struct {
+	UserID   string `db:"user_id"`
+	Audience string `db:"audience"`
+}
+
+// GetMFAState reads the MFA state of the user.
+func GetMFAState(userID string) (MFAState, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var state MFAState
+	err := sqlxdb.QueryRowx(`
+		SELECT
+			EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND enabled_at IS NOT NULL),
+			EXISTS (
+				SELECT 1 FROM user_roles ur
+				INNER JOIN rols r ON ur.rol_id = r.id
+				WHERE ur.user_id::text = $1 AND r.requires_mfa
+			),
+			EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`, userID).Scan(&state.Enabled, &state.Required, &state.Passkeys)
+	if err != nil {
+		return state, fmt.Errorf("error reading MFA state: %w", err)
+	}
+	return state, nil
+}
+
+// StartMFAEnrollment creates a new secret for the user, replacing any
+// enrollment not confirmed yet. MFA is enabled once EnableMFA checks a code.
+// The secret is stored sealed with SECRET_ENCRYPTION_KEY.
+func StartMFAEnrollment(user *User) (*MFAEnrollment, error) {
+	secret, err := libs.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := libs.SealSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		INSERT INTO user_mfa (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+		WHERE user_mfa.enabled_at IS NULL
+	`, user.ID, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("error storing MFA secret: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return &MFAEnrollment{Secret: secret, URI: libs.TOTPURI(mfaIssuer(), user.Email, secret)}, nil
+}
+
+// mfaIssuer is the account issuer shown by authenticator apps, read from
+// MFA_ISSUER.
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Global Auth"
+}
+
+// EnableMFA confirms the pending enrollment of the user with a code from the
+// authenticator app and returns the recovery codes.
+func EnableMFA(userID string, code string) ([]string, error) {
+	step, err := checkTOTP(userID, code, false)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE user_mfa
+		SET enabled_at = now(), last_used_step = $2
+		WHERE user_id = $1 AND enabled_at IS NULL
+	`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("error enabling MFA: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error enabling MFA: %w", err)
+	}
+	return codes, nil
+}
+
+// VerifyMFA checks a code from the authenticator app or an unused recovery
+// code of a user with MFA enabled. Both can only be used once.
+func VerifyMFA(userID string, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrMFARequired
+	}
+	if len(code) != libs.TOTPDigits {
+		return useRecoveryCode(userID, code)
+	}
+
+	step, err := checkTOTP(userID, code, true)
+	if err != nil {
+		return err
+	}
+
+	// Moving last_used_step forward in one statement rejects a replay
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE user_mfa
+		SET last_used_step = $2
+		WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_used_step < $2
+	`, userID, step)
+	if err != nil {
+		return fmt.Errorf("error storing MFA step: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// CheckMFACode is VerifyMFA for a signed in user changing its MFA settings.
+// A locked account is refused and a wrong code counts as a failed login,
+// locking the account as wrong passwords do, so a stolen access token cannot
+// be used to guess codes.
+func CheckMFACode(userID string, code string) error {
+	lockedUntil, err := GetLockedUntil(userID)
+	if err != nil {
+		return err
+	}
+	if lockedUntil != nil {
+		return &AccountLockedError{UserID: userID, Until: *lockedUntil}
+	}
+
+	err = VerifyMFA(userID, code)
+	if errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrMFARequired) {
+		lockedUntil, lockErr := RecordLoginFailure(userID)
+		if lockErr != nil {
+			return lockErr
+		}
+		if lockedUntil != nil {
+			return &AccountLockedError{UserID: userID, Until: *lockedUntil, JustLocked: true}
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return ResetLoginFailures(userID)
+}
+
+// StepUp is what a signed in user gives to prove it is still the account
+// holder: the current password, or a code or a passkey assertion from a
+// login session started without a user.
+type StepUp struct {
+	Password   string
+	Code       string
+	SessionID  string
+	Credential []byte
+}
+
+// VerifyStepUp checks a factor of the user besides the access token before
+// a new factor is added, so a stolen token cannot plant one that outlasts
+// it. A user with MFA or passkeys proves one of them; anyone else the
+// current password. Wrong codes and passwords count as failed logins. Users
+// of an identity provider have no password here and are only refused by the
+// age of their token.
+func VerifyStepUp(user *User, proof StepUp) error {
+	state, err := GetMFAState(user.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case state.Enabled && proof.Code != "":
+		return CheckMFACode(user.ID, proof.Code)
+	case state.Passkeys && proof.SessionID != "":
+		verified, _, err := FinishWebAuthnLogin(proof.SessionID, "", proof.Credential)
+		if err != nil {
+			return err
+		}
+		if verified.ID != user.ID {
+			return ErrWebAuthnVerification
+		}
+		return nil
+	case state.Enabled || state.Passkeys:
+		return ErrStepUpRequired
+	}
+
+	_, err = Authenticators(user)
+	var federated *FederatedLoginError
+	if errors.As(err, &federated) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if proof.Password == "" {
+		return ErrStepUpRequired
+	}
+	_, _, err = checkPassword(user, proof.Password)
+	return err
+}
+
+// checkTOTP validates a code against the enabled or the pending secret of
+// the user and returns its time step.
+func checkTOTP(userID string, code string, enabled bool) (int64, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var secret string
+	var lastUsedStep int64
+	err := sqlxdb.QueryRowx(`
+		SELECT secret, last_used_step FROM user_mfa
+		WHERE user_id = $1 AND (enabled_at IS NOT NULL) = $2
+	`, userID, enabled).Scan(&secret, &lastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrMFANotEnabled
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading MFA secret: %w", err)
+	}
+	if secret, err = libs.OpenSecret(secret); err != nil {
+		return 0, err
+	}
+
+	step, ok := libs.ValidateTOTP(secret, code, time.Now(), 1)
+	if !ok || step <= lastUsedStep {
+		return 0, ErrInvalidMFACode
+	}
+	return step, nil
+}
+
+// useRecoveryCode consumes a recovery code of the user.
+func useRecoveryCode(userID string, code string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE mfa_recovery_codes
+		SET used_at = now()
+		WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL
+	`, libs.HashOpaqueToken(normalizeRecoveryCode(code)), userID)
+	if err != nil {
+		return fmt.Errorf("error using recovery code: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user with MFA
+// enabled.
+func RegenerateRecoveryCodes(userID string) ([]string, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error storing recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+func replaceRecoveryCodes(tx *sqlx.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO mfa_recovery_codes (code_hash, user_id) VALUES ($1, $2)
+		`, libs.HashOpaqueToken(normalizeRecoveryCode(code)), userID)
+		if err != nil {
+			return nil, fmt.Errorf("error storing recovery code: %w", err)
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random code like "ab3d-ef4h-jk5m-np6q".
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating recovery code: %w", err)
+	}
+	var code strings.Builder
+	for i, b := range buf {
+		if i > 0 && i%4 == 0 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(recoveryCodeAlphabet[int(b)%32])
+	}
+	return code.String(), nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// DisableMFA removes the MFA secret and the recovery codes of the user.
+func DisableMFA(userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_mfa WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("error disabling MFA: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error disabling MFA: %w", err)
+	}
+	return nil
+}
+
+// CheckMFA enforces MFA on a login form that takes the code along with the
+// password: users with MFA enabled must send a valid code, users with
+// passkeys who send no code get ErrPasskeyRequired so the form asks for the
+// passkey, and users a role requires MFA from must enroll first.
+func CheckMFA(userID string, code string) error {
+	state, err := GetMFAState(userID)
+	if err != nil {
+		return err
+	}
+	if state.Enabled && (strings.TrimSpace(code) != "" || !state.Passkeys) {
+		return VerifyMFA(userID, code)
+	}
+	if state.Passkeys {
+		return ErrPasskeyRequired
+	}
+	if state.Required {
+		return ErrMFAEnrollmentRequired
+	}
+	return nil
+}
+
+// CreateMFAChallenge stores the pending second step of a login and returns
+// the opaque token that completes it.
+func CreateMFAChallenge(userID string, audience string) (string, time.Duration, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	if _, err := sqlxdb.Exec(`DELETE FROM mfa_challenges WHERE expires_at < now()`); err != nil {
+		return "", 0, fmt.Errorf("error purging MFA challenges: %w", err)
+	}
+
+	token, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = sqlxdb.Exec(`
+		INSERT INTO mfa_challenges (token_hash, user_id, audience, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, hash, userID, audience, time.Now().Add(mfaChallengeTTL))
+	if err != nil {
+		return "", 0, fmt.Errorf("error storing MFA challenge: %w", err)
+	}
+	return token, mfaChallengeTTL, nil
+}
+
+// GetMFAChallenge looks up a live challenge without using an attempt.
+func GetMFAChallenge(token string) (*MFAChallenge, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var challenge MFAChallenge
+	err := sqlxdb.Get(&challenge, `
+		SELECT user_id, audience FROM mfa_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() AND attempts < $2
+	`, libs.HashOpaqueToken(token), maxMFAAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading MFA challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// CompleteMFAChallenge checks the code for a challenge and consumes it. For
+// a user still enrolling, the code confirms the enrollment and the recovery
+// codes are returned. Each challenge allows a few attempts only.
+func CompleteMFAChallenge(token string, code string) (*MFAChallenge, []string, error) {
+	challenge, err := attemptMFAChallenge(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, err := GetMFAState(challenge.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recoveryCodes []string
+	if state.Enabled {
+		err = VerifyMFA(challenge.UserID, code)
+	} else {
+		recoveryCodes, err = EnableMFA(challenge.UserID, code)
+	}
+	if errors.Is(err, ErrMFANotEnabled) {
+		err = ErrInvalidMFACode
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := consumeMFAChallenge(token); err != nil {
+		return nil, nil, err
+	}
+	return challenge, recoveryCodes, nil
+}
+
+// IssueMFAEnrollmentToken returns a single-use token that lets a user a
+// role requires MFA from enroll during a login, replacing the tokens issued
+// before. Admins hand it to the user through a trusted channel, so a leaked
+// password alone is not enough to enroll an authenticator.
+func IssueMFAEnrollmentToken(userID string) (string, time.Duration, error) {
+	token, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", 0, err
+	}
+	ttl := MFAEnrollmentTTL()
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return "", 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM mfa_enrollment_tokens
+		WHERE user_id = $1 OR expires_at < now()
+	`, userID)
+	if err != nil {
+		return "", 0, fmt.Errorf("error purging enrollment tokens: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO mfa_enrollment_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, userID, time.Now().Add(ttl))
+	if err != nil {
+		return "", 0, fmt.Errorf("error storing enrollment token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", 0, fmt.Errorf("error storing enrollment token: %w", err)
+	}
+	return token, ttl, nil
+}
+
+// StartChallengeEnrollment hands the TOTP secret to a user completing a
+// login that requires enrollment, once the enrollment token issued to the
+// same user checks out. The token is consumed, so the pending secret only
+// changes when a new token is issued.
+func StartChallengeEnrollment(token string, enrollmentToken string) (*MFAEnrollment, error) {
+	challenge, err := attemptMFAChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE mfa_enrollment_tokens
+		SET used_at = now()
+		WHERE token_hash = $1 AND user_id = $2 AND used_at IS NULL AND expires_at > now()
+	`, libs.HashOpaqueToken(enrollmentToken), challenge.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming enrollment token: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	user, err := GetUserByID(challenge.UserID)
+	if err != nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return StartMFAEnrollment(user)
+}
+
+// CompleteMFAChallengeWithWebAuthn completes a challenge with a passkey of
+// the user instead of a code, verifying the WebAuthn login started for it.
+func CompleteMFAChallengeWithWebAuthn(token string, sessionID string, response []byte) (*MFAChallenge, error) {
+	challenge, err := attemptMFAChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := FinishWebAuthnLogin(sessionID, challenge.UserID, response); err != nil {
+		return nil, err
+	}
+	if err := consumeMFAChallenge(token); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// attemptMFAChallenge counts an attempt on a live challenge.
+func attemptMFAChallenge(token string) (*MFAChallenge, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var challenge MFAChallenge
+	err := sqlxdb.Get(&challenge, `
+		UPDATE mfa_challenges
+		SET attempts = attempts + 1
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() AND attempts < $2
+		RETURNING user_id, audience
+	`, libs.HashOpaqueToken(token), maxMFAAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading MFA challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// consumeMFAChallenge marks a challenge as used, so it completes one login.
+func consumeMFAChallenge(token string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		UPDATE mfa_challenges SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL
+	`, libs.HashOpaqueToken(token))
+	if err != nil {
+		return fmt.Errorf("error consuming MFA challenge: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidMFAChallenge
+	}
+	return nil
+}
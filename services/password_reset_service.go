@@ -0,0 +1,229 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidResetToken is returned for an unknown, used or expired reset
+// token.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// PasswordResetTTL is how long a reset token can be used, read from
+// PASSWORD_RESET_TTL (default 30m).
+func PasswordResetTTL() time.Duration {
+	return libs.DurationFromEnv("PASSWORD_RESET_TTL", 30*time.Minute)
+}
+
+const (
+	// passwordResetWorkers is how many reset emails are sent at once.
+	passwordResetWorkers = 4
+	// passwordResetQueueSize is how many requests wait for a worker; further
+	// requests are dropped.
+	passwordResetQueueSize = 256
+)
+
+// passwordResetRequest is a reset email waiting in the queue, with the path
+// it was requested on for the audit log.
+type passwordResetRequest struct {
+	email string
+	path  string
+}
+
+var (
+	passwordResetQueue     chan passwordResetRequest
+	oncePasswordResetQueue sync.Once
+)
+
+// QueuePasswordReset sends the reset email of RequestPasswordReset in the
+// background and audits the result. A fixed number of workers send the
+// emails, so a burst of requests cannot pile up goroutines and SMTP
+// connections; when the queue is full the request is dropped and false is
+// returned.
+func QueuePasswordReset(email string, path string) bool {
+	oncePasswordResetQueue.Do(func() {
+		passwordResetQueue = make(chan passwordResetRequest, passwordResetQueueSize)
+		for range passwordResetWorkers {
+			go sendPasswordResets(passwordResetQueue)
+		}
+	})
+
+	select {
+	case passwordResetQueue <- passwordResetRequest{email: email, path: path}:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendPasswordResets is a worker of the reset email queue.
+func sendPasswordResets(queue <-chan passwordResetRequest) {
+	loggingService := NewLoggingService()
+	for request := range queue {
+		user, err := RequestPasswordReset(request.email)
+		var userID any
+		if user != nil {
+			userID = user.ID
+		}
+		if err != nil {
+			// The error may carry SMTP or database details
+			loggingService.Log(userID, request.path, nil, map[string]any{"message": "Could not send password reset"}, "PASSWORD_RESET_FAILED")
+			continue
+		}
+		if user != nil {
+			loggingService.Log(user.ID, request.path, nil, map[string]any{"message": "Password reset requested", "user": user.Email}, "PASSWORD_RESET_REQUESTED")
+		}
+	}
+}
+
+// RequestPasswordReset emails a reset token to the user with the email, if
+// there is an active one with a local password. It returns the user the token
+// was sent to, or nil when nobody was found, so the caller can answer the
+// same either way; on an error the user is returned when already known.
+// Tokens sent before are invalidated.
+func RequestPasswordReset(email string) (*User, error) {
+	user, err := GetUserByEmail(email)
+	if err != nil || !user.IsActive {
+		return nil, nil
+	}
+	local, err := hasLocalPassword(user)
+	if err != nil {
+		return user, err
+	}
+	if !local {
+		return nil, nil
+	}
+
+	token, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return user, err
+	}
+	ttl := PasswordResetTTL()
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return user, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM password_resets
+		WHERE user_id = $1 OR expires_at < now()
+	`, user.ID)
+	if err != nil {
+		return user, fmt.Errorf("error purging reset tokens: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO password_resets (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, user.ID, time.Now().Add(ttl))
+	if err != nil {
+		return user, fmt.Errorf("error storing reset token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return user, fmt.Errorf("error storing reset token: %w", err)
+	}
+
+	if err := libs.GetMailer().Send(passwordResetMail(user, token, ttl)); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+// passwordResetMail builds the reset email. PASSWORD_RESET_URL is the page
+// where the user picks the new password; the token is added as a query
+// parameter. Without it the email carries the bare token.
+func passwordResetMail(user *User, token string, ttl time.Duration) libs.MailMessage {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hola %s,\n\n", user.Names)
+	body.WriteString("Recibimos una solicitud para restablecer su contraseña.\n\n")
+	if resetURL := os.Getenv("PASSWORD_RESET_URL"); resetURL != "" {
+		separator := "?"
+		if strings.Contains(resetURL, "?") {
+			separator = "&"
+		}
+		fmt.Fprintf(&body, "Abra el siguiente enlace para elegir una nueva contraseña:\n\n%s%stoken=%s\n\n", resetURL, separator, url.QueryEscape(token))
+	} else {
+		fmt.Fprintf(&body, "Use el siguiente código para elegir una nueva contraseña:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "El enlace caduca en %d minutos y solo se puede usar una vez. Si no solicitó el cambio, ignore este mensaje.\n", int(ttl.Minutes()))
+
+	return libs.MailMessage{
+		To:      user.Email,
+		Subject: "Restablecer contraseña",
+		Body:    body.String(),
+	}
+}
+
+// ResetPassword sets a new password with a reset token. The token is only
+// consumed once the new password passes the policy, so the user can retry.
+// Users without a local password get ErrPasswordNotLocal. The reset also
+// lifts a lockout and revokes every token issued so far.
+func ResetPassword(token string, password string) (*User, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	hash := libs.HashOpaqueToken(token)
+
+	var userID string
+	err := sqlxdb.Get(&userID, `
+		SELECT user_id FROM password_resets
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+	`, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading reset token: %w", err)
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, ErrInvalidResetToken
+	}
+	if !user.IsActive {
+		return nil, ErrUserInactive
+	}
+	local, err := hasLocalPassword(user)
+	if err != nil {
+		return nil, err
+	}
+	if !local {
+		return nil, ErrPasswordNotLocal
+	}
+	if err := LoadPasswordPolicyFromEnv().Validate(password, user); err != nil {
+		return nil, err
+	}
+
+	// Consuming the token is a single statement so it is used only once
+	result, err := sqlxdb.Exec(`
+		UPDATE password_resets
+		SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+	`, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming reset token: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrInvalidResetToken
+	}
+
+	if err := SetPassword(user.ID, password); err != nil {
+		return nil, err
+	}
+	if err := UnlockUser(user.ID); err != nil {
+		return nil, err
+	}
+	if err := RevokeUserTokens(user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrWeakPassword is returned when a new password does not meet the
+	// policy.
+	ErrWeakPassword = errors.New("password does not meet the policy")
+	// ErrPasswordNotLocal is returned when changing the password of a user
+	// whose password is kept by a directory or an identity provider.
+	ErrPasswordNotLocal = errors.New("password is managed by an external directory")
+)
+
+// maxPasswordBytes is the longest password bcrypt can hash.
+const maxPasswordBytes = 72
+
+// PasswordPolicy holds the rules new passwords must follow.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols
+	// must appear.
+	MinClasses int
+}
+
+// LoadPasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH (default 10) and
+// PASSWORD_MIN_CLASSES (default 3).
+func LoadPasswordPolicyFromEnv() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:  libs.IntFromEnv("PASSWORD_MIN_LENGTH", 10),
+		MinClasses: libs.IntFromEnv("PASSWORD_MIN_CLASSES", 3),
+	}
+}
+
+// Validate checks a new password for the user. The error wraps
+// ErrWeakPassword and tells which rule failed.
+func (p PasswordPolicy) Validate(password string, user *User) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("%w: it must have at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: it must have at most %d bytes", ErrWeakPassword, maxPasswordBytes)
+	}
+	if passwordClasses(password) < p.MinClasses {
+		return fmt.Errorf("%w: it must mix at least %d of lowercase, uppercase, digits and symbols", ErrWeakPassword, p.MinClasses)
+	}
+
+	if user != nil {
+		lower := strings.ToLower(password)
+		local, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+		for _, personal := range []string{local, strings.ToLower(user.Username)} {
+			if len(personal) >= 3 && strings.Contains(lower, personal) {
+				return fmt.Errorf("%w: it must not contain the username or email", ErrWeakPassword)
+			}
+		}
+		if user.Password != nil && bcrypt.CompareHashAndPassword([]byte(*user.Password), []byte(password)) == nil {
+			return fmt.Errorf("%w: it must differ from the current password", ErrWeakPassword)
+		}
+	}
+	return nil
+}
+
+// passwordClasses counts the character classes used in the password.
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// ChangePassword replaces the password of the user after checking the
+// current one, as a login does. A wrong current password counts as a failed
+// login, so the endpoint cannot be used to guess it. Only local passwords can
+// be changed (ErrPasswordNotLocal otherwise). On success the usage counter is
+// reset and every token issued so far is revoked.
+func ChangePassword(userID string, current string, password string) (*User, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	local, err := hasLocalPassword(user)
+	if err != nil {
+		return nil, err
+	}
+	if !local {
+		return nil, ErrPasswordNotLocal
+	}
+	if _, _, err := checkPassword(user, current); err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrUserInactive
+	}
+
+	if err := LoadPasswordPolicyFromEnv().Validate(password, user); err != nil {
+		return nil, err
+	}
+	if err := SetPassword(user.ID, password); err != nil {
+		return nil, err
+	}
+	if err := RevokeUserTokens(user.ID); err != nil {
+		return nil, err
+	}
+
+	logins := 0
+	user.Logins = &logins
+	return user, nil
+}
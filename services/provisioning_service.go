@@ -0,0 +1,269 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrProvisioningRuleNotFound is returned for unknown rule ids.
+	ErrProvisioningRuleNotFound = errors.New("provisioning rule not found")
+	// ErrInvalidProvisioningRuleData wraps validation errors of the
+	// provisioning rule admin API.
+	ErrInvalidProvisioningRuleData = errors.New("invalid provisioning rule data")
+)
+
+// UsernameTakenError is returned when the username a provisioned user would
+// get, the local part of the email, already belongs to another user, e.g.
+// ana@a.com and ana@b.com. An admin has to create or link the account.
+type UsernameTakenError struct {
+	Username string
+}
+
+func (e *UsernameTakenError) Error() string {
+	return "username " + e.Username + " is already taken"
+}
+
+// ProvisioningRule represents the structure of the provisioning_rules table.
+// A rule lets the users it matches be created on their first login, with
+// its roles.
+type ProvisioningRule struct {
+	ID string `db:"rule_id" json:"rule_id"`
+	// Source is LDAPBackend or an identity provider id; empty matches both.
+	Source string `db:"source" json:"source"`
+	// Domain is an email domain; empty matches any.
+	Domain string `db:"domain" json:"domain"`
+	// UpstreamGroup is a directory group DN or a value of the groups claim;
+	// empty matches any.
+	UpstreamGroup string         `db:"upstream_group" json:"upstream_group"`
+	Roles         pq.StringArray `db:"roles" json:"roles" swaggertype:"array,string"`
+	CreatedAt     time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// ProvisioningRuleInput holds the fields of a rule that the admin API can
+// set.
+type ProvisioningRuleInput struct {
+	Source        string   `json:"source"`
+	Domain        string   `json:"domain"`
+	UpstreamGroup string   `json:"upstream_group"`
+	Roles         []string `json:"roles"`
+}
+
+// provisioningRuleColumns is the column list shared by the rule lookups
+const provisioningRuleColumns = `
+			rule_id,
+			source,
+			domain,
+			upstream_group,
+			roles,
+			created_at,
+			updated_at`
+
+// ListProvisioningRules returns every rule ordered by id.
+func ListProvisioningRules() ([]ProvisioningRule, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	rules := []ProvisioningRule{}
+	err := sqlxdb.Select(&rules, `
+		SELECT `+provisioningRuleColumns+`
+		FROM provisioning_rules
+		ORDER BY rule_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing provisioning rules: %w", err)
+	}
+	return rules, nil
+}
+
+// SaveProvisioningRule creates or replaces a rule. Its roles must exist in
+// rols.
+func SaveProvisioningRule(ruleID string, input ProvisioningRuleInput) (*ProvisioningRule, error) {
+	if strings.TrimSpace(ruleID) == "" {
+		return nil, fmt.Errorf("%w: rule id is required", ErrInvalidProvisioningRuleData)
+	}
+	input.Domain = strings.ToLower(strings.TrimSpace(input.Domain))
+	if strings.Contains(input.Domain, "@") {
+		return nil, fmt.Errorf("%w: domain must not contain @", ErrInvalidProvisioningRuleData)
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	if input.Source != "" && input.Source != LDAPBackend {
+		if _, err := GetIdentityProvider(input.Source); err != nil {
+			if errors.Is(err, ErrIdentityProviderNotFound) {
+				return nil, fmt.Errorf("%w: source must be empty, ldap or an identity provider id", ErrInvalidProvisioningRuleData)
+			}
+			return nil, err
+		}
+	}
+	var known []string
+	if err := sqlxdb.Select(&known, `SELECT code FROM rols WHERE code = ANY($1)`, textArray(input.Roles)); err != nil {
+		return nil, fmt.Errorf("error checking roles: %w", err)
+	}
+	for _, code := range input.Roles {
+		if !slices.Contains(known, code) {
+			return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidProvisioningRuleData, code)
+		}
+	}
+
+	var rule ProvisioningRule
+	err := sqlxdb.Get(&rule, `
+		INSERT INTO provisioning_rules (rule_id, source, domain, upstream_group, roles)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (rule_id) DO UPDATE
+		SET source = EXCLUDED.source, domain = EXCLUDED.domain, upstream_group = EXCLUDED.upstream_group,
+			roles = EXCLUDED.roles, updated_at = now()
+		RETURNING `+provisioningRuleColumns,
+		ruleID, input.Source, input.Domain, strings.TrimSpace(input.UpstreamGroup), textArray(input.Roles))
+	if err != nil {
+		return nil, fmt.Errorf("error saving provisioning rule: %w", err)
+	}
+	return &rule, nil
+}
+
+// DeleteProvisioningRule removes a rule. Users already provisioned keep
+// their roles.
+func DeleteProvisioningRule(ruleID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	result, err := sqlxdb.Exec(`DELETE FROM provisioning_rules WHERE rule_id = $1`, ruleID)
+	if err != nil {
+		return fmt.Errorf("error deleting provisioning rule: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrProvisioningRuleNotFound
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to the identity. Empty fields
+// match anything; the domain is that of the email of the identity and
+// groups compare case-insensitively.
+func (r *ProvisioningRule) Matches(identity *ExternalIdentity) bool {
+	if r.Source != "" && r.Source != identity.Source {
+		return false
+	}
+	if r.Domain != "" && r.Domain != emailDomain(identity.Email) {
+		return false
+	}
+	if r.UpstreamGroup == "" {
+		return true
+	}
+	return slices.ContainsFunc(identity.Groups, func(group string) bool {
+		return strings.EqualFold(group, r.UpstreamGroup)
+	})
+}
+
+// ProvisionUser creates the local user of an identity that signs in for the
+// first time, with the roles of every matching rule, and links the identity
+// to it. Without a matching rule it returns ErrNoLocalAccount, and
+// UsernameTakenError when another user has its username.
+func ProvisionUser(identity *ExternalIdentity) (*User, error) {
+	rules, err := ListProvisioningRules()
+	if err != nil {
+		return nil, err
+	}
+	matched := false
+	roles := []string{}
+	for _, rule := range rules {
+		if rule.Matches(identity) {
+			matched = true
+			roles = append(roles, rule.Roles...)
+		}
+	}
+	if !matched {
+		return nil, ErrNoLocalAccount
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+	username, _, _ := strings.Cut(identity.Email, "@")
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.Get(&taken, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))`, username); err != nil {
+		return nil, fmt.Errorf("error checking username: %w", err)
+	}
+	if taken {
+		return nil, &UsernameTakenError{Username: username}
+	}
+
+	var userID string
+	err = tx.Get(&userID, `
+		INSERT INTO users (username, names, email, is_staff, is_active, created_at, updated_at)
+		VALUES ($1, $2, $3, false, true, now(), now())
+		RETURNING id::text
+	`, username, name, identity.Email)
+	if err != nil {
+		return nil, fmt.Errorf("error creating user: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_roles (user_id, rol_id)
+		SELECT u.id, r.id
+		FROM users u
+		CROSS JOIN rols r
+		WHERE u.id::text = $1 AND r.code = ANY ($2)
+	`, userID, textArray(roles)); err != nil {
+		return nil, fmt.Errorf("error assigning roles: %w", err)
+	}
+	if err := linkIdentity(tx, userID, identity); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error creating user: %w", err)
+	}
+
+	NewLoggingService().Log(userID, "", nil, map[string]any{"message": "User provisioned", "source": identity.Source, "roles": roles}, "USER_PROVISIONED")
+	return GetUserByID(userID)
+}
+
+// provisionDirectoryUser signs in an email of LDAP_DOMAINS that has no local
+// user yet: the directory checks the password and ProvisionUser creates the
+// user. It returns ErrInvalidCredentials when the directory or the rules do
+// not accept the user, or when the mail of the entry is another email, so
+// no account is created under an address the user did not sign in with.
+func provisionDirectoryUser(email string, password string) (*User, error) {
+	config := libs.GetLDAPConfig()
+	if !config.Enabled() || !config.HandlesEmail(email) {
+		return nil, ErrInvalidCredentials
+	}
+
+	username, _, _ := strings.Cut(email, "@")
+	identity, err := LDAPAuthenticator{Config: config}.Authenticate(&User{Username: username, Email: email}, password)
+	if errors.Is(err, ErrNoCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(identity.Email, email) {
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := ProvisionUser(identity)
+	if errors.Is(err, ErrNoLocalAccount) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := SyncDirectoryRoles(user.ID, identity.Groups); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for unknown or expired refresh tokens.
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is
+	// presented again; the whole token family is revoked when it happens.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken represents a row of the refresh_tokens table.
+type RefreshToken struct {
+	FamilyID  string    `db:"family_id"`
+	UserID    string    `db:"user_id"`
+	Audience  string    `db:"audience"`
+	Scope     string    `db:"scope"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// AllowsScope reports whether the space separated requested scopes are
+// within the scope of the token. An empty request keeps the whole scope.
+func (r *RefreshToken) AllowsScope(requested string) bool {
+	granted := strings.Fields(r.Scope)
+	for _, scope := range strings.Fields(requested) {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateRefreshToken stores a refresh token starting a new family (a new
+// login) and returns the opaque value. An empty audience means the default
+// audiences; scope is the scope granted to the client.
+func CreateRefreshToken(userID string, audience string, scope string, ttl time.Duration) (string, *RefreshToken, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	return insertRefreshToken(sqlxdb, RefreshToken{UserID: userID, Audience: audience, Scope: scope}, ttl)
+}
+
+func insertRefreshToken(db sqlx.Execer, refreshToken RefreshToken, ttl time.Duration) (string, *RefreshToken, error) {
+	token, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	if refreshToken.FamilyID == "" {
+		refreshToken.FamilyID = hash
+	}
+
+	refreshToken.ExpiresAt = time.Now().Add(ttl)
+	_, err = db.Exec(`
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, audience, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hash, refreshToken.FamilyID, refreshToken.UserID, refreshToken.Audience, refreshToken.Scope, refreshToken.ExpiresAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("error storing refresh token: %w", err)
+	}
+	return token, &refreshToken, nil
+}
+
+// GetRefreshToken looks up a live refresh token without consuming it.
+func GetRefreshToken(token string) (*RefreshToken, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var refreshToken RefreshToken
+	err := sqlxdb.Get(&refreshToken, `
+		SELECT family_id, user_id, audience, scope, expires_at
+		FROM refresh_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > now()
+	`, libs.HashOpaqueToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching refresh token: %w", err)
+	}
+	return &refreshToken, nil
+}
+
+// RotateRefreshToken consumes a refresh token and issues its successor in the
+// same family, returning the new opaque value and its row. A non-empty
+// audience only accepts tokens issued for that audience (client).
+func RotateRefreshToken(token string, audience string, ttl time.Duration) (string, *RefreshToken, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	hash := libs.HashOpaqueToken(token)
+
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return "", nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current RefreshToken
+	err = tx.Get(&current, `
+		UPDATE refresh_tokens
+		SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > now()
+			AND ($2 = '' OR audience = $2)
+		RETURNING family_id, user_id, audience, scope, expires_at
+	`, hash, audience)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, handleStaleRefreshToken(sqlxdb, hash)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error consuming refresh token: %w", err)
+	}
+
+	newToken, next, err := insertRefreshToken(tx, current, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("error committing refresh token: %w", err)
+	}
+	return newToken, next, nil
+}
+
+// handleStaleRefreshToken revokes the family of a token that was already used
+// or revoked, since presenting it again means it leaked.
+func handleStaleRefreshToken(db *sqlx.DB, hash string) error {
+	var stale struct {
+		FamilyID  string     `db:"family_id"`
+		UsedAt    *time.Time `db:"used_at"`
+		RevokedAt *time.Time `db:"revoked_at"`
+	}
+	err := db.Get(&stale, `
+		SELECT family_id, used_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up refresh token: %w", err)
+	}
+	if stale.UsedAt == nil && stale.RevokedAt == nil {
+		// Simply expired, or issued for another audience
+		return ErrRefreshTokenInvalid
+	}
+
+	if err := RevokeRefreshTokenFamily(stale.FamilyID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// RevokeRefreshTokenFamily revokes every token rotated from the same login.
+func RevokeRefreshTokenFamily(familyID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err := sqlxdb.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = now()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`, familyID)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user.
+func RevokeUserRefreshTokens(userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err := sqlxdb.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = now()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshToken revokes the family of the user's refresh token, ending
+// the login it belongs to.
+func RevokeRefreshToken(token string, userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var familyID string
+	err := sqlxdb.Get(&familyID, `
+		SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2
+	`, libs.HashOpaqueToken(token), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up refresh token: %w", err)
+	}
+	return RevokeRefreshTokenFamily(familyID)
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"fmt"
+	"global-auth-server/libs"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// RevokeToken adds a single access token to the denylist until it expires.
+func RevokeToken(jti string, userID string, expiresAt time.Time) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err := sqlxdb.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		VALUES ($1, NULLIF($2, ''), $3)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, userID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error revoking token: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes every access and refresh token issued to the user
+// so far. The entry is kept for as long as a signing key stays published,
+// after which no older token can be verified anyway.
+//
+// Access tokens carry iat in milliseconds. A token issued in the millisecond
+// of the revocation counts as revoked, so the call returns only once that
+// millisecond has passed; a token issued afterwards (a new login, or the
+// session that changed the password) is never born revoked.
+func RevokeUserTokens(userID string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	now := time.Now().Truncate(time.Millisecond)
+	expiresAt := now.Add(libs.LoadKeyRingConfigFromEnv().Retention)
+	_, err := sqlxdb.Exec(`
+		INSERT INTO user_revocations (user_id, revoked_before, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET revoked_before = EXCLUDED.revoked_before, expires_at = EXCLUDED.expires_at
+	`, userID, now, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error revoking user tokens: %w", err)
+	}
+	time.Sleep(time.Until(now.Add(time.Millisecond)))
+	return RevokeUserRefreshTokens(userID)
+}
+
+// IsTokenRevoked reports whether the token was revoked by jti or through a
+// revocation of all the user's tokens, which covers every token issued at or
+// before revoked_before.
+func IsTokenRevoked(jti string, userID string, issuedAt time.Time) (bool, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var state struct {
+		Denied        bool       `db:"denied"`
+		RevokedBefore *time.Time `db:"revoked_before"`
+	}
+	err := sqlxdb.Get(&state, `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1) AS denied,
+			(SELECT revoked_before FROM user_revocations WHERE user_id = $2) AS revoked_before
+	`, jti, userID)
+	if err != nil {
+		return false, fmt.Errorf("error checking token revocation: %w", err)
+	}
+	if state.Denied {
+		return true, nil
+	}
+	return state.RevokedBefore != nil && !issuedAt.After(*state.RevokedBefore), nil
+}
+
+// IsClaimsRevoked applies IsTokenRevoked to the claims of a verified token.
+// Tokens without iat are treated as issued at the epoch, so revoking a user
+// also revokes them.
+func IsClaimsRevoked(claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+	userID, _ := claims["user_id"].(string)
+	issuedAt := libs.IssuedAt(claims)
+	revoked, err := IsTokenRevoked(jti, userID, issuedAt)
+	if revoked || err != nil {
+		return revoked, err
+	}
+
+	// Impersonation tokens also die with the tokens of the staff member
+	if act, ok := claims["act"].(map[string]any); ok {
+		actorID, _ := act["sub"].(string)
+		return IsTokenRevoked(jti, actorID, issuedAt)
+	}
+	return false, nil
+}
+
+// PurgeExpiredRevocations deletes denylist entries whose tokens have expired.
+func PurgeExpiredRevocations() (int64, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	var purged int64
+	for _, table := range []string{"revoked_tokens", "user_revocations"} {
+		result, err := sqlxdb.Exec(`DELETE FROM ` + table + ` WHERE expires_at < now()`)
+		if err != nil {
+			return purged, fmt.Errorf("error purging %s: %w", table, err)
+		}
+		rows, _ := result.RowsAffected()
+		purged += rows
+	}
+	return purged, nil
+}
+
+// StartRevocationPurge purges expired denylist entries every interval.
+func StartRevocationPurge(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := PurgeExpiredRevocations(); err != nil {
+				fmt.Println("Error purging revoked tokens:", err)
+			}
+		}
+	}()
+}
@@ -1,12 +1,32 @@
 package services
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"global-auth-server/libs"
 
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	// ErrInvalidCredentials is returned when the email or password is wrong.
+	ErrInvalidCredentials = errors.New("invalid user or password")
+	// ErrUserInactive is returned for valid credentials of an inactive user.
+	ErrUserInactive = errors.New("user is inactive")
+	// ErrPasswordExpired is returned once the password has been used for
+	// MaxPasswordLogins logins. No token is issued, so the user changes it
+	// through the password reset flow (see ResetPassword).
+	ErrPasswordExpired = errors.New("password usage limit reached")
+)
+
+// MaxPasswordLogins is the number of logins allowed with the same password,
+// read from PASSWORD_MAX_LOGINS (default 30). Zero or less disables the limit.
+func MaxPasswordLogins() int {
+	return libs.IntFromEnv("PASSWORD_MAX_LOGINS", 30)
+}
+
 // User represents the structure of the users table
 type User struct {
 	ID              string  `db:"id" json:"id"`
@@ -33,14 +53,8 @@ type Role struct {
 	Description string `db:"description" json:"description"`
 }
 
-// Getuserbyemail looks for a user by email using SQLX and the Singleton connection
-func GetUserByEmail(email string) (*User, error) {
-	db := libs.GetDB()
-	sqlxdb := sqlx.NewDb(db, "postgres")
-
-	var user User
-	err := sqlxdb.Get(&user, `
-		SELECT 
+// userColumns is the column list shared by the user lookups
+const userColumns = `
 			id::text,
 			username, 
 			code, 
@@ -57,7 +71,16 @@ func GetUserByEmail(email string) (*User, error) {
 			logins, 
 			can_download_xlsx, 
 			bank_id::text, 
-			filial_id::text
+			filial_id::text`
+
+// Getuserbyemail looks for a user by email using SQLX and the Singleton connection
+func GetUserByEmail(email string) (*User, error) {
+	db := libs.GetDB()
+	sqlxdb := sqlx.NewDb(db, "postgres")
+
+	var user User
+	err := sqlxdb.Get(&user, `
+		SELECT `+userColumns+`
 		FROM users 
 		WHERE email = $1
 	`, email)
@@ -67,6 +90,23 @@ func GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetUserByID looks for a user by its id
+func GetUserByID(id string) (*User, error) {
+	db := libs.GetDB()
+	sqlxdb := sqlx.NewDb(db, "postgres")
+
+	var user User
+	err := sqlxdb.Get(&user, `
+		SELECT `+userColumns+`
+		FROM users 
+		WHERE id::text = $1
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+	return &user, nil
+}
+
 func GetRolesByUserID(userID string) ([]Role, error) {
 	db := libs.GetDB()
 	sqlxdb := sqlx.NewDb(db, "postgres")
@@ -83,3 +123,183 @@ func GetRolesByUserID(userID string) ([]Role, error) {
 	}
 	return roles, nil
 }
+
+// AuthenticateUser checks the email and the plain text password with the
+// authenticators of the user (see Authenticators). Failures are counted per
+// user and a locked account is rejected with an *AccountLockedError before
+// the password is checked. A successful login must come from an active user;
+// ErrUserInactive is only returned after a correct password, so it tells
+// nothing to someone who does not already hold the credentials. A local
+// password that reached its usage limit is refused, though the login is only
+// counted once it completes (see CountPasswordLogin). A login with LDAP
+// syncs the roles mapped to directory groups and links the entry. An email
+// of LDAP_DOMAINS without a user is provisioned (see ProvisionUser).
+func AuthenticateUser(email string, password string) (*User, error) {
+	user, err := GetUserByEmail(email)
+	if err != nil {
+		provider, err := FindIdentityProviderForEmail(email)
+		if err != nil {
+			return nil, err
+		}
+		if provider != nil {
+			return nil, &FederatedLoginError{ProviderID: provider.ID}
+		}
+		return provisionDirectoryUser(email, password)
+	}
+
+	authenticator, identity, err := checkPassword(user, password)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrUserInactive
+	}
+	if identity != nil {
+		if err := linkIdentity(sqlx.NewDb(libs.GetDB(), "postgres"), user.ID, identity); err != nil {
+			return nil, err
+		}
+		if err := SyncDirectoryRoles(user.ID, identity.Groups); err != nil {
+			return nil, err
+		}
+	}
+	if authenticator.Name() != LocalBackend {
+		// The directory manages its own password policy
+		return user, nil
+	}
+	if limit := MaxPasswordLogins(); limit > 0 && user.Logins != nil && *user.Logins >= limit {
+		return nil, ErrPasswordExpired
+	}
+	return user, nil
+}
+
+// CountPasswordLogin counts a login that started with the password of the
+// user against MaxPasswordLogins. It is called once the tokens or the
+// authorization code are issued, after the second factor, so failed and
+// abandoned logins do not use up the password. Only the local password is
+// counted; ErrPasswordExpired is returned when the limit was reached.
+func CountPasswordLogin(user *User) error {
+	local, err := hasLocalPassword(user)
+	if err != nil || !local {
+		return err
+	}
+	logins, err := incrementLogins(user.ID)
+	if err != nil {
+		return err
+	}
+	user.Logins = &logins
+	return nil
+}
+
+// checkPassword verifies the password of an existing user with its
+// authenticators. A locked account is rejected before the password is
+// checked, a wrong password counts as a failed login and a right one clears
+// the failures.
+func checkPassword(user *User, password string) (Authenticator, *ExternalIdentity, error) {
+	lockedUntil, err := GetLockedUntil(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lockedUntil != nil {
+		return nil, nil, &AccountLockedError{UserID: user.ID, Until: *lockedUntil}
+	}
+
+	authenticator, identity, err := verifyPassword(user, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		lockedUntil, err := RecordLoginFailure(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if lockedUntil != nil {
+			return nil, nil, &AccountLockedError{UserID: user.ID, Until: *lockedUntil, JustLocked: true}
+		}
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ResetLoginFailures(user.ID); err != nil {
+		return nil, nil, err
+	}
+	return authenticator, identity, nil
+}
+
+// GetLoginUser returns the user a login finishes for without the password
+// step (a second factor or a passkey), refusing inactive and locked
+// accounts as AuthenticateUser does.
+func GetLoginUser(userID string) (*User, error) {
+	user, err := GetUserByID(userID)
+	if err != nil || !user.IsActive {
+		return nil, ErrUserInactive
+	}
+	lockedUntil, err := GetLockedUntil(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil != nil {
+		return nil, &AccountLockedError{UserID: user.ID, Until: *lockedUntil}
+	}
+	return user, nil
+}
+
+// incrementLogins counts a login with the current password. The check and
+// the increment are one statement so concurrent logins cannot overshoot the
+// limit.
+func incrementLogins(userID string) (int, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var logins int
+	err := sqlxdb.Get(&logins, `
+		UPDATE users
+		SET logins = COALESCE(logins, 0) + 1
+		WHERE id::text = $1 AND ($2 <= 0 OR COALESCE(logins, 0) < $2)
+		RETURNING logins
+	`, userID, MaxPasswordLogins())
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrPasswordExpired
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error counting login: %w", err)
+	}
+	return logins, nil
+}
+
+// SetPassword stores the bcrypt hash of a new password and resets the usage
+// counter of the password. Reset tokens not used yet are dropped, so a token
+// requested before the change cannot override it.
+func SetPassword(userID string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	tx, err := sqlxdb.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET password = $2, logins = 0, updated_at = now()
+		WHERE id::text = $1
+	`, userID, string(hash))
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	_, err = tx.Exec(`
+		DELETE FROM password_resets
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("error purging reset tokens: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"global-auth-server/libs"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jmoiron/sqlx"
+)
+
+// webAuthnSessionTTL is how long a ceremony can take.
+const webAuthnSessionTTL = 5 * time.Minute
+
+var (
+	// ErrWebAuthnSession is returned for an unknown, used or expired
+	// ceremony.
+	ErrWebAuthnSession = errors.New("invalid or expired WebAuthn session")
+	// ErrWebAuthnVerification is returned when the browser response does not
+	// verify.
+	ErrWebAuthnVerification = errors.New("WebAuthn verification failed")
+	// ErrNoWebAuthnCredentials is returned for a user without passkeys.
+	ErrNoWebAuthnCredentials = errors.New("no WebAuthn credentials")
+	// ErrWebAuthnCredentialNotFound is returned for a credential the user
+	// does not own.
+	ErrWebAuthnCredentialNotFound = errors.New("WebAuthn credential not found")
+)
+
+// WebAuthnCredential represents a row of the webauthn_credentials table.
+type WebAuthnCredential struct {
+	ID         string     `db:"id" json:"id"`
+	UserID     string     `db:"user_id" json:"-"`
+	Name       string     `db:"name" json:"name"`
+	Data       []byte     `db:"credential" json:"-"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at,omitempty"`
+}
+
+// webAuthnSession represents a row of the webauthn_sessions table.
+type webAuthnSession struct {
+	Purpose  string `db:"purpose"`
+	UserID   string `db:"user_id"`
+	Audience string `db:"audience"`
+	Data     []byte `db:"data"`
+}
+
+// webAuthnUser adapts a user and its credentials to the WebAuthn library.
+// The user handle is the user id.
+type webAuthnUser struct {
+	user        *User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return []byte(u.user.ID) }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.user.Email }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.user.Names }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// loadWebAuthnUser reads the credentials of the user.
+func loadWebAuthnUser(user *User) (*webAuthnUser, error) {
+	rows, err := ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]webauthn.Credential, 0, len(rows))
+	for _, row := range rows {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(row.Data, &credential); err != nil {
+			return nil, fmt.Errorf("error decoding WebAuthn credential: %w", err)
+		}
+		credentials = append(credentials, credential)
+	}
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// ListWebAuthnCredentials returns the credentials of the user.
+func ListWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	credentials := []WebAuthnCredential{}
+	err := sqlxdb.Select(&credentials, `
+		SELECT id, user_id, name, credential, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing WebAuthn credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential removes a credential of the user.
+func DeleteWebAuthnCredential(userID string, id string) error {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	result, err := sqlxdb.Exec(`
+		DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting WebAuthn credential: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+// BeginWebAuthnRegistration starts registering a passkey for the user and
+// returns the options for navigator.credentials.create and the session id.
+func BeginWebAuthnRegistration(user *User) (*protocol.CredentialCreation, string, error) {
+	relyingParty, err := libs.GetWebAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+	waUser, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Authenticators already registered are not offered again
+	exclusions := webauthn.Credentials(waUser.credentials).CredentialDescriptors()
+	creation, session, err := relyingParty.BeginRegistration(waUser, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, "", fmt.Errorf("error starting WebAuthn registration: %w", err)
+	}
+	sessionID, err := storeWebAuthnSession("registration", user.ID, "", session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, sessionID, nil
+}
+
+// FinishWebAuthnRegistration verifies the response of
+// navigator.credentials.create and stores the new credential.
+func FinishWebAuthnRegistration(user *User, sessionID string, name string, response []byte) (*WebAuthnCredential, error) {
+	relyingParty, err := libs.GetWebAuthn()
+	if err != nil {
+		return nil, err
+	}
+	session, data, err := takeWebAuthnSession(sessionID, "registration")
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID {
+		return nil, ErrWebAuthnSession
+	}
+	waUser, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+	credential, err := relyingParty.CreateCredential(waUser, *data, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding WebAuthn credential: %w", err)
+	}
+	stored := WebAuthnCredential{
+		ID:     base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserID: user.ID,
+		Name:   name,
+	}
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	err = sqlxdb.Get(&stored.CreatedAt, `
+		INSERT INTO webauthn_credentials (id, user_id, name, credential)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`, stored.ID, stored.UserID, stored.Name, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error storing WebAuthn credential: %w", err)
+	}
+	return &stored, nil
+}
+
+// BeginWebAuthnLogin starts a login with a passkey and returns the options
+// for navigator.credentials.get and the session id. Without a user id any
+// passkey of the server can be used (passwordless login); with one, only the
+// passkeys of that user (second factor).
+func BeginWebAuthnLogin(userID string, audience string) (*protocol.CredentialAssertion, string, error) {
+	relyingParty, err := libs.GetWebAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if userID == "" {
+		assertion, session, err = relyingParty.BeginDiscoverableLogin()
+	} else {
+		user, lookupErr := GetUserByID(userID)
+		if lookupErr != nil {
+			return nil, "", ErrNoWebAuthnCredentials
+		}
+		waUser, loadErr := loadWebAuthnUser(user)
+		if loadErr != nil {
+			return nil, "", loadErr
+		}
+		if len(waUser.credentials) == 0 {
+			return nil, "", ErrNoWebAuthnCredentials
+		}
+		assertion, session, err = relyingParty.BeginLogin(waUser)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error starting WebAuthn login: %w", err)
+	}
+
+	sessionID, err := storeWebAuthnSession("login", userID, audience, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, sessionID, nil
+}
+
+// FinishWebAuthnLogin verifies the response of navigator.credentials.get
+// and returns the user and the audience the login was started for. The user
+// id must be the one given to BeginWebAuthnLogin. The signature counter of
+// the credential is updated, and a counter going backwards, the sign of a
+// cloned authenticator, fails the login.
+func FinishWebAuthnLogin(sessionID string, userID string, response []byte) (*User, string, error) {
+	relyingParty, err := libs.GetWebAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+	session, data, err := takeWebAuthnSession(sessionID, "login")
+	if err != nil {
+		return nil, "", err
+	}
+	if session.UserID != userID {
+		return nil, "", ErrWebAuthnSession
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+
+	var waUser *webAuthnUser
+	var credential *webauthn.Credential
+	if userID == "" {
+		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+			user, err := GetUserByID(string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+			waUser, err = loadWebAuthnUser(user)
+			return waUser, err
+		}
+		_, credential, err = relyingParty.ValidatePasskeyLogin(handler, *data, parsed)
+	} else {
+		user, lookupErr := GetUserByID(userID)
+		if lookupErr != nil {
+			return nil, "", ErrWebAuthnVerification
+		}
+		if waUser, err = loadWebAuthnUser(user); err != nil {
+			return nil, "", err
+		}
+		credential, err = relyingParty.ValidateLogin(waUser, *data, parsed)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, "", fmt.Errorf("%w: signature counter went backwards", ErrWebAuthnVerification)
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		return nil, "", fmt.Errorf("error encoding WebAuthn credential: %w", err)
+	}
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	_, err = sqlxdb.Exec(`
+		UPDATE webauthn_credentials
+		SET credential = $3, last_used_at = now()
+		WHERE id = $1 AND user_id = $2
+	`, base64.RawURLEncoding.EncodeToString(credential.ID), waUser.user.ID, encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("error updating WebAuthn credential: %w", err)
+	}
+	return waUser.user, session.Audience, nil
+}
+
+// storeWebAuthnSession keeps the state of a ceremony until its verify step
+// and returns the opaque id the browser sends back.
+func storeWebAuthnSession(purpose string, userID string, audience string, data *webauthn.SessionData) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("error encoding WebAuthn session: %w", err)
+	}
+	sessionID, hash, err := libs.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+	if _, err := sqlxdb.Exec(`DELETE FROM webauthn_sessions WHERE expires_at < now()`); err != nil {
+		return "", fmt.Errorf("error purging WebAuthn sessions: %w", err)
+	}
+	_, err = sqlxdb.Exec(`
+		INSERT INTO webauthn_sessions (session_hash, purpose, user_id, audience, data, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hash, purpose, userID, audience, encoded, time.Now().Add(webAuthnSessionTTL))
+	if err != nil {
+		return "", fmt.Errorf("error storing WebAuthn session: %w", err)
+	}
+	return sessionID, nil
+}
+
+// takeWebAuthnSession consumes a ceremony, so each challenge is verified
+// once.
+func takeWebAuthnSession(sessionID string, purpose string) (*webAuthnSession, *webauthn.SessionData, error) {
+	sqlxdb := sqlx.NewDb(libs.GetDB(), "postgres")
+
+	var session webAuthnSession
+	err := sqlxdb.Get(&session, `
+		DELETE FROM webauthn_sessions
+		WHERE session_hash = $1 AND purpose = $2 AND expires_at > now()
+		RETURNING purpose, user_id, audience, data
+	`, libs.HashOpaqueToken(sessionID), purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrWebAuthnSession
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading WebAuthn session: %w", err)
+	}
+
+	var data webauthn.SessionData
+	if err := json.Unmarshal(session.Data, &data); err != nil {
+		return nil, nil, fmt.Errorf("error decoding WebAuthn session: %w", err)
+	}
+	return &session, &data, nil
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteKeySet_VerifiesTokensFromJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwk, err := libs.NewJWK(key.Public())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(authclient.JWKS{Keys: []authclient.JWK{jwk}})
+	}))
+	defer server.Close()
+
+	keys := authclient.NewRemoteKeySet(server.URL, time.Hour, nil)
+	require.NoError(t, keys.Start())
+	defer keys.Stop()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":     "global-auth-server",
+		"aud":     []string{"reports"},
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"iat":     time.Now().Unix(),
+		"user_id": "42",
+		"roles":   []map[string]string{{"code": "REPORTS_VIEW", "description": "Reports"}},
+	})
+	token.Header["kid"] = jwk.Kid
+	token.Header["typ"] = authclient.AccessTokenType
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	verifier := authclient.NewVerifier(keys, authclient.Config{Issuer: "global-auth-server", Audience: "reports"})
+	claims, err := verifier.Verify(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "42", claims.UserID)
+	assert.True(t, claims.HasRole("REPORTS_VIEW"))
+
+	other := authclient.NewVerifier(keys, authclient.Config{Audience: "portal"})
+	_, err = other.Verify(signed)
+	assert.Error(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/reports", authclient.Middleware(verifier), authclient.RequireRole("REPORTS_VIEW"), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(authclient.UserIDKey))
+	})
+	r.GET("/admin", authclient.Middleware(verifier), authclient.RequireRole("ADMIN"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "42", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
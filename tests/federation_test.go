@@ -0,0 +1,263 @@
+package test
+
+import (
+	"encoding/json"
+	"global-auth-server/controllers"
+	"global-auth-server/libs"
+	"global-auth-server/oidcmock"
+	"global-auth-server/services"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const federationRedirectURI = "https://auth.example.com/oauth/federation/callback"
+
+// authorizeAtMock follows the authorization URL to the mock provider and
+// returns the parameters it redirects back with.
+func authorizeAtMock(t *testing.T, provider *libs.OIDCProvider, clientID string, nonce string, verifier string) url.Values {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(provider.AuthorizationURL(clientID, federationRedirectURI, []string{"openid", "email"}, "state-1", nonce, verifier, "ana@proveedores.com.pa"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return location.Query()
+}
+
+func TestFederation_CodeFlowWithMockProvider(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	idp.SetUser(oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+
+	provider, err := libs.DiscoverOIDCProvider(idp.Issuer())
+	require.NoError(t, err)
+
+	params := authorizeAtMock(t, provider, idp.ClientID, "nonce-1", "verifier-1")
+	assert.Equal(t, "state-1", params.Get("state"))
+	require.NotEmpty(t, params.Get("code"))
+
+	idToken, err := provider.ExchangeCode(idp.ClientID, idp.ClientSecret, params.Get("code"), federationRedirectURI, "verifier-1")
+	require.NoError(t, err)
+
+	claims, err := provider.VerifyIDToken(idToken, idp.ClientID, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, "42", claims["sub"])
+	assert.Equal(t, "ana@proveedores.com.pa", claims["email"])
+
+	// The code is single use
+	_, err = provider.ExchangeCode(idp.ClientID, idp.ClientSecret, params.Get("code"), federationRedirectURI, "verifier-1")
+	assert.Error(t, err)
+}
+
+func TestFederation_RejectsWrongVerifier(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+
+	provider, err := libs.DiscoverOIDCProvider(idp.Issuer())
+	require.NoError(t, err)
+
+	params := authorizeAtMock(t, provider, idp.ClientID, "nonce-1", "verifier-1")
+	_, err = provider.ExchangeCode(idp.ClientID, idp.ClientSecret, params.Get("code"), federationRedirectURI, "another-verifier")
+	assert.Error(t, err)
+}
+
+func TestFederation_VerifyIDTokenChecksNonceAndAudience(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+
+	provider, err := libs.DiscoverOIDCProvider(idp.Issuer())
+	require.NoError(t, err)
+	user := oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"}
+
+	idToken, err := idp.IDToken(user, idp.ClientID, "nonce-1")
+	require.NoError(t, err)
+	_, err = provider.VerifyIDToken(idToken, idp.ClientID, "nonce-1")
+	assert.NoError(t, err)
+	_, err = provider.VerifyIDToken(idToken, idp.ClientID, "nonce-2")
+	assert.ErrorIs(t, err, libs.ErrInvalidIDToken)
+
+	otherAudience, err := idp.IDToken(user, "another-client", "nonce-1")
+	require.NoError(t, err)
+	_, err = provider.VerifyIDToken(otherAudience, idp.ClientID, "nonce-1")
+	assert.ErrorIs(t, err, libs.ErrInvalidIDToken)
+}
+
+func TestFederation_DiscoveryFailsForUnknownIssuer(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+
+	_, err := libs.DiscoverOIDCProvider(idp.URL + "/tenant")
+	assert.Error(t, err)
+}
+
+// signInAtMock signs the user in at the mock provider and returns the state
+// the callback would take along with the code the provider sent back. The
+// provider row is expected from the database.
+func signInAtMock(t *testing.T, mock sqlmock.Sqlmock, idp *oidcmock.Server, user oidcmock.User) (*services.FederationState, string) {
+	idp.SetUser(user)
+	provider, err := libs.DiscoverOIDCProvider(idp.Issuer())
+	require.NoError(t, err)
+	params := authorizeAtMock(t, provider, idp.ClientID, "nonce-1", "verifier-1")
+
+	mock.ExpectQuery(`FROM identity_providers`).WithArgs("proveedores").WillReturnRows(sqlmock.NewRows([]string{
+		"provider_id", "name", "issuer", "client_id", "client_secret", "scopes", "domains", "created_at", "updated_at",
+	}).AddRow("proveedores", "Proveedores", idp.Issuer(), idp.ClientID, idp.ClientSecret, "{openid,email}", "{proveedores.com.pa}", time.Now(), time.Now()))
+
+	state := &services.FederationState{ProviderID: "proveedores", Nonce: "nonce-1", CodeVerifier: "verifier-1", RedirectURI: federationRedirectURI}
+	return state, params.Get("code")
+}
+
+func expectNoLinkedIdentity(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`UPDATE user_identities`).
+		WithArgs("proveedores", "42", "ana@proveedores.com.pa").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+}
+
+func TestCompleteFederatedLogin_LinkedIdentity(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	mock.ExpectQuery(`UPDATE user_identities`).
+		WithArgs("proveedores", "42", "ana@proveedores.com.pa").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("7"))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, false))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+
+	user, mfa, err := services.CompleteFederatedLogin(state, code)
+	require.NoError(t, err)
+	assert.Equal(t, "7", user.ID)
+	assert.False(t, mfa)
+}
+
+func TestCompleteFederatedLogin_HonoursProviderMFA(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa", Claims: map[string]any{"amr": []string{"pwd", "mfa"}}})
+	mock.ExpectQuery(`UPDATE user_identities`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("7"))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, true))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+
+	_, mfa, err := services.CompleteFederatedLogin(state, code)
+	require.NoError(t, err)
+	assert.True(t, mfa)
+}
+
+func TestCompleteFederatedLogin_RefusesLockedAccount(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	mock.ExpectQuery(`UPDATE user_identities`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("7"))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, false))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Hour)))
+
+	_, _, err := services.CompleteFederatedLogin(state, code)
+	var locked *services.AccountLockedError
+	assert.ErrorAs(t, err, &locked)
+}
+
+func TestCompleteFederatedLogin_LinksExistingUserByVerifiedEmail(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	expectNoLinkedIdentity(mock)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@proveedores.com.pa").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, false))
+	mock.ExpectExec(`INSERT INTO user_identities`).
+		WithArgs("proveedores", "42", "7", "ana@proveedores.com.pa").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+
+	user, _, err := services.CompleteFederatedLogin(state, code)
+	require.NoError(t, err)
+	assert.Equal(t, "7", user.ID)
+}
+
+func TestCompleteFederatedLogin_RequiresExplicitlyVerifiedEmail(t *testing.T) {
+	cases := map[string]map[string]any{
+		"missing":  {"email_verified": nil},
+		"false":    {"email_verified": false},
+		"string":   {"email_verified": "yes"},
+		"verified": nil,
+	}
+	for name, claims := range cases {
+		t.Run(name, func(t *testing.T) {
+			idp := oidcmock.NewServer()
+			defer idp.Close()
+			mock := mockDB(t)
+
+			user := oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa", Claims: claims}
+			if name == "verified" {
+				// Verified, but outside the domains of the provider
+				user.Email = "ana@example.com"
+			}
+			state, code := signInAtMock(t, mock, idp, user)
+			mock.ExpectQuery(`UPDATE user_identities`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+			// No account is looked up, let alone linked
+			_, _, err := services.CompleteFederatedLogin(state, code)
+			assert.ErrorIs(t, err, services.ErrFederatedEmailRejected)
+		})
+	}
+}
+
+func TestFederationCallback_AsksForTheSecondFactor(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.GET("/oauth/federation/callback", controllers.FederationCallback)
+
+	request, err := json.Marshal(controllers.AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "portal",
+		RedirectURI:         "https://portal.example.com/callback",
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: "S256",
+	})
+	require.NoError(t, err)
+	mock.ExpectQuery(`DELETE FROM federation_states`).
+		WithArgs(libs.HashOpaqueToken("state-1")).
+		WillReturnRows(sqlmock.NewRows([]string{"provider_id", "nonce", "code_verifier", "redirect_uri", "request"}).
+			AddRow("proveedores", "nonce-1", "verifier-1", federationRedirectURI, request))
+	expectClient(mock, "portal", nil, "{}", "{}")
+	_, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	mock.ExpectQuery(`UPDATE user_identities`).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("7"))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, true))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required", "passkeys"}).AddRow(true, true, false))
+	mock.ExpectExec(`DELETE FROM mfa_challenges`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO mfa_challenges`).WithArgs(sqlmock.AnyArg(), "7", "portal", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/federation/callback?state=state-1&code="+url.QueryEscape(code), nil))
+
+	// No code is issued until the user enters the verification code
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Contains(t, w.Body.String(), `name="mfa_token"`)
+	assert.Contains(t, w.Body.String(), `name="code"`)
+	assert.NotContains(t, w.Body.String(), "usePasskey")
+}
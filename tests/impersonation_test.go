@@ -0,0 +1,21 @@
+package test
+
+import (
+	"global-auth-server/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckImpersonation(t *testing.T) {
+	staff := &services.User{ID: "1", IsStaff: true, IsActive: true}
+	target := &services.User{ID: "2", IsActive: true}
+	allowed := []services.Role{{Code: "IMPERSONATE"}}
+
+	assert.NoError(t, services.CheckImpersonation(staff, allowed, target))
+	assert.ErrorIs(t, services.CheckImpersonation(staff, nil, target), services.ErrImpersonationForbidden)
+	assert.ErrorIs(t, services.CheckImpersonation(&services.User{ID: "3", IsActive: true}, allowed, target), services.ErrImpersonationForbidden)
+	assert.ErrorIs(t, services.CheckImpersonation(staff, allowed, nil), services.ErrImpersonationTarget)
+	assert.ErrorIs(t, services.CheckImpersonation(staff, allowed, &services.User{ID: "4", IsStaff: true, IsActive: true}), services.ErrImpersonationTarget)
+	assert.ErrorIs(t, services.CheckImpersonation(staff, allowed, staff), services.ErrImpersonationTarget)
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"encoding/json"
+	"global-auth-server/controllers"
+	"global-auth-server/libs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestIntrospect_OnlyReturnsRolesAllowedForClient(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/auth/introspect", controllers.Introspect)
+
+	token, exp, err := libs.GenerateJWT(map[string]any{
+		"sub":     "42",
+		"user_id": "42",
+		"email":   "ana@example.com",
+		"roles":   []map[string]string{{"code": "ADMIN"}, {"code": "REPORTS_VIEW"}},
+	}, time.Hour)
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("reports-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	expectClient(mock, "reports", string(hash), "{}", "{REPORTS_VIEW}")
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM revoked_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"denied", "revoked_before"}).AddRow(false, nil))
+	mock.ExpectQuery(`FROM users\s+WHERE id::text = \$1`).
+		WithArgs("42").
+		WillReturnRows(userRows("42", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM user_roles ur`).
+		WithArgs("42").
+		WillReturnRows(sqlmock.NewRows([]string{"code", "description"}).
+			AddRow("ADMIN", "Administrator").
+			AddRow("REPORTS_VIEW", "Reports"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("reports", "reports-secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, true, response["active"])
+	assert.Equal(t, "42", response["sub"])
+	assert.Equal(t, float64(exp), response["exp"])
+	assert.Equal(t, []any{map[string]any{"code": "REPORTS_VIEW", "description": "Reports"}}, response["roles"])
+	assert.NotContains(t, response, "claims")
+	assert.NotContains(t, w.Body.String(), "ADMIN")
+}
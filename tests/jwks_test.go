@@ -0,0 +1,63 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"global-auth-server/libs"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Example key from RFC 7638, section 3.1.
+const rfc7638Modulus = "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"
+
+func TestKeyID_RFC7638(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString(rfc7638Modulus)
+	assert.NoError(t, err)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	kid, err := libs.KeyID(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", kid)
+
+	jwk, err := libs.NewJWK(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "RSA", jwk.Kty)
+	assert.Equal(t, "RS256", jwk.Alg)
+	assert.Equal(t, "sig", jwk.Use)
+	assert.Equal(t, rfc7638Modulus, jwk.N)
+	assert.Equal(t, "AQAB", jwk.E)
+}
+
+func TestNewJWK_RoundTripPerAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cases := map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+	for alg, key := range cases {
+		jwk, err := libs.NewJWK(key.Public())
+		require.NoError(t, err, alg)
+		assert.Equal(t, alg, jwk.Alg)
+
+		pub, err := jwk.PublicKey()
+		require.NoError(t, err, alg)
+		assert.True(t, pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()), alg)
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = libs.NewJWK(p384.Public())
+	assert.Error(t, err)
+}
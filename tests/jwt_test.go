@@ -0,0 +1,115 @@
+package test
+
+import (
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateAndParseJWT(t *testing.T) {
+	token, exp, err := libs.GenerateJWT(map[string]any{"user_id": "42", "email": "user@example.com"}, time.Hour)
+	require.NoError(t, err)
+
+	claims, err := libs.ParseJWT(token)
+	require.NoError(t, err)
+	assert.Equal(t, "42", claims["user_id"])
+	assert.Equal(t, float64(exp), claims["exp"])
+
+	_, err = libs.ParseJWT(token[:len(token)-4] + "AAAA")
+	assert.Error(t, err)
+}
+
+func TestParseJWT_Expired(t *testing.T) {
+	token, _, err := libs.GenerateJWT(map[string]any{"user_id": "42"}, -time.Minute)
+	require.NoError(t, err)
+
+	_, err = libs.ParseJWT(token)
+	assert.Error(t, err)
+}
+
+func TestGenerateJWT_RegisteredClaims(t *testing.T) {
+	config := libs.GetTokenConfig()
+
+	token, _, err := libs.GenerateJWT(map[string]any{"sub": "42", "user_id": "42"}, time.Hour)
+	require.NoError(t, err)
+
+	claims, err := libs.ParseJWT(token)
+	require.NoError(t, err)
+	for _, claim := range []string{"iss", "aud", "sub", "iat", "nbf", "exp", "jti"} {
+		assert.Contains(t, claims, claim)
+	}
+	assert.Equal(t, config.Issuer, claims["iss"])
+
+	audience, err := claims.GetAudience()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, config.Audiences, []string(audience))
+
+	token, _, err = libs.GenerateJWT(map[string]any{"sub": "42", "aud": "portal"}, time.Hour)
+	require.NoError(t, err)
+	claims, err = libs.ParseJWT(token)
+	require.NoError(t, err)
+	assert.Equal(t, "portal", claims["aud"])
+}
+
+func TestVerify_MissingIssuerGraceWindow(t *testing.T) {
+	current, err := libs.GetKeyRing().Current()
+	require.NoError(t, err)
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(current.Method, claims)
+		token.Header["kid"] = current.ID
+		delete(token.Header, "typ")
+		signed, err := token.SignedString(current.Key)
+		require.NoError(t, err)
+		return signed
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	// Issued before iss and the typ header existed
+	legacy := sign(jwt.MapClaims{"user_id": "42", "exp": exp})
+	foreign := sign(jwt.MapClaims{"user_id": "42", "exp": exp, "iss": "someone-else"})
+
+	strict := authclient.NewVerifier(libs.GetKeyRing(), authclient.Config{Issuer: "global-auth-server"})
+	_, err = strict.Verify(legacy)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	grace := authclient.NewVerifier(libs.GetKeyRing(), authclient.Config{
+		Issuer:             "global-auth-server",
+		MissingIssuerUntil: time.Now().Add(time.Hour),
+	})
+	claims, err := grace.Verify(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, "42", claims.UserID)
+	_, err = grace.Verify(foreign)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	expired := authclient.NewVerifier(libs.GetKeyRing(), authclient.Config{
+		Issuer:             "global-auth-server",
+		MissingIssuerUntil: time.Now().Add(-time.Minute),
+	})
+	_, err = expired.Verify(legacy)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+}
+
+func TestParseJWT_RejectsIDTokens(t *testing.T) {
+	idToken, _, err := libs.GenerateIDToken(map[string]any{"sub": "42", "aud": "portal"}, time.Hour)
+	require.NoError(t, err)
+
+	_, err = libs.ParseJWT(idToken)
+	assert.ErrorIs(t, err, authclient.ErrNotAccessToken)
+
+	verifier := libs.NewVerifier(authclient.Config{Audience: "portal"})
+	_, err = verifier.Verify(idToken)
+	assert.ErrorIs(t, err, authclient.ErrNotAccessToken)
+
+	accessToken, _, err := libs.GenerateJWT(map[string]any{"sub": "42", "user_id": "42", "aud": "portal"}, time.Hour)
+	require.NoError(t, err)
+	_, err = verifier.Verify(accessToken)
+	assert.NoError(t, err)
+
+	_, _, err = libs.GenerateIDToken(map[string]any{"sub": "42"}, time.Hour)
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing_RotationKeepsPreviousKey(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	current := first
+	ring := libs.NewKeyRing(libs.KeyRingConfig{Retention: time.Hour}, libs.KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+		return current, nil, nil
+	}))
+
+	signing, err := ring.Current()
+	require.NoError(t, err)
+	assert.Equal(t, keyID(t, first), signing.ID)
+
+	// Rotate the secret: the new key signs, the old one stays published
+	current = second
+	require.NoError(t, ring.Refresh())
+
+	signing, err = ring.Current()
+	require.NoError(t, err)
+	assert.Equal(t, keyID(t, second), signing.ID)
+
+	keys, err := ring.Keys()
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, signing.ID, keys[0].ID)
+
+	_, ok := ring.Key(keyID(t, first))
+	assert.True(t, ok)
+}
+
+func TestKeyRing_DropsKeysPastRetention(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	current := first
+	ring := libs.NewKeyRing(libs.KeyRingConfig{Retention: 0}, libs.KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+		return current, nil, nil
+	}))
+	require.NoError(t, ring.Refresh())
+
+	current = second
+	time.Sleep(time.Millisecond)
+	require.NoError(t, ring.Refresh())
+
+	_, ok := ring.Key(keyID(t, first))
+	assert.False(t, ok)
+}
+
+func TestKeyRing_FailedRefreshKeepsTheRing(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	unsupported, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	var current crypto.Signer = first
+	var previous []crypto.Signer
+	ring := libs.NewKeyRing(libs.KeyRingConfig{Retention: time.Hour}, libs.KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+		return current, previous, nil
+	}))
+	require.NoError(t, ring.Refresh())
+
+	// The new current key is usable but a previous one is not
+	current, previous = second, []crypto.Signer{unsupported}
+	assert.Error(t, ring.Refresh())
+
+	signing, err := ring.Current()
+	require.NoError(t, err)
+	assert.Equal(t, keyID(t, first), signing.ID)
+	_, ok := ring.Key(keyID(t, second))
+	assert.False(t, ok)
+}
+
+func TestKeyRing_StartAndStopRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ring := libs.NewKeyRing(libs.KeyRingConfig{RefreshInterval: time.Millisecond, Retention: time.Hour}, libs.KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+		return key, nil, nil
+	}))
+
+	// Run with -race: starting and stopping from several goroutines is safe
+	done := make(chan struct{})
+	go func() {
+		ring.StartRefresh()
+		close(done)
+	}()
+	ring.StartRefresh()
+	<-done
+	time.Sleep(5 * time.Millisecond)
+	ring.Stop()
+	ring.Stop()
+
+	_, err = ring.Current()
+	assert.NoError(t, err)
+}
+
+func TestKeyRing_SignAndVerifyThroughJWKSPerAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cases := map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+	for alg, key := range cases {
+		ring := libs.NewKeyRing(libs.KeyRingConfig{Retention: time.Hour}, libs.KeyProviderFunc(func() (crypto.Signer, []crypto.Signer, error) {
+			return key, nil, nil
+		}))
+		signing, err := ring.Current()
+		require.NoError(t, err, alg)
+		assert.Equal(t, alg, signing.Method.Alg())
+
+		token := jwt.NewWithClaims(signing.Method, jwt.MapClaims{
+			"iss":     "global-auth-server",
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"iat":     time.Now().Unix(),
+			"user_id": "42",
+		})
+		token.Header["kid"] = signing.ID
+		token.Header["typ"] = authclient.AccessTokenType
+		signed, err := token.SignedString(signing.Key)
+		require.NoError(t, err, alg)
+
+		jwks, err := ring.PublicJWKS()
+		require.NoError(t, err, alg)
+		require.Len(t, jwks.Keys, 1)
+		assert.Equal(t, alg, jwks.Keys[0].Alg)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(jwks)
+		}))
+		keys := authclient.NewRemoteKeySet(server.URL, time.Hour, nil)
+		require.NoError(t, keys.Start(), alg)
+
+		claims, err := authclient.NewVerifier(keys, authclient.Config{Issuer: "global-auth-server"}).Verify(signed)
+		require.NoError(t, err, alg)
+		assert.Equal(t, "42", claims.UserID)
+
+		// A key only verifies its own algorithm
+		others := authclient.NewVerifier(keys, authclient.Config{Algorithms: []string{"HS256"}})
+		_, err = others.Verify(signed)
+		assert.Error(t, err, alg)
+
+		keys.Stop()
+		server.Close()
+	}
+}
+
+func keyID(t *testing.T, key crypto.Signer) string {
+	kid, err := libs.KeyID(key.Public())
+	require.NoError(t, err)
+	return kid
+}
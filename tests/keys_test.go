@@ -0,0 +1,95 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"global-auth-server/libs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrivateKeyPEM_Formats(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	pkcs1PEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	cases := map[string][]byte{
+		"pkcs8":       pkcs8PEM,
+		"pkcs1":       pkcs1PEM,
+		"single line": []byte(strings.ReplaceAll(string(pkcs8PEM), "\n", " ")),
+		"escaped":     []byte(strings.ReplaceAll(string(pkcs1PEM), "\n", `\n`)),
+	}
+	for name, data := range cases {
+		parsed, err := libs.ParsePrivateKeyPEM(data)
+		if assert.NoError(t, err, name) {
+			assert.True(t, key.Equal(parsed), name)
+		}
+	}
+
+	_, err = libs.ParsePrivateKeyPEM([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestParsePrivateKeyPEM_ECAndEd25519(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	parsed, err := libs.ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+	require.NoError(t, err)
+	assert.True(t, ecKey.Equal(parsed))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	parsed, err = libs.ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	require.NoError(t, err)
+	assert.True(t, edKey.Equal(parsed))
+
+	method, err := libs.SigningMethodFor(parsed.Public())
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", method.Alg())
+}
+
+func TestFileKeyProvider_BundledKey(t *testing.T) {
+	provider := &libs.FileKeyProvider{Path: "../certificates/private.pem"}
+
+	current, previous, err := provider.LoadKeys()
+	require.NoError(t, err)
+	assert.NotNil(t, current)
+	assert.Empty(t, previous)
+}
+
+func TestNewKeyProviderFromEnv_Selection(t *testing.T) {
+	t.Setenv("JWT_KEY_PROVIDER", "env")
+	data, err := os.ReadFile("../certificates/private.pem")
+	require.NoError(t, err)
+	t.Setenv("JWT_PRIVATE_KEY", string(data))
+
+	provider, err := libs.NewKeyProviderFromEnv()
+	require.NoError(t, err)
+	_, ok := provider.(*libs.EnvKeyProvider)
+	assert.True(t, ok)
+
+	current, _, err := provider.LoadKeys()
+	require.NoError(t, err)
+	assert.NotNil(t, current)
+
+	t.Setenv("JWT_KEY_PROVIDER", "vault")
+	_, err = libs.NewKeyProviderFromEnv()
+	assert.Error(t, err)
+}
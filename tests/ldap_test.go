@@ -0,0 +1,150 @@
+package test
+
+import (
+	"fmt"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startDirectory runs a local LDAP server with the users alice (password
+// "password") in the admins group and carol (password "password") with a
+// display name, and returns the settings to reach it.
+func startDirectory(t *testing.T) libs.LDAPConfig {
+	groups := testdirectory.NewMemberOf(t, []string{"admins"})
+	users := testdirectory.NewUsers(t, []string{"alice"}, testdirectory.WithMembersOf(t, groups...))
+	users = append(users, gldap.NewEntry("cn=search,ou=people,dc=example,dc=org", map[string][]string{"password": {"secret"}}))
+	users = append(users, gldap.NewEntry("cn=carol,ou=people,dc=example,dc=org", map[string][]string{
+		"cn":          {"carol"},
+		"password":    {"password"},
+		"displayName": {"Carol Díaz"},
+		"mail":        {"carol@example.com"},
+	}))
+
+	directory := testdirectory.Start(t,
+		testdirectory.WithNoTLS(t),
+		testdirectory.WithDefaults(t, &testdirectory.Defaults{Users: users}),
+	)
+	return libs.LDAPConfig{
+		URL:            fmt.Sprintf("ldap://%s:%d", directory.Host(), directory.Port()),
+		BindDN:         "cn=search,ou=people,dc=example,dc=org",
+		BindPassword:   "secret",
+		BaseDN:         testdirectory.DefaultUserDN,
+		UserFilter:     "(cn={username})",
+		GroupAttribute: "memberOf",
+		Timeout:        5 * time.Second,
+	}
+}
+
+func TestLDAPAuthenticate_SearchAndBind(t *testing.T) {
+	config := startDirectory(t)
+
+	entry, err := libs.LDAPAuthenticate(config, "alice", "alice@example.com", "password")
+	require.NoError(t, err)
+	assert.Equal(t, "cn=alice,ou=people,dc=example,dc=org", entry.DN)
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=org"}, entry.Groups)
+
+	_, err = libs.LDAPAuthenticate(config, "alice", "alice@example.com", "wrong")
+	assert.ErrorIs(t, err, libs.ErrLDAPInvalidCredentials)
+
+	_, err = libs.LDAPAuthenticate(config, "alice", "alice@example.com", "")
+	assert.ErrorIs(t, err, libs.ErrLDAPInvalidCredentials)
+
+	_, err = libs.LDAPAuthenticate(config, "bob", "bob@example.com", "password")
+	assert.ErrorIs(t, err, libs.ErrLDAPUserNotFound)
+}
+
+func TestLDAPAuthenticate_ReadsNameAndEmail(t *testing.T) {
+	config := startDirectory(t)
+
+	entry, err := libs.LDAPAuthenticate(config, "carol", "carol@example.com", "password")
+	require.NoError(t, err)
+	assert.Equal(t, "cn=carol,ou=people,dc=example,dc=org", entry.DN)
+	assert.Equal(t, "Carol Díaz", entry.Name)
+	assert.Equal(t, "carol@example.com", entry.Email)
+	assert.Empty(t, entry.Groups)
+}
+
+func TestLDAPAuthenticator_TakesEmailFromDirectory(t *testing.T) {
+	authenticator := services.LDAPAuthenticator{Config: startDirectory(t)}
+
+	identity, err := authenticator.Authenticate(&services.User{Username: "carol", Email: "carol@corp.example.com"}, "password")
+	require.NoError(t, err)
+	assert.Equal(t, "cn=carol,ou=people,dc=example,dc=org", identity.Subject)
+	assert.Equal(t, "carol@example.com", identity.Email)
+
+	// Entries without mail keep the email of the user
+	identity, err = authenticator.Authenticate(&services.User{Username: "alice", Email: "alice@example.com"}, "password")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity.Email)
+}
+
+func TestLDAPAuthenticate_UserDNTemplate(t *testing.T) {
+	config := startDirectory(t)
+	config.BindDN, config.BindPassword, config.BaseDN = "", "", ""
+	config.UserDN = "cn={username},ou=people,dc=example,dc=org"
+
+	entry, err := libs.LDAPAuthenticate(config, "alice", "alice@example.com", "password")
+	require.NoError(t, err)
+	assert.Equal(t, "cn=alice,ou=people,dc=example,dc=org", entry.DN)
+
+	_, err = libs.LDAPAuthenticate(config, "alice,ou=other", "alice@example.com", "password")
+	assert.ErrorIs(t, err, libs.ErrLDAPInvalidCredentials)
+}
+
+func TestLDAPAuthenticate_Unreachable(t *testing.T) {
+	config := libs.LDAPConfig{URL: fmt.Sprintf("ldap://localhost:%d", testdirectory.FreePort(t)), Timeout: time.Second}
+
+	_, err := libs.LDAPAuthenticate(config, "alice", "alice@example.com", "password")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, libs.ErrLDAPInvalidCredentials)
+	assert.NotErrorIs(t, err, libs.ErrLDAPUserNotFound)
+	assert.ErrorIs(t, err, libs.ErrLDAPUnavailable)
+
+	// Only an unreachable directory lets the local password be tried next
+	_, err = services.LDAPAuthenticator{Config: config}.Authenticate(&services.User{Username: "alice", Email: "alice@example.com"}, "password")
+	assert.ErrorIs(t, err, services.ErrBackendUnavailable)
+}
+
+func TestLDAPAuthenticate_ConfigurationErrorsAreNotOutages(t *testing.T) {
+	config := startDirectory(t)
+	config.BindPassword = "wrong"
+
+	_, err := libs.LDAPAuthenticate(config, "alice", "alice@example.com", "password")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, libs.ErrLDAPUnavailable)
+
+	// A filter matching several entries names nobody in the error
+	config = startDirectory(t)
+	config.UserFilter = "(cn=*)"
+	_, err = libs.LDAPAuthenticate(config, "alice", "alice@example.com", "password")
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, libs.ErrLDAPUnavailable)
+	assert.NotErrorIs(t, err, libs.ErrLDAPUserNotFound)
+	assert.NotContains(t, err.Error(), "alice")
+
+	_, err = services.LDAPAuthenticator{Config: config}.Authenticate(&services.User{Username: "alice", Email: "alice@example.com"}, "password")
+	assert.NotErrorIs(t, err, services.ErrBackendUnavailable)
+}
+
+func TestLDAPConfig_HandlesEmail(t *testing.T) {
+	config := libs.LDAPConfig{Domains: []string{"corp.example.com"}}
+
+	assert.True(t, config.HandlesEmail("alice@CORP.example.com"))
+	assert.False(t, config.HandlesEmail("alice@example.com"))
+	assert.False(t, config.HandlesEmail("alice"))
+}
+
+func TestLoadLDAPConfig_NoLocalFallbackByDefault(t *testing.T) {
+	t.Setenv("LDAP_FALLBACK_LOCAL", "")
+	assert.False(t, libs.LoadLDAPConfigFromEnv().Fallback)
+
+	t.Setenv("LDAP_FALLBACK_LOCAL", "true")
+	assert.True(t, libs.LoadLDAPConfigFromEnv().Fallback)
+}
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"database/sql"
+	"global-auth-server/services"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLockoutConfig_LockDurationEscalates(t *testing.T) {
+	config := services.LockoutConfig{Threshold: 5, Duration: 15 * time.Minute, MaxDuration: time.Hour}
+
+	assert.Equal(t, 15*time.Minute, config.LockDuration(0))
+	assert.Equal(t, 30*time.Minute, config.LockDuration(1))
+	assert.Equal(t, time.Hour, config.LockDuration(2))
+	assert.Equal(t, time.Hour, config.LockDuration(10))
+}
+
+func TestMaxPasswordLogins(t *testing.T) {
+	assert.Equal(t, 30, services.MaxPasswordLogins())
+
+	t.Setenv("PASSWORD_MAX_LOGINS", "10")
+	assert.Equal(t, 10, services.MaxPasswordLogins())
+}
+
+// expectPasswordCheck expects the lookups of AuthenticateUser up to the
+// password check of a local user that is not locked.
+func expectPasswordCheck(mock sqlmock.Sqlmock, password string) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@example.com").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+}
+
+func loginFailureRows(failedAttempts int, lockCount int, lockedUntil *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"failed_attempts", "lock_count", "locked_until"}).
+		AddRow(failedAttempts, lockCount, lockedUntil)
+}
+
+func TestAuthenticateUser_WrongPasswordCountsFailure(t *testing.T) {
+	mock := mockDB(t)
+	expectPasswordCheck(mock, "Current-Pass-1")
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").WillReturnRows(loginFailureRows(1, 0, nil))
+	mock.ExpectCommit()
+
+	_, err := services.AuthenticateUser("ana@example.com", "wrong")
+	assert.ErrorIs(t, err, services.ErrInvalidCredentials)
+}
+
+func TestAuthenticateUser_LocksAtThreshold(t *testing.T) {
+	mock := mockDB(t)
+	expectPasswordCheck(mock, "Current-Pass-1")
+	lockedUntil := &capturedTime{}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").
+		WillReturnRows(loginFailureRows(services.GetLockoutConfig().Threshold, 0, nil))
+	mock.ExpectExec(`UPDATE login_failures\s+SET failed_attempts = 0, lock_count = \$2, locked_until = \$3`).
+		WithArgs("7", 1, lockedUntil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := services.AuthenticateUser("ana@example.com", "wrong")
+	var locked *services.AccountLockedError
+	require.ErrorAs(t, err, &locked)
+	assert.True(t, locked.JustLocked)
+	assert.Equal(t, lockedUntil.value, locked.Until)
+	assert.WithinDuration(t, time.Now().Add(services.GetLockoutConfig().Duration), locked.Until, time.Minute)
+}
+
+func TestRecordLoginFailure_EscalatesLock(t *testing.T) {
+	config := services.GetLockoutConfig()
+	recent := time.Now().Add(-time.Hour)
+	forgotten := time.Now().Add(-config.MaxDuration - time.Hour)
+	cases := []struct {
+		name        string
+		lockCount   int
+		lockedUntil *time.Time
+		nextCount   int
+		duration    time.Duration
+	}{
+		{"second lock doubles", 1, &recent, 2, config.LockDuration(1)},
+		{"unlocked long ago starts over", 3, &forgotten, 1, config.LockDuration(0)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := mockDB(t)
+			lockedUntil := &capturedTime{}
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").
+				WillReturnRows(loginFailureRows(config.Threshold, tc.lockCount, tc.lockedUntil))
+			mock.ExpectExec(`UPDATE login_failures`).WithArgs("7", tc.nextCount, lockedUntil).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			until, err := services.RecordLoginFailure("7")
+			require.NoError(t, err)
+			require.NotNil(t, until)
+			assert.WithinDuration(t, time.Now().Add(tc.duration), *until, time.Minute)
+		})
+	}
+}
+
+func TestAuthenticateUser_RefusesLockedAccount(t *testing.T) {
+	mock := mockDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	until := time.Now().Add(10 * time.Minute)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@example.com").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(until))
+
+	// Even the right password is not checked while the account is locked
+	_, err := services.AuthenticateUser("ana@example.com", "Current-Pass-1")
+	var locked *services.AccountLockedError
+	require.ErrorAs(t, err, &locked)
+	assert.False(t, locked.JustLocked)
+	assert.True(t, locked.Until.Equal(until))
+}
+
+func TestAuthenticateUser_SuccessClearsFailures(t *testing.T) {
+	mock := mockDB(t)
+	expectPasswordCheck(mock, "Current-Pass-1")
+	mock.ExpectExec(`UPDATE login_failures\s+SET failed_attempts = 0\s+WHERE user_id = \$1 AND failed_attempts > 0`).
+		WithArgs("7").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The login is counted when the tokens are issued, not here
+	user, err := services.AuthenticateUser("ana@example.com", "Current-Pass-1")
+	require.NoError(t, err)
+	assert.Equal(t, "7", user.ID)
+}
+
+func TestCountPasswordLogin(t *testing.T) {
+	backend := func(name string) *sqlmock.Rows { return sqlmock.NewRows([]string{"backend"}).AddRow(name) }
+
+	t.Run("local password", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(backend("local"))
+		mock.ExpectQuery(`UPDATE users\s+SET logins`).WithArgs("7", services.MaxPasswordLogins()).
+			WillReturnRows(sqlmock.NewRows([]string{"logins"}).AddRow(3))
+
+		user := &services.User{ID: "7", Email: "ana@example.com"}
+		require.NoError(t, services.CountPasswordLogin(user))
+		assert.Equal(t, 3, *user.Logins)
+	})
+
+	t.Run("limit reached", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(backend("local"))
+		mock.ExpectQuery(`UPDATE users\s+SET logins`).WithArgs("7", services.MaxPasswordLogins()).
+			WillReturnRows(sqlmock.NewRows([]string{"logins"}))
+
+		err := services.CountPasswordLogin(&services.User{ID: "7", Email: "ana@example.com"})
+		assert.ErrorIs(t, err, services.ErrPasswordExpired)
+	})
+
+	t.Run("directory user", func(t *testing.T) {
+		mock := mockDB(t)
+		mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(backend("ldap"))
+
+		// The directory manages its own password policy
+		assert.NoError(t, services.CountPasswordLogin(&services.User{ID: "7", Email: "ana@example.com"}))
+	})
+}
+
+func TestAuthenticateUser_RefusesUsedUpPassword(t *testing.T) {
+	mock := mockDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	rows := sqlmock.NewRows([]string{
+		"id", "username", "code", "names", "email", "password", "rol_id", "is_staff", "is_active", "boss_id",
+		"created_at", "updated_at", "token", "logins", "can_download_xlsx", "bank_id", "filial_id",
+	}).AddRow("7", "user7", nil, "User 7", "ana@example.com", string(hash), nil, false, true, nil,
+		"2024-01-01", "2024-01-01", nil, services.MaxPasswordLogins(), nil, nil, nil)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@example.com").WillReturnRows(rows)
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	mock.ExpectExec(`UPDATE login_failures`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Refused before the second factor, without counting
+	_, err := services.AuthenticateUser("ana@example.com", "Current-Pass-1")
+	assert.ErrorIs(t, err, services.ErrPasswordExpired)
+}
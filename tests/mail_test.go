@@ -0,0 +1,35 @@
+package test
+
+import (
+	"global-auth-server/libs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMailer_AppendsMessages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mail.log")
+	mailer := libs.NewLogMailer("no-reply@example.com", file)
+
+	err := mailer.Send(libs.MailMessage{
+		To:      "user@example.com\r\nBcc: other@example.com",
+		Subject: "Restablecer contraseña",
+		Body:    "token\nline",
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "From: no-reply@example.com\r\n")
+	assert.Contains(t, string(content), "To: user@example.comBcc: other@example.com\r\n")
+	assert.Contains(t, string(content), "Subject: =?UTF-8?q?Restablecer_contrase=C3=B1a?=\r\n")
+	assert.Contains(t, string(content), "\r\n\r\ntoken\r\nline")
+}
+
+func TestNewSMTPMailer_RequiresHost(t *testing.T) {
+	_, err := libs.NewSMTPMailer(libs.MailConfig{SMTPPort: 587})
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"global-auth-server/libs"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain points the shared key ring at the bundled development key so the
+// token tests run without AWS credentials, and sets the public URL the
+// issuer and the OpenID Connect endpoints derive from.
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_KEY_PROVIDER", "file")
+	os.Setenv("JWT_PRIVATE_KEY_FILE", "../certificates/private.pem")
+	os.Setenv("PUBLIC_URL", "https://auth.example.com")
+	os.Exit(m.Run())
+}
+
+// mockDB points the shared connection at a sqlmock database for the test.
+// Queries are matched as regular expressions, in order.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	libs.SetDB(db)
+	t.Cleanup(func() {
+		require.NoError(t, mock.ExpectationsWereMet())
+		db.Close()
+	})
+	return mock
+}
+
+// userRows returns an active user row as the user lookups select it.
+func userRows(id string, email string, password any, isStaff bool) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "username", "code", "names", "email", "password", "rol_id", "is_staff", "is_active", "boss_id",
+		"created_at", "updated_at", "token", "logins", "can_download_xlsx", "bank_id", "filial_id",
+	}).AddRow(id, "user"+id, nil, "User "+id, email, password, nil, isStaff, true, nil,
+		"2024-01-01", "2024-01-01", nil, 0, nil, nil, nil)
+}
@@ -0,0 +1,263 @@
+package test
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"global-auth-server/authclient"
+	"global-auth-server/controllers"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// capturedString matches any string argument and keeps it.
+type capturedString struct{ value string }
+
+func (c *capturedString) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	c.value = s
+	return ok
+}
+
+func setSecretEncryptionKey(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	t.Setenv("SECRET_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+}
+
+func expectChallengeAttempt(mock sqlmock.Sqlmock, userID string) {
+	mock.ExpectQuery(`UPDATE mfa_challenges\s+SET attempts = attempts \+ 1`).
+		WithArgs(libs.HashOpaqueToken("challenge-token"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "audience"}).AddRow(userID, ""))
+}
+
+func TestSealSecret_RoundTrip(t *testing.T) {
+	setSecretEncryptionKey(t)
+
+	sealed, err := libs.SealSecret("JBSWY3DPEHPK3PXP")
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, "JBSWY3DPEHPK3PXP")
+
+	opened, err := libs.OpenSecret(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", opened)
+
+	// Secrets stored before encryption are still read
+	opened, err = libs.OpenSecret("JBSWY3DPEHPK3PXP")
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", opened)
+
+	t.Setenv("SECRET_ENCRYPTION_KEY", "")
+	_, err = libs.SealSecret("JBSWY3DPEHPK3PXP")
+	assert.ErrorIs(t, err, libs.ErrSecretKeyMissing)
+}
+
+func TestStartChallengeEnrollment_RequiresEnrollmentToken(t *testing.T) {
+	mock := mockDB(t)
+	expectChallengeAttempt(mock, "7")
+	mock.ExpectExec(`UPDATE mfa_enrollment_tokens`).
+		WithArgs(libs.HashOpaqueToken("guessed"), "7").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// The password step alone does not hand out a secret
+	_, err := services.StartChallengeEnrollment("challenge-token", "guessed")
+	assert.ErrorIs(t, err, services.ErrInvalidEnrollmentToken)
+}
+
+func TestMFAChallenge_EnrollsWithAdminToken(t *testing.T) {
+	setSecretEncryptionKey(t)
+	mock := mockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM mfa_enrollment_tokens`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO mfa_enrollment_tokens`).WithArgs(sqlmock.AnyArg(), "7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	enrollmentToken, ttl, err := services.IssueMFAEnrollmentToken("7")
+	require.NoError(t, err)
+	assert.Equal(t, services.MFAEnrollmentTTL(), ttl)
+
+	sealed := &capturedString{}
+	expectChallengeAttempt(mock, "7")
+	mock.ExpectExec(`UPDATE mfa_enrollment_tokens`).
+		WithArgs(libs.HashOpaqueToken(enrollmentToken), "7").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", nil, false))
+	mock.ExpectExec(`INSERT INTO user_mfa`).WithArgs("7", sealed).WillReturnResult(sqlmock.NewResult(0, 1))
+	enrollment, err := services.StartChallengeEnrollment("challenge-token", enrollmentToken)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed.value, "v1:"))
+	assert.NotContains(t, sealed.value, enrollment.Secret)
+
+	// The first code confirms the enrollment and completes the login
+	code, err := libs.TOTPCode(enrollment.Secret, libs.TOTPStep(time.Now()))
+	require.NoError(t, err)
+	expectChallengeAttempt(mock, "7")
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required", "passkeys"}).AddRow(false, true, false))
+	mock.ExpectQuery(`SELECT secret, last_used_step FROM user_mfa`).WithArgs("7", false).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(sealed.value, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_mfa\s+SET enabled_at = now\(\)`).WithArgs("7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM mfa_recovery_codes`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 10; i++ {
+		mock.ExpectExec(`INSERT INTO mfa_recovery_codes`).WithArgs(sqlmock.AnyArg(), "7").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectExec(`UPDATE mfa_challenges SET used_at = now\(\)`).
+		WithArgs(libs.HashOpaqueToken("challenge-token")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	challenge, recoveryCodes, err := services.CompleteMFAChallenge("challenge-token", code)
+	require.NoError(t, err)
+	assert.Equal(t, "7", challenge.UserID)
+	assert.Len(t, recoveryCodes, 10)
+}
+
+func TestMFARecoveryCodes_WrongCodesLockTheAccount(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/mfa/recovery-codes", func(c *gin.Context) {
+		c.Set(authclient.ClaimsKey, &authclient.Claims{UserID: "7"})
+		controllers.MFARecoveryCodes(c)
+	})
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/mfa/recovery-codes", strings.NewReader(`{"code":"wrong-recovery-code"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expectWrongCode := func() {
+		mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", nil, false))
+		mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec(`UPDATE mfa_recovery_codes`).WithArgs(sqlmock.AnyArg(), "7").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+	}
+
+	// A wrong code is counted like a wrong password
+	expectWrongCode()
+	mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").WillReturnRows(loginFailureRows(1, 0, nil))
+	mock.ExpectCommit()
+	assert.Equal(t, http.StatusBadRequest, post().Code)
+
+	// The one reaching the threshold locks the account
+	expectWrongCode()
+	mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").
+		WillReturnRows(loginFailureRows(services.GetLockoutConfig().Threshold, 0, nil))
+	mock.ExpectExec(`UPDATE login_failures`).WithArgs("7", 1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	w := post()
+	assert.Equal(t, http.StatusLocked, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Once locked, codes are no longer checked
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+	assert.Equal(t, http.StatusLocked, post().Code)
+}
+
+func expectMFAState(mock sqlmock.Sqlmock, enabled bool, passkeys bool) {
+	mock.ExpectQuery(`SELECT\s+EXISTS`).WithArgs("7").
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "required", "passkeys"}).AddRow(enabled, false, passkeys))
+}
+
+func TestMFAEnroll_RequiresStepUp(t *testing.T) {
+	mock := mockDB(t)
+	setSecretEncryptionKey(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	issuedAt := time.Now()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/mfa/enroll", func(c *gin.Context) {
+		c.Set(authclient.ClaimsKey, &authclient.Claims{
+			UserID:           "7",
+			RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(issuedAt)},
+		})
+		controllers.MFAEnroll(c)
+	})
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/mfa/enroll", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expectUser := func() {
+		mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	}
+	password := `{"password":"` + base64.StdEncoding.EncodeToString([]byte("Current-Pass-1")) + `"}`
+
+	// The access token alone is not enough
+	expectUser()
+	expectMFAState(mock, false, false)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	assert.Equal(t, http.StatusUnauthorized, post(`{}`).Code)
+
+	// A wrong password counts as a failed login
+	expectUser()
+	expectMFAState(mock, false, false)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO login_failures`).WithArgs("7").WillReturnRows(loginFailureRows(1, 0, nil))
+	mock.ExpectCommit()
+	assert.Equal(t, http.StatusUnauthorized, post(`{"password":"`+base64.StdEncoding.EncodeToString([]byte("wrong"))+`"}`).Code)
+
+	// The current password starts the enrollment
+	expectUser()
+	expectMFAState(mock, false, false)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("local"))
+	mock.ExpectExec(`UPDATE login_failures\s+SET failed_attempts = 0`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO user_mfa`).WithArgs("7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	w := post(password)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "otpauth://")
+
+	// Nor is the password of a token issued long ago
+	issuedAt = time.Now().Add(-time.Hour)
+	expectUser()
+	assert.Equal(t, http.StatusUnauthorized, post(password).Code)
+}
+
+func TestWebAuthnRegisterOptions_AsksForTheSecondFactor(t *testing.T) {
+	mock := mockDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/webauthn/register/options", func(c *gin.Context) {
+		c.Set(authclient.ClaimsKey, &authclient.Claims{
+			UserID:           "7",
+			RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+		})
+		controllers.WebAuthnRegisterOptions(c)
+	})
+
+	// With MFA enabled the password does not stand in for the code
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	expectMFAState(mock, true, false)
+	body := `{"password":"` + base64.StdEncoding.EncodeToString([]byte("Current-Pass-1")) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/register/options", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
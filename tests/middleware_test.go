@@ -0,0 +1,84 @@
+package test
+
+import (
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/middlewares"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouter(handlers ...gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handlers = append(handlers, func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/protected", handlers...)
+	return r
+}
+
+func TestRequireAuth_RejectsMissingAndInvalidTokens(t *testing.T) {
+	r := newTestRouter(middlewares.RequireAuth())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequireAuth_RejectsIDTokens(t *testing.T) {
+	idToken, _, err := libs.GenerateIDToken(map[string]any{"sub": "42", "aud": "portal"}, time.Hour)
+	require.NoError(t, err)
+
+	r := newTestRouter(middlewares.RequireAuth())
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+idToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequireRole(t *testing.T) {
+	withRoles := func(roles ...authclient.Role) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Set(authclient.ClaimsKey, &authclient.Claims{Roles: roles}) }
+	}
+
+	r := newTestRouter(withRoles(authclient.Role{Code: "ADMIN"}), middlewares.RequireRole("ADMIN"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r = newTestRouter(withRoles(authclient.Role{Code: "TELLER"}), middlewares.RequireRole("ADMIN"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRequireAdmin_RejectsImpersonationTokens(t *testing.T) {
+	withClaims := func(claims *authclient.Claims) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Set(authclient.ClaimsKey, claims) }
+	}
+	admin := []authclient.Role{{Code: "ADMIN"}}
+
+	r := newTestRouter(withClaims(&authclient.Claims{UserID: "2", Roles: admin}), middlewares.RequireAdmin())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// A staff member impersonating an admin does not get admin rights
+	impersonated := &authclient.Claims{UserID: "2", Roles: admin, Actor: &authclient.Actor{Sub: "1"}}
+	r = newTestRouter(withClaims(impersonated), middlewares.RequireAdmin())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,263 @@
+package test
+
+import (
+	"database/sql"
+	"errors"
+	"global-auth-server/controllers"
+	"global-auth-server/services"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPKCE_RFC7636Example(t *testing.T) {
+	// Example from RFC 7636, appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.True(t, services.VerifyPKCE(verifier, challenge))
+	assert.False(t, services.VerifyPKCE(verifier+"x", challenge))
+	assert.False(t, services.VerifyPKCE("short", challenge))
+}
+
+func TestClientGrantScopes(t *testing.T) {
+	client := &services.Client{ID: "reports", Scopes: []string{"logs:write", "reports:read"}}
+
+	scopes, ok := client.GrantScopes("")
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"logs:write", "reports:read"}, scopes)
+
+	scopes, ok = client.GrantScopes("reports:read")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"reports:read"}, scopes)
+
+	_, ok = client.GrantScopes("reports:read admin")
+	assert.False(t, ok)
+}
+
+func TestClientFilterRoles(t *testing.T) {
+	client := &services.Client{ID: "portal", Roles: []string{"REPORTS_VIEW"}}
+	roles := []services.Role{{Code: "ADMIN"}, {Code: "REPORTS_VIEW"}}
+
+	assert.Equal(t, []services.Role{{Code: "REPORTS_VIEW"}}, client.FilterRoles(roles))
+	assert.Empty(t, (&services.Client{ID: "other"}).FilterRoles(roles))
+}
+
+func TestClientAllowsUserScopes(t *testing.T) {
+	client := &services.Client{ID: "tv", Scopes: []string{"reports:read"}}
+
+	assert.True(t, client.AllowsUserScopes(""))
+	assert.True(t, client.AllowsUserScopes("openid profile reports:read"))
+	assert.False(t, client.AllowsUserScopes("openid logs:write"))
+}
+
+func TestValidateClientSettings(t *testing.T) {
+	valid := services.ClientInput{
+		ClientID:     "portal",
+		RedirectURIs: []string{"https://portal.example.com/callback"},
+		GrantTypes:   []string{"authorization_code", "refresh_token"},
+	}
+	assert.NoError(t, services.ValidateClientSettings(valid))
+
+	publicCredentials := valid
+	publicCredentials.GrantTypes = []string{"client_credentials"}
+	assert.ErrorIs(t, services.ValidateClientSettings(publicCredentials), services.ErrInvalidClientData)
+
+	relative := valid
+	relative.RedirectURIs = []string{"/callback"}
+	assert.ErrorIs(t, services.ValidateClientSettings(relative), services.ErrInvalidClientData)
+
+	unknown := valid
+	unknown.GrantTypes = []string{"implicit"}
+	assert.ErrorIs(t, services.ValidateClientSettings(unknown), services.ErrInvalidClientData)
+
+	// password is not a token endpoint grant but allows /auth/login
+	password := valid
+	password.GrantTypes = []string{services.PasswordGrantType}
+	assert.NoError(t, services.ValidateClientSettings(password))
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDFGHJK", services.NormalizeUserCode("bcdf-ghjk"))
+	assert.Equal(t, "BCDFGHJK", services.NormalizeUserCode(" BCDF GHJK "))
+	assert.Equal(t, "BCDF-GHJK", services.FormatUserCode("BCDFGHJK"))
+}
+
+// expectClient answers the next client lookup with a client using the
+// authorization code flow. Arrays use the Postgres text format.
+func expectClient(mock sqlmock.Sqlmock, clientID string, secretHash any, scopes string, roles string) {
+	mock.ExpectQuery(`FROM clients\s+WHERE client_id = \$1`).
+		WithArgs(clientID).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"client_id", "name", "secret_hash", "redirect_uris", "scopes", "audiences", "grant_types",
+			"access_token_ttl", "refresh_token_ttl", "roles", "created_at", "updated_at",
+		}).AddRow(clientID, clientID, secretHash, "{https://portal.example.com/callback}", scopes, "{}",
+			"{authorization_code,refresh_token}", nil, nil, roles, time.Now(), time.Now()))
+}
+
+func TestAuthorizeLogin_RequiresCSRFToken(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.GET("/oauth/authorize", controllers.Authorize)
+	r.POST("/oauth/authorize", controllers.AuthorizeLogin)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"portal"},
+		"redirect_uri":          {"https://portal.example.com/callback"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+
+	expectClient(mock, "portal", nil, "{}", "{}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	csrf := cookies[0]
+	assert.Equal(t, "form_csrf", csrf.Name)
+	assert.True(t, csrf.HttpOnly)
+	assert.Contains(t, w.Body.String(), `name="csrf_token" value="`+csrf.Value+`"`)
+
+	post := func(token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"ana@example.com"}, "password": {"secret"}, "csrf_token": {token}}
+		for name, values := range params {
+			form[name] = values
+		}
+		req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// A form posted from another site has neither the cookie nor its value
+	expectClient(mock, "portal", nil, "{}", "{}")
+	assert.Equal(t, http.StatusForbidden, post("", nil).Code)
+	expectClient(mock, "portal", nil, "{}", "{}")
+	assert.Equal(t, http.StatusForbidden, post(csrf.Value, nil).Code)
+	expectClient(mock, "portal", nil, "{}", "{}")
+	assert.Equal(t, http.StatusForbidden, post("guessed", csrf).Code)
+
+	// With the token of the rendered form the login goes on
+	expectClient(mock, "portal", nil, "{}", "{}")
+	mock.ExpectQuery(`FROM identity_providers`).WillReturnError(errors.New("database unavailable"))
+	assert.NotEqual(t, http.StatusForbidden, post(csrf.Value, csrf).Code)
+}
+
+func TestDeviceVerify_DenyRequiresCredentials(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.POST("/oauth/device", controllers.DeviceVerify)
+
+	mock.ExpectQuery(`FROM device_codes\s+WHERE user_code = \$1 AND status = 'pending'`).
+		WithArgs("BCDFGHJK").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"user_code", "client_id", "scope", "status", "user_id", "poll_interval", "last_polled_at", "expires_at", "used_at",
+		}).AddRow("BCDFGHJK", "tv", "", "pending", nil, 5, nil, time.Now().Add(time.Minute), nil))
+	mock.ExpectQuery(`FROM users\s+WHERE email = \$1`).
+		WithArgs("").
+		WillReturnError(sql.ErrNoRows)
+
+	form := url.Values{"user_code": {"BCDF-GHJK"}, "action": {"deny"}}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// No UPDATE of device_codes was expected: the request stays pending
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotContains(t, w.Body.String(), "rechazado")
+}
+
+func TestLogin_RefusesClientAudienceWithoutPasswordGrant(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/login", controllers.Login)
+
+	// portal only allows authorization_code and refresh_token
+	expectClient(mock, "portal", nil, "{}", "{}")
+
+	body := `{"email":"ana@example.com","password":"c2VjcmV0","audience":"portal"}`
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// The password is never checked, so no user is read
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid audience")
+}
+
+func TestToken_RefreshRefusesWiderScope(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/oauth/token", controllers.Token)
+
+	expectClient(mock, "portal", nil, "{reports:read,reports:write}", "{}")
+	mock.ExpectQuery(`SELECT family_id, user_id, audience, scope, expires_at\s+FROM refresh_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_id", "audience", "scope", "expires_at"}).
+			AddRow("family-1", "42", "portal", "openid reports:read", time.Now().Add(time.Hour)))
+
+	// The client may request reports:write, but it was not granted
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"portal"},
+		"refresh_token": {"refresh-1"},
+		"scope":         {"openid reports:write"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// The refresh token is not consumed
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_scope")
+}
+
+func TestAuthorize_RefusesScopeNotAllowedForClient(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.GET("/oauth/authorize", controllers.Authorize)
+
+	expectClient(mock, "portal", nil, "{reports:read}", "{}")
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"portal"},
+		"redirect_uri":          {"https://portal.example.com/callback"},
+		"scope":                 {"openid logs:write"},
+		"state":                 {"xyz"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "invalid_scope", location.Query().Get("error"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"global-auth-server/authclient"
+	"global-auth-server/controllers"
+	"global-auth-server/libs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTokenConfig_IssuerDefaultsToPublicURL(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCES", "")
+	t.Setenv("PUBLIC_URL", "https://auth.example.com/")
+	config := libs.LoadTokenConfigFromEnv()
+	assert.Equal(t, "https://auth.example.com", config.Issuer)
+	assert.Equal(t, []string{"https://auth.example.com"}, config.Audiences)
+
+	t.Setenv("JWT_ISSUER", "https://login.example.com")
+	assert.Equal(t, "https://login.example.com", libs.LoadTokenConfigFromEnv().Issuer)
+}
+
+func TestOpenIDConfiguration_IgnoresRequestHost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/.well-known/openid-configuration", controllers.OpenIDConfigurationDocument)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+	req.Host = "attacker.example.net"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var document controllers.OpenIDConfiguration
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &document))
+	assert.Equal(t, "https://auth.example.com", document.Issuer)
+	assert.Equal(t, libs.GetTokenConfig().Issuer, document.Issuer)
+	assert.Equal(t, "https://auth.example.com/oauth/authorize", document.AuthorizationEndpoint)
+	assert.Equal(t, "https://auth.example.com/oauth/token", document.TokenEndpoint)
+	assert.Equal(t, "https://auth.example.com/.well-known/jwks.json", document.JWKSURI)
+	assert.Equal(t, "https://auth.example.com/api/auth/userinfo", document.UserInfoEndpoint)
+	assert.Contains(t, document.ScopesSupported, "openid")
+	assert.Equal(t, []string{"S256"}, document.CodeChallengeMethodsSupported)
+}
+
+func TestOpenIDConfiguration_RequiresPublicURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/.well-known/openid-configuration", controllers.OpenIDConfigurationDocument)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+
+	// Nothing cacheable is built from the Host header
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+}
+
+func TestToken_AuthorizationCodeIssuesIDToken(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/oauth/token", controllers.Token)
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	expectClient(mock, "portal", nil, "{openid,profile}", "{}")
+	mock.ExpectQuery(`UPDATE authorization_codes`).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "user_id", "redirect_uri", "scope", "nonce", "code_challenge"}).
+			AddRow("portal", "42", "https://portal.example.com/callback", "openid profile", "nonce-1", challenge))
+	mock.ExpectQuery(`FROM users`).WithArgs("42").WillReturnRows(userRows("42", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM user_roles`).WithArgs("42").
+		WillReturnRows(sqlmock.NewRows([]string{"code", "description"}).AddRow("ADMIN", "Admin"))
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"portal"},
+		"code":          {"code-1"},
+		"redirect_uri":  {"https://portal.example.com/callback"},
+		"code_verifier": {verifier},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response controllers.TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotEmpty(t, response.IDToken)
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(response.IDToken, claims)
+	require.NoError(t, err)
+	assert.Equal(t, "https://auth.example.com", claims["iss"])
+	assert.Equal(t, "portal", claims["aud"])
+	assert.Equal(t, "42", claims["sub"])
+	assert.Equal(t, "nonce-1", claims["nonce"])
+	assert.Equal(t, "ana@example.com", claims["email"])
+	assert.Contains(t, claims, "auth_time")
+	// Roles are only carried by the access token
+	assert.NotContains(t, claims, "roles")
+
+	// The id_token is not accepted as an access token
+	_, err = libs.ParseJWT(response.IDToken)
+	assert.Error(t, err)
+}
+
+func TestUserInfo_FiltersRolesOfTheClient(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userinfo", func(c *gin.Context) {
+		claims := &authclient.Claims{UserID: "42"}
+		claims.Audience = jwt.ClaimStrings{"portal"}
+		c.Set(authclient.ClaimsKey, claims)
+		controllers.UserInfo(c)
+	})
+
+	mock.ExpectQuery(`FROM users`).WithArgs("42").WillReturnRows(userRows("42", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM user_roles`).WithArgs("42").
+		WillReturnRows(sqlmock.NewRows([]string{"code", "description"}).AddRow("ADMIN", "Admin").AddRow("SUPPLIER", "Supplier"))
+	expectClient(mock, "portal", nil, "{openid}", "{SUPPLIER}")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userinfo", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var info controllers.UserInfoResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "42", info.Sub)
+	assert.Equal(t, "user42", info.PreferredUsername)
+	assert.Equal(t, "ana@example.com", info.Email)
+	require.Len(t, info.Roles, 1)
+	assert.Equal(t, "SUPPLIER", info.Roles[0].Code)
+}
+
+func TestUserInfo_RejectsUnknownUsers(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userinfo", func(c *gin.Context) {
+		c.Set(authclient.ClaimsKey, &authclient.Claims{UserID: "42"})
+		controllers.UserInfo(c)
+	})
+
+	mock.ExpectQuery(`FROM users`).WithArgs("42").WillReturnError(sqlmock.ErrCancelled)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/userinfo", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"database/sql"
+	"global-auth-server/services"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := services.PasswordPolicy{MinLength: 10, MinClasses: 3}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	current := string(hash)
+	user := &services.User{Username: "jperez", Email: "juan.perez@example.com", Password: &current}
+
+	assert.NoError(t, policy.Validate("Nueva-Clave-22", user))
+	assert.ErrorIs(t, policy.Validate("Short-1", user), services.ErrWeakPassword)
+	assert.ErrorIs(t, policy.Validate("onlylowercaseletters", user), services.ErrWeakPassword)
+	assert.ErrorIs(t, policy.Validate(strings.Repeat("Ab1", 25), user), services.ErrWeakPassword)
+	assert.ErrorIs(t, policy.Validate("Juan.Perez-2024", user), services.ErrWeakPassword)
+	assert.ErrorIs(t, policy.Validate("X-JPerez-2024", user), services.ErrWeakPassword)
+	assert.ErrorIs(t, policy.Validate("Current-Pass-1", user), services.ErrWeakPassword)
+}
+
+func TestChangePassword_RefusesDirectoryUsers(t *testing.T) {
+	mock := mockDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(sqlmock.NewRows([]string{"backend"}).AddRow("ldap"))
+
+	// The local hash is never checked nor replaced for an LDAP user
+	_, err := services.ChangePassword("7", "Current-Pass-1", "Nueva-Clave-22")
+	assert.ErrorIs(t, err, services.ErrPasswordNotLocal)
+}
+
+func TestChangePassword_DropsPendingResetTokens(t *testing.T) {
+	mock := mockDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Current-Pass-1"), bcrypt.MinCost)
+	backend := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"backend"}).AddRow("local") }
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", string(hash), false))
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(backend())
+	mock.ExpectQuery(`FROM login_failures`).WithArgs("7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM user_auth_backends`).WithArgs("7").WillReturnRows(backend())
+	mock.ExpectExec(`UPDATE login_failures`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE users`).WithArgs("7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM password_resets`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`INSERT INTO user_revocations`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE refresh_tokens`).WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user, err := services.ChangePassword("7", "Current-Pass-1", "Nueva-Clave-22")
+	require.NoError(t, err)
+	assert.Equal(t, 0, *user.Logins)
+}
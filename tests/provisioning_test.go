@@ -0,0 +1,133 @@
+package test
+
+import (
+	"errors"
+	"global-auth-server/oidcmock"
+	"global-auth-server/services"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func expectProvisioningRules(mock sqlmock.Sqlmock, rules ...services.ProvisioningRule) {
+	rows := sqlmock.NewRows([]string{"rule_id", "source", "domain", "upstream_group", "roles", "created_at", "updated_at"})
+	for _, rule := range rules {
+		rows.AddRow(rule.ID, rule.Source, rule.Domain, rule.UpstreamGroup, "{"+rule.Roles[0]+"}", time.Now(), time.Now())
+	}
+	mock.ExpectQuery(`FROM provisioning_rules`).WillReturnRows(rows)
+}
+
+func TestProvisioningRule_Matches(t *testing.T) {
+	identity := &services.ExternalIdentity{
+		Source: "proveedores",
+		Email:  "ana@proveedores.com.pa",
+		Groups: []string{"CN=Suppliers,OU=Groups"},
+	}
+	cases := []struct {
+		name  string
+		rule  services.ProvisioningRule
+		match bool
+	}{
+		{"empty fields match anything", services.ProvisioningRule{}, true},
+		{"same domain", services.ProvisioningRule{Domain: "proveedores.com.pa"}, true},
+		{"other domain", services.ProvisioningRule{Domain: "example.com"}, false},
+		{"same source", services.ProvisioningRule{Source: "proveedores"}, true},
+		{"other source", services.ProvisioningRule{Source: services.LDAPBackend}, false},
+		{"group in another case", services.ProvisioningRule{UpstreamGroup: "cn=suppliers,ou=groups"}, true},
+		{"missing group", services.ProvisioningRule{UpstreamGroup: "cn=admins,ou=groups"}, false},
+		{"every field", services.ProvisioningRule{Source: "proveedores", Domain: "proveedores.com.pa", UpstreamGroup: "CN=Suppliers,OU=Groups"}, true},
+		{"one field off", services.ProvisioningRule{Source: "proveedores", Domain: "example.com", UpstreamGroup: "CN=Suppliers,OU=Groups"}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.match, tc.rule.Matches(identity))
+		})
+	}
+
+	// An identity without groups only matches rules without a group
+	noGroups := &services.ExternalIdentity{Source: services.LDAPBackend, Email: "ana@corp.example.com"}
+	assert.True(t, (&services.ProvisioningRule{Domain: "corp.example.com"}).Matches(noGroups))
+	assert.False(t, (&services.ProvisioningRule{UpstreamGroup: "cn=staff"}).Matches(noGroups))
+}
+
+func TestProvisionUser_CreatesUserWithRolesOfMatchingRules(t *testing.T) {
+	mock := mockDB(t)
+	identity := &services.ExternalIdentity{Source: "proveedores", Subject: "42", Email: "ana@proveedores.com.pa", Name: "Ana"}
+
+	expectProvisioningRules(mock,
+		services.ProvisioningRule{ID: "suppliers", Domain: "proveedores.com.pa", Roles: []string{"SUPPLIER"}},
+		services.ProvisioningRule{ID: "admins", UpstreamGroup: "admins", Roles: []string{"ADMIN"}},
+	)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("ana").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`INSERT INTO users`).WithArgs("ana", "Ana", "ana@proveedores.com.pa").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("7"))
+	mock.ExpectExec(`INSERT INTO user_roles`).WithArgs("7", `{"SUPPLIER"}`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO user_identities`).WithArgs("proveedores", "42", "7", "ana@proveedores.com.pa").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, false))
+
+	user, err := services.ProvisionUser(identity)
+	require.NoError(t, err)
+	assert.Equal(t, "7", user.ID)
+}
+
+func TestProvisionUser_RequiresAMatchingRule(t *testing.T) {
+	mock := mockDB(t)
+	expectProvisioningRules(mock, services.ProvisioningRule{ID: "corp", Domain: "corp.example.com", Roles: []string{"STAFF"}})
+
+	_, err := services.ProvisionUser(&services.ExternalIdentity{Source: "proveedores", Subject: "42", Email: "ana@proveedores.com.pa"})
+	assert.ErrorIs(t, err, services.ErrNoLocalAccount)
+}
+
+func TestProvisionUser_RefusesTakenUsername(t *testing.T) {
+	mock := mockDB(t)
+	expectProvisioningRules(mock, services.ProvisioningRule{ID: "all", Roles: []string{"SUPPLIER"}})
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("ana").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	// ana@a.com already has the username ana
+	_, err := services.ProvisionUser(&services.ExternalIdentity{Source: "proveedores", Subject: "42", Email: "ana@b.com"})
+	var taken *services.UsernameTakenError
+	require.ErrorAs(t, err, &taken)
+	assert.Equal(t, "ana", taken.Username)
+}
+
+func TestCompleteFederatedLogin_RefusesIdentityLinkedToOtherUser(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	expectNoLinkedIdentity(mock)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@proveedores.com.pa").WillReturnRows(userRows("7", "ana@proveedores.com.pa", nil, false))
+	// The subject was linked to user 8 in between, so nothing is updated
+	mock.ExpectExec(`INSERT INTO user_identities`).
+		WithArgs("proveedores", "42", "7", "ana@proveedores.com.pa").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, _, err := services.CompleteFederatedLogin(state, code)
+	assert.ErrorIs(t, err, services.ErrIdentityLinkedToOtherUser)
+}
+
+func TestCompleteFederatedLogin_DoesNotProvisionOnDatabaseErrors(t *testing.T) {
+	idp := oidcmock.NewServer()
+	defer idp.Close()
+	mock := mockDB(t)
+
+	state, code := signInAtMock(t, mock, idp, oidcmock.User{Subject: "42", Email: "ana@proveedores.com.pa"})
+	expectNoLinkedIdentity(mock)
+	mock.ExpectQuery(`FROM users`).WithArgs("ana@proveedores.com.pa").WillReturnError(errors.New("database unavailable"))
+
+	// No provisioning rule is read, let alone a user created
+	_, _, err := services.CompleteFederatedLogin(state, code)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, services.ErrNoLocalAccount)
+}
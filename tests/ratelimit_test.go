@@ -0,0 +1,129 @@
+package test
+
+import (
+	"global-auth-server/authclient"
+	"global-auth-server/libs"
+	"global-auth-server/middlewares"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimitStore_TokenBucket(t *testing.T) {
+	store := libs.NewMemoryRateLimitStore()
+	limit := libs.RateLimit{Requests: 2, Period: time.Minute, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take("ip:10.0.0.1", limit)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	allowed, retryAfter, err := store.Take("ip:10.0.0.1", limit)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.InDelta(t, 30*time.Second, retryAfter, float64(time.Second))
+
+	allowed, _, _ = store.Take("ip:10.0.0.2", limit)
+	assert.True(t, allowed)
+}
+
+func TestRateLimit_ByEmailKeepsBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limit := libs.RateLimit{Requests: 1, Period: time.Minute, Burst: 1}
+	r := gin.New()
+	r.POST("/login", middlewares.RateLimit(libs.NewMemoryRateLimitStore(), "account", limit, middlewares.ByEmail), func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		require.NoError(t, c.ShouldBindJSON(&req))
+		c.String(http.StatusOK, req.Email)
+	})
+
+	login := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := login("user@example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user@example.com", w.Body.String())
+
+	w = login("USER@example.com")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, login("other@example.com").Code)
+}
+
+func TestRateLimitToken_LimitsPerIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("RATE_LIMIT_TOKEN_REQUESTS", "1")
+	r := gin.New()
+	r.POST("/token", middlewares.RateLimitToken("token-test"), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	token := func(ip string) int {
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("grant_type=refresh_token"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, token("10.1.0.1"))
+	assert.Equal(t, http.StatusTooManyRequests, token("10.1.0.1"))
+	assert.Equal(t, http.StatusOK, token("10.1.0.2"))
+}
+
+func TestRateLimitLogin_SharesAccountBucketAcrossEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("RATE_LIMIT_ACCOUNT_REQUESTS", "1")
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.POST("/login", middlewares.RateLimitLogin("login-test"), ok)
+	r.POST("/authorize", middlewares.RateLimitLogin("authorize-test"), ok)
+
+	post := func(path string, email string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("email="+email))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("/login", "shared@example.com"))
+	// Another endpoint does not give the account a new budget
+	assert.Equal(t, http.StatusTooManyRequests, post("/authorize", "shared@example.com"))
+	assert.Equal(t, http.StatusOK, post("/authorize", "someone-else@example.com"))
+}
+
+func TestRateLimitUser_LimitsPerUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("RATE_LIMIT_ACCOUNT_REQUESTS", "1")
+	r := gin.New()
+	r.POST("/mfa/disable", func(c *gin.Context) {
+		c.Set(authclient.UserIDKey, c.GetHeader("X-User"))
+	}, middlewares.RateLimitUser(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	disable := func(userID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/mfa/disable", nil)
+		req.Header.Set("X-User", userID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, disable("rate-limit-user-1"))
+	assert.Equal(t, http.StatusTooManyRequests, disable("rate-limit-user-1"))
+	assert.Equal(t, http.StatusOK, disable("rate-limit-user-2"))
+}
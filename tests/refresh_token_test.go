@@ -0,0 +1,89 @@
+package test
+
+import (
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateRefreshToken_IssuesSuccessorInFamily(t *testing.T) {
+	mock := mockDB(t)
+	token, _, err := libs.GenerateOpaqueToken()
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE refresh_tokens\s+SET used_at = now\(\)`).
+		WithArgs(libs.HashOpaqueToken(token), "portal").
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_id", "audience", "scope", "expires_at"}).
+			AddRow("family-1", "42", "portal", "openid reports:read", expiresAt))
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).
+		WithArgs(sqlmock.AnyArg(), "family-1", "42", "portal", "openid reports:read", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	next, row, err := services.RotateRefreshToken(token, "portal", time.Hour)
+	require.NoError(t, err)
+	assert.NotEqual(t, token, next)
+	assert.Equal(t, "family-1", row.FamilyID)
+	assert.Equal(t, "42", row.UserID)
+	assert.Equal(t, "openid reports:read", row.Scope)
+}
+
+func TestRefreshToken_AllowsScope(t *testing.T) {
+	token := services.RefreshToken{Scope: "openid reports:read"}
+	assert.True(t, token.AllowsScope(""))
+	assert.True(t, token.AllowsScope("reports:read"))
+	assert.False(t, token.AllowsScope("openid reports:write"))
+	assert.False(t, (&services.RefreshToken{}).AllowsScope("openid"))
+}
+
+func TestRotateRefreshToken_ReuseRevokesFamily(t *testing.T) {
+	mock := mockDB(t)
+	token, _, err := libs.GenerateOpaqueToken()
+	require.NoError(t, err)
+	hash := libs.HashOpaqueToken(token)
+
+	// The token was already rotated: consuming it matches no live row, the
+	// lookup finds it used and the whole family is revoked
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE refresh_tokens\s+SET used_at = now\(\)`).
+		WithArgs(hash, "").
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_id", "audience", "expires_at"}))
+	mock.ExpectQuery(`SELECT family_id, used_at, revoked_at\s+FROM refresh_tokens`).
+		WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "used_at", "revoked_at"}).
+			AddRow("family-1", time.Now().Add(-time.Minute), nil))
+	mock.ExpectExec(`UPDATE refresh_tokens\s+SET revoked_at = now\(\)\s+WHERE family_id = \$1`).
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectRollback()
+
+	_, _, err = services.RotateRefreshToken(token, "", time.Hour)
+	assert.ErrorIs(t, err, services.ErrRefreshTokenReused)
+}
+
+func TestRotateRefreshToken_ExpiredTokenKeepsFamily(t *testing.T) {
+	mock := mockDB(t)
+	token, _, err := libs.GenerateOpaqueToken()
+	require.NoError(t, err)
+	hash := libs.HashOpaqueToken(token)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE refresh_tokens\s+SET used_at = now\(\)`).
+		WithArgs(hash, "").
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_id", "audience", "expires_at"}))
+	mock.ExpectQuery(`SELECT family_id, used_at, revoked_at\s+FROM refresh_tokens`).
+		WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "used_at", "revoked_at"}).
+			AddRow("family-1", nil, nil))
+	mock.ExpectRollback()
+
+	_, _, err = services.RotateRefreshToken(token, "", time.Hour)
+	assert.ErrorIs(t, err, services.ErrRefreshTokenInvalid)
+}
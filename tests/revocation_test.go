@@ -0,0 +1,103 @@
+package test
+
+import (
+	"database/sql/driver"
+	"global-auth-server/authclient"
+	"global-auth-server/controllers"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturedTime matches any time argument and keeps it.
+type capturedTime struct{ value time.Time }
+
+func (c *capturedTime) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	c.value = t
+	return ok
+}
+
+func TestRevokeUserTokens_RevokesTokenIssuedInSameSecond(t *testing.T) {
+	mock := mockDB(t)
+
+	issued, _, err := libs.GenerateJWT(map[string]any{"sub": "42", "user_id": "42"}, time.Hour)
+	require.NoError(t, err)
+	claims, err := libs.ParseJWT(issued)
+	require.NoError(t, err)
+
+	revokedBefore := &capturedTime{}
+	mock.ExpectExec(`INSERT INTO user_revocations`).
+		WithArgs("42", revokedBefore, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE refresh_tokens\s+SET revoked_at = now\(\)\s+WHERE user_id = \$1`).
+		WithArgs("42").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, services.RevokeUserTokens("42"))
+
+	// Issued right before the revocation, most likely in the same second
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM revoked_tokens`).
+		WithArgs(claims["jti"], "42").
+		WillReturnRows(sqlmock.NewRows([]string{"denied", "revoked_before"}).AddRow(false, revokedBefore.value))
+	revoked, err := services.IsClaimsRevoked(claims)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	// Issued once the revocation returned, as the new session after a
+	// password change
+	next, _, err := libs.GenerateJWT(map[string]any{"sub": "42", "user_id": "42"}, time.Hour)
+	require.NoError(t, err)
+	nextClaims, err := libs.ParseJWT(next)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM revoked_tokens`).
+		WithArgs(nextClaims["jti"], "42").
+		WillReturnRows(sqlmock.NewRows([]string{"denied", "revoked_before"}).AddRow(false, revokedBefore.value))
+	revoked, err = services.IsClaimsRevoked(nextClaims)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func TestIssuedAt_MillisecondPrecision(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	token, _, err := libs.GenerateJWT(map[string]any{"sub": "42"}, time.Hour)
+	require.NoError(t, err)
+	claims, err := libs.ParseJWT(token)
+	require.NoError(t, err)
+
+	issuedAt := libs.IssuedAt(claims)
+	assert.False(t, issuedAt.Before(before))
+	assert.False(t, issuedAt.After(time.Now()))
+
+	assert.Equal(t, time.Unix(1700000000, 0), libs.IssuedAt(map[string]any{"iat": float64(1700000000)}))
+	assert.Equal(t, time.Unix(0, 0), libs.IssuedAt(map[string]any{}))
+}
+
+func TestLogout_RevokesEveryTokenWithoutJTI(t *testing.T) {
+	mock := mockDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/logout", func(c *gin.Context) {
+		c.Set(authclient.ClaimsKey, &authclient.Claims{UserID: "42"})
+	}, controllers.Logout)
+
+	// The denylist needs a jti, so the whole user is revoked
+	mock.ExpectExec(`INSERT INTO user_revocations`).
+		WithArgs("42", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE refresh_tokens\s+SET revoked_at = now\(\)\s+WHERE user_id = \$1`).
+		WithArgs("42").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/logout", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
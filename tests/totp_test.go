@@ -0,0 +1,56 @@
+package test
+
+import (
+	"encoding/base32"
+	"global-auth-server/libs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := libs.TOTPCode(rfc6238Secret, libs.TOTPStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "time %d", unix)
+	}
+}
+
+func TestValidateTOTP_AllowsSkew(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	previous, err := libs.TOTPCode(rfc6238Secret, libs.TOTPStep(now)-1)
+	require.NoError(t, err)
+
+	step, ok := libs.ValidateTOTP(rfc6238Secret, previous, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, libs.TOTPStep(now)-1, step)
+
+	_, ok = libs.ValidateTOTP(rfc6238Secret, previous, now, 0)
+	assert.False(t, ok)
+	_, ok = libs.ValidateTOTP(rfc6238Secret, "12345", now, 1)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := libs.GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	uri := libs.TOTPURI("Global Auth", "user@example.com", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Global%20Auth:user@example.com?"))
+	assert.Contains(t, uri, "secret="+secret)
+	assert.Contains(t, uri, "issuer=Global+Auth")
+	assert.Contains(t, uri, "digits=6")
+}
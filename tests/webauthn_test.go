@@ -0,0 +1,230 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"global-auth-server/libs"
+	"global-auth-server/services"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadWebAuthnConfigFromEnv_DefaultsToPublicURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "https://auth.example.com:8443/base")
+	t.Setenv("WEBAUTHN_RP_ID", "")
+	t.Setenv("WEBAUTHN_RP_NAME", "")
+	t.Setenv("WEBAUTHN_ORIGINS", "")
+
+	config := libs.LoadWebAuthnConfigFromEnv()
+	assert.Equal(t, "auth.example.com", config.RPID)
+	assert.Equal(t, "Global Auth", config.RPName)
+	assert.Equal(t, []string{"https://auth.example.com:8443"}, config.Origins)
+}
+
+func TestLoadWebAuthnConfigFromEnv_ExplicitOrigins(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "https://auth.example.com")
+	t.Setenv("WEBAUTHN_RP_ID", "example.com")
+	t.Setenv("WEBAUTHN_ORIGINS", "https://app.example.com, https://auth.example.com")
+
+	config := libs.LoadWebAuthnConfigFromEnv()
+	assert.Equal(t, "example.com", config.RPID)
+	assert.Equal(t, []string{"https://app.example.com", "https://auth.example.com"}, config.Origins)
+}
+
+// capturedBytes matches any []byte argument and keeps it.
+type capturedBytes struct{ value []byte }
+
+func (c *capturedBytes) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	c.value = b
+	return ok
+}
+
+// softAuthenticator is a software passkey: an ES256 key pair registered
+// under a credential id.
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	require.NoError(t, err)
+	return &softAuthenticator{key: key, id: id}
+}
+
+// authenticatorData builds the authenticator data with user presence and
+// user verification, plus the attested credential on registration.
+func (a *softAuthenticator) authenticatorData(t *testing.T, rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	if !attested {
+		return data
+	}
+
+	public, err := a.key.PublicKey.ECDH()
+	require.NoError(t, err)
+	point := public.Bytes()
+	coseKey, err := cbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]})
+	require.NoError(t, err)
+	data = append(data, make([]byte, 16)...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+	data = append(data, a.id...)
+	return append(data, coseKey...)
+}
+
+func clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64, origin string) []byte {
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge.String(), "origin": origin})
+	require.NoError(t, err)
+	return data
+}
+
+// register answers navigator.credentials.create with a "none" attestation.
+func (a *softAuthenticator) register(t *testing.T, creation *protocol.CredentialCreation, origin string) []byte {
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(t, creation.Response.RelyingParty.ID, true),
+	})
+	require.NoError(t, err)
+	response, err := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", creation.Response.Challenge, origin)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+	require.NoError(t, err)
+	return response
+}
+
+// assert answers navigator.credentials.get, signing the challenge.
+func (a *softAuthenticator) assert(t *testing.T, assertion *protocol.CredentialAssertion, origin string, userHandle string) []byte {
+	a.counter++
+	authData := a.authenticatorData(t, assertion.Response.RelyingPartyID, false)
+	clientDataJSON := clientData(t, "webauthn.get", assertion.Response.Challenge, origin)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	response, err := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString([]byte(userHandle)),
+		},
+	})
+	require.NoError(t, err)
+	return response
+}
+
+func TestWebAuthn_RegistrationAndLoginCeremony(t *testing.T) {
+	t.Setenv("WEBAUTHN_RP_ID", "auth.example.com")
+	t.Setenv("WEBAUTHN_ORIGINS", "https://auth.example.com")
+	const origin = "https://auth.example.com"
+	mock := mockDB(t)
+	user := &services.User{ID: "7", Email: "ana@example.com", Names: "Ana"}
+	authenticator := newSoftAuthenticator(t)
+	credentialColumns := []string{"id", "user_id", "name", "credential", "created_at", "last_used_at"}
+	sessionColumns := []string{"purpose", "user_id", "audience", "data"}
+
+	// Registration
+	session := &capturedBytes{}
+	mock.ExpectQuery(`FROM webauthn_credentials`).WithArgs("7").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	mock.ExpectExec(`DELETE FROM webauthn_sessions WHERE expires_at < now\(\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO webauthn_sessions`).
+		WithArgs(sqlmock.AnyArg(), "registration", "7", "", session, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	creation, sessionID, err := services.BeginWebAuthnRegistration(user)
+	require.NoError(t, err)
+
+	stored := &capturedBytes{}
+	mock.ExpectQuery(`DELETE FROM webauthn_sessions\s+WHERE session_hash`).
+		WithArgs(libs.HashOpaqueToken(sessionID), "registration").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow("registration", "7", "", session.value))
+	mock.ExpectQuery(`FROM webauthn_credentials`).WithArgs("7").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	mock.ExpectQuery(`INSERT INTO webauthn_credentials`).
+		WithArgs(base64.RawURLEncoding.EncodeToString(authenticator.id), "7", "Portátil", stored).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	credential, err := services.FinishWebAuthnRegistration(user, sessionID, "Portátil", authenticator.register(t, creation, origin))
+	require.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(authenticator.id), credential.ID)
+
+	credentialRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(credentialColumns).AddRow(credential.ID, "7", "Portátil", stored.value, time.Now(), nil)
+	}
+
+	// Login as the second factor of user 7
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM webauthn_credentials`).WithArgs("7").WillReturnRows(credentialRows())
+	mock.ExpectExec(`DELETE FROM webauthn_sessions WHERE expires_at < now\(\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO webauthn_sessions`).
+		WithArgs(sqlmock.AnyArg(), "login", "7", "portal", session, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assertion, sessionID, err := services.BeginWebAuthnLogin("7", "portal")
+	require.NoError(t, err)
+	require.Len(t, assertion.Response.AllowedCredentials, 1)
+
+	mock.ExpectQuery(`DELETE FROM webauthn_sessions\s+WHERE session_hash`).
+		WithArgs(libs.HashOpaqueToken(sessionID), "login").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow("login", "7", "portal", session.value))
+	mock.ExpectQuery(`FROM users`).WithArgs("7").WillReturnRows(userRows("7", "ana@example.com", nil, false))
+	mock.ExpectQuery(`FROM webauthn_credentials`).WithArgs("7").WillReturnRows(credentialRows())
+	mock.ExpectExec(`UPDATE webauthn_credentials`).
+		WithArgs(credential.ID, "7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	loggedIn, audience, err := services.FinishWebAuthnLogin(sessionID, "7", authenticator.assert(t, assertion, origin, "7"))
+	require.NoError(t, err)
+	assert.Equal(t, "7", loggedIn.ID)
+	assert.Equal(t, "portal", audience)
+}
+
+func TestCheckMFA_AsksPasskeyUsersForThePasskey(t *testing.T) {
+	mock := mockDB(t)
+	state := func(enabled, required, passkeys bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"enabled", "required", "passkeys"}).AddRow(enabled, required, passkeys)
+	}
+
+	// A role requiring MFA is satisfied by a passkey, no TOTP enrollment
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").WillReturnRows(state(false, true, true))
+	assert.ErrorIs(t, services.CheckMFA("7", ""), services.ErrPasskeyRequired)
+
+	// The password alone is not enough once the user has a passkey
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").WillReturnRows(state(false, false, true))
+	assert.ErrorIs(t, services.CheckMFA("7", ""), services.ErrPasskeyRequired)
+
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").WillReturnRows(state(false, true, false))
+	assert.ErrorIs(t, services.CheckMFA("7", ""), services.ErrMFAEnrollmentRequired)
+
+	mock.ExpectQuery(`FROM user_mfa`).WithArgs("7").WillReturnRows(state(false, false, false))
+	assert.NoError(t, services.CheckMFA("7", ""))
+}